@@ -1,20 +1,122 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
 	"github.com/hizkifw/hako/pkg/hako"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/fx"
+	"go.uber.org/fx/fxevent"
 )
 
 func main() {
+	args := os.Args[1:]
+
+	// Print the effective configuration
+	if len(args) >= 2 && args[0] == "config" && args[1] == "print" {
+		cfg := loadConfig(args[2:])
+		if err := hako.PrintConfig(os.Stdout, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Import or export the blocklist, read from stdin or written to stdout
+	if len(args) >= 2 && args[0] == "blocklist" {
+		cfg := loadConfig(args[2:])
+		if err := runBlocklist(args[1], cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Requests are logged by the server, so gin's own logs are only wanted
+	// when asked for
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	cfg := loadConfig(args)
 	fx.New(
-		fx.Provide(hako.ConfigFromEnv),
+		fx.WithLogger(func(logger *slog.Logger) fxevent.Logger {
+			l := &fxevent.SlogLogger{Logger: logger.With("component", "fx")}
+			l.UseLogLevel(slog.LevelDebug)
+			return l
+		}),
+		// Leave the server time to drain requests before Fx gives up
+		fx.StopTimeout(cfg.ShutdownTimeout+15*time.Second),
+		fx.Supply(cfg, hako.ConfigArgs(args)),
+		fx.Provide(hako.FxNewLiveConfig),
+		fx.Provide(hako.FxNewLogger),
+		fx.Provide(hako.FxNewTracerProvider),
 		fx.Provide(hako.FxNewDB),
-		fx.Provide(hako.FxNewLocalFS),
+		fx.Provide(hako.NewEvents),
+		fx.Provide(hako.FxNewFS),
 		fx.Provide(hako.FxNewGC),
+		fx.Provide(hako.FxNewScanQueue),
+		fx.Provide(hako.FxNewWebhooks),
 		fx.Provide(hako.FxNewServer),
 		fx.Invoke(func(db *hako.DB) {
 			db.Migrate()
 		}),
-		fx.Invoke(func(*hako.Server, *hako.GC) {}),
+		fx.Invoke(func(trace.TracerProvider, *hako.Server, *hako.GC, *hako.ScanQueue, *hako.Webhooks) {}),
+		fx.Invoke(hako.FxNotifySystemd),
 	).Run()
 }
+
+// loadConfig loads the configuration, and exits if it is invalid.
+func loadConfig(args []string) *hako.Config {
+	cfg, err := hako.LoadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(2)
+	}
+	return cfg
+}
+
+// runBlocklist imports a blocklist file from stdin into the database, or
+// exports the blocklist to stdout.
+func runBlocklist(command string, cfg *hako.Config) error {
+	db, err := hako.NewDB(cfg.DbLocation)
+	if err != nil {
+		return err
+	}
+	if err := db.Migrate(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "import":
+		entries, err := hako.ParseBlocklist(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("invalid blocklist: %v", err)
+		}
+		added, expired, err := db.ImportBlocklist(ctx, entries)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Blocked %d new hashes, %d stored files will be removed\n", added, expired)
+		return nil
+	case "export":
+		entries, err := db.ExportBlocklist(ctx)
+		if err != nil {
+			return err
+		}
+		return hako.WriteBlocklist(os.Stdout, entries)
+	default:
+		return fmt.Errorf("unknown blocklist command %q, must be import or export", command)
+	}
+}
@@ -0,0 +1,336 @@
+package hako
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminFile is the representation of a file in the admin API.
+type AdminFile struct {
+	ID           string     `json:"id"`
+	Slug         string     `json:"slug,omitempty"`
+	Filename     string     `json:"filename"`
+	MimeType     string     `json:"mime_type"`
+	Size         int64      `json:"size"`
+	Sha256       string     `json:"sha256"`
+	IPAddress    string     `json:"ip_address"`
+	UserAgent    string     `json:"user_agent"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	Downloads    int64      `json:"downloads"`
+	MaxDownloads int64      `json:"max_downloads"`
+	ScanStatus   ScanStatus `json:"scan_status"`
+	Removed      bool       `json:"removed"`
+	Private      bool       `json:"private"`
+	RemovedAt    *time.Time `json:"removed_at,omitempty"`
+}
+
+// AdminInfo returns the representation of the file in the admin API.
+func (f *DbFile) AdminInfo() AdminFile {
+	info := AdminFile{
+		ID:           strconv.FormatInt(f.ID, 36),
+		Slug:         f.Slug,
+		Filename:     f.OriginalFilename,
+		MimeType:     f.MimeType,
+		Size:         f.Size,
+		Sha256:       f.Sha256,
+		IPAddress:    f.IPAddress,
+		UserAgent:    f.UserAgent,
+		CreatedAt:    f.CreatedAt(),
+		ExpiresAt:    f.ExpiresAt,
+		Downloads:    f.Downloads,
+		MaxDownloads: f.MaxDownloads,
+		ScanStatus:   f.ScanStatus,
+		Removed:      f.Removed,
+		Private:      f.AccessKeyHash != "",
+	}
+	if !f.RemovedAt.IsZero() {
+		info.RemovedAt = &f.RemovedAt
+	}
+	return info
+}
+
+// AdminPatchRequest is the body of a PATCH request to the admin API. Omitted
+// fields are left unchanged.
+type AdminPatchRequest struct {
+	// Expiry is the new time to live of the file, counted from now. Unlike
+	// uploaders, admins are not held to the maximum TTL.
+	Expiry *string `json:"expiry"`
+
+	// Quarantined puts the file on hold, so that it is no longer served, or
+	// releases it.
+	Quarantined *bool `json:"quarantined"`
+}
+
+// requireAdmin only lets requests with the admin token through, given as a
+// bearer token or as the password of basic authentication, so that browsers
+// can log in to the dashboard. The admin routes do not exist when no admin
+// token is configured.
+//
+// Browsers send basic authentication along with cross-site requests too, so
+// changes made with it must also have the X-Requested-With header, which
+// cross-site forms cannot set, and scripts on other sites cannot set without
+// a CORS preflight that is never allowed.
+func (s *Server) requireAdmin(c *gin.Context) {
+	cfg := s.config.Load()
+	if cfg.AdminToken == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	token := RequestToken(c)
+	_, password, basic := c.Request.BasicAuth()
+	if basic {
+		token = password
+	}
+	if !cfg.IsAdminToken(token) {
+		c.Header("WWW-Authenticate", `Basic realm="hako admin"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Admin token required"})
+		return
+	}
+
+	safe := c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || c.Request.Method == http.MethodOptions
+	if basic && !safe && c.GetHeader("X-Requested-With") == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "X-Requested-With header required"})
+		return
+	}
+
+	c.Next()
+}
+
+// queryInt returns the integer query parameter with the given name, or def
+// if it is not set, clamped to [0, max].
+func queryInt(c *gin.Context, name string, def, max int) (int, bool) {
+	v := c.Query(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid %s", name)})
+		return 0, false
+	}
+	return min(n, max), true
+}
+
+// adminListFiles lists files that are not removed, or recently removed ones
+// with ?removed=true, optionally filtered with ?q=.
+func (s *Server) adminListFiles(c *gin.Context) {
+	limit, ok := queryInt(c, "limit", 50, 500)
+	if !ok {
+		return
+	}
+	offset, ok := queryInt(c, "offset", 0, 1<<30)
+	if !ok {
+		return
+	}
+
+	files, total, err := s.db.ListFiles(c.Request.Context(), FileQuery{
+		Search:  c.Query("q"),
+		Removed: c.Query("removed") == "true",
+		Limit:   limit,
+		Offset:  offset,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	infos := make([]AdminFile, len(files))
+	for i, file := range files {
+		infos[i] = file.AdminInfo()
+	}
+	c.JSON(http.StatusOK, gin.H{"files": infos, "total": total})
+}
+
+// adminFindFile looks up a file with the given base36 ID, whether it is live
+// or not. If the file does not exist, an error response is written and false
+// is returned.
+func (s *Server) adminFindFile(c *gin.Context) (*DbFile, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 36, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return nil, false
+	}
+
+	file, err := s.db.GetFile(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+
+	setLogFileID(c, file)
+	return file, true
+}
+
+// adminGetFile returns a file, including removed ones.
+func (s *Server) adminGetFile(c *gin.Context) {
+	file, ok := s.adminFindFile(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, file.AdminInfo())
+}
+
+// adminPatchFile extends a file, or quarantines or releases it.
+func (s *Server) adminPatchFile(c *gin.Context) {
+	ctx := c.Request.Context()
+	file, ok := s.adminFindFile(c)
+	if !ok {
+		return
+	}
+	if file.Removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	var req AdminPatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parsing request: %s", err)})
+		return
+	}
+
+	if req.Expiry != nil {
+		ttl, err := ParseExpiry(*req.Expiry)
+		if err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expiry"})
+			return
+		}
+
+		expiresAt := time.Now().Add(ttl)
+		updated, err := s.db.UpdateFile(ctx, file.ID, FileUpdate{ExpiresAt: &expiresAt})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !updated {
+			c.JSON(http.StatusConflict, gin.H{"error": "File is up for garbage collection"})
+			return
+		}
+	}
+
+	// Quarantine applies to the contents, and so to every file sharing them.
+	// Released contents are scanned again, since they may have been put on
+	// hold before their scan.
+	if req.Quarantined != nil {
+		var status ScanStatus
+		switch {
+		case *req.Quarantined && (file.ScanStatus == ScanClean || file.ScanStatus == ScanPending):
+			status = ScanQuarantined
+		case !*req.Quarantined && file.ScanStatus == ScanQuarantined && s.scans.Enabled():
+			status = ScanPending
+		case !*req.Quarantined && file.ScanStatus == ScanQuarantined:
+			status = ScanClean
+		case *req.Quarantined != (file.ScanStatus == ScanQuarantined):
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("File is %s", file.ScanStatus)})
+			return
+		}
+		if status != "" {
+			if err := s.db.SetScanStatus(ctx, file.FilePath, status); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			RequestLogger(c).Info("Changed scan status", "file_id", file.ID, "path", file.FilePath, "scan_status", status)
+			if status == ScanPending {
+				s.scans.Enqueue(file.ID)
+			}
+		}
+	}
+
+	file, err := s.db.GetFile(ctx, file.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, file.AdminInfo())
+}
+
+// adminDeleteFile removes any file.
+func (s *Server) adminDeleteFile(c *gin.Context) {
+	file, ok := s.adminFindFile(c)
+	if !ok {
+		return
+	}
+	if file.Removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	if !s.removeFile(c, file) {
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// adminUsage returns the current storage usage, and its history over the
+// last ?days=, 7 by default, as recorded by garbage collection.
+func (s *Server) adminUsage(c *gin.Context) {
+	ctx := c.Request.Context()
+	days, ok := queryInt(c, "days", 7, 90)
+	if !ok {
+		return
+	}
+
+	usage, err := s.db.GetStorageUsage(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Keep the history to a couple hundred points
+	window := time.Duration(max(days, 1)) * 24 * time.Hour
+	interval := max(time.Minute, (window / 200).Truncate(time.Minute))
+	points, err := s.db.ListUsageHistory(ctx, time.Now().Add(-window), interval)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	history := make([]gin.H, len(points))
+	for i, point := range points {
+		history[i] = gin.H{"time": point.Time, "files": point.Files, "bytes": point.Bytes}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"files":   usage.Files,
+		"blobs":   usage.Blobs,
+		"bytes":   usage.Bytes,
+		"history": history,
+	})
+}
+
+// adminListGCRuns returns the most recent rounds of garbage collection, up to
+// ?limit=.
+func (s *Server) adminListGCRuns(c *gin.Context) {
+	limit, ok := queryInt(c, "limit", 50, 500)
+	if !ok {
+		return
+	}
+
+	runs, err := s.db.ListGCRuns(c.Request.Context(), time.Time{}, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := make([]gin.H, len(runs))
+	for i, run := range runs {
+		entry := gin.H{
+			"started_at":  run.StartedAt,
+			"duration_ms": run.Duration.Milliseconds(),
+			"removed":     run.Removed,
+			"scrubbed":    run.Scrubbed,
+			"corrupt":     run.Corrupt,
+			"files":       run.Usage.Files,
+			"bytes":       run.Usage.Bytes,
+		}
+		if run.Error != "" {
+			entry["error"] = run.Error
+		}
+		result[i] = entry
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": result})
+}
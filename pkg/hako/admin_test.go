@@ -0,0 +1,230 @@
+package hako_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerAdminAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	// The admin routes do not exist without an admin token
+	srv, _, _ := newTestServer(t, &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour})
+	status, _ := doRequest(t, http.MethodGet, srv.URL+"/admin/api/files", "", nil)
+	assert.Equal(http.StatusNotFound, status, "Admin API should be disabled")
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, AdminToken: "admin-token", APIKeys: []string{"api-key"}}
+	srv, _, _ = newTestServer(t, cfg)
+
+	res, err := http.Get(srv.URL + "/admin")
+	assert.Nil(err, "Failed to get dashboard")
+	res.Body.Close()
+	assert.Equal(http.StatusUnauthorized, res.StatusCode, "Dashboard should require the admin token")
+	assert.Contains(res.Header.Get("WWW-Authenticate"), "Basic", "Browsers should be asked to log in")
+
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/admin/api/files", "api-key", nil)
+	assert.Equal(http.StatusUnauthorized, status, "API keys should not grant admin access")
+
+	// Browsers log in with basic authentication
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin", nil)
+	req.SetBasicAuth("admin", "admin-token")
+	res, err = http.DefaultClient.Do(req)
+	assert.Nil(err, "Failed to get dashboard")
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode, "Dashboard should be served")
+	assert.Contains(res.Header.Get("Content-Type"), "text/html", "Dashboard should be HTML")
+
+	// Changes with basic authentication must not come from cross-site forms
+	req, _ = http.NewRequest(http.MethodPost, srv.URL+"/admin/api/files/zzzzzz/takedown", nil)
+	req.SetBasicAuth("admin", "admin-token")
+	res, err = http.DefaultClient.Do(req)
+	assert.Nil(err, "Failed to send request")
+	res.Body.Close()
+	assert.Equal(http.StatusForbidden, res.StatusCode, "Changes without X-Requested-With should be refused")
+
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	res, err = http.DefaultClient.Do(req)
+	assert.Nil(err, "Failed to send request")
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode, "Changes from the dashboard should be allowed")
+
+	status, _ = doRequest(t, http.MethodPost, srv.URL+"/admin/api/files/zzzzzz/takedown", "admin-token", nil)
+	assert.Equal(http.StatusNotFound, status, "Bearer tokens should not need X-Requested-With")
+
+	// The dashboard directory is not served as web content
+	res, err = http.Head(srv.URL + "/admin")
+	assert.Nil(err, "Failed to send request")
+	res.Body.Close()
+	assert.NotEqual(http.StatusOK, res.StatusCode, "Dashboard should not be served without the admin token")
+}
+
+func TestServerAdminFiles(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, AdminToken: "admin-token"}
+	srv, db, _ := newTestServer(t, cfg)
+
+	var ids []string
+	for _, name := range []string{"cat.txt", "dog.txt", "cat_100%.txt"} {
+		status, upload := doRequest(t, http.MethodPut, srv.URL+"/"+url.PathEscape(name), "", "Hello, "+name)
+		assert.Equal(http.StatusOK, status, "Upload should succeed")
+		ids = append(ids, upload["id"].(string))
+	}
+
+	// Files are listed most recent first, and can be searched
+	status, res := doRequest(t, http.MethodGet, srv.URL+"/admin/api/files", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Listing files should succeed")
+	assert.Equal(float64(3), res["total"], "All files should be counted")
+	files := res["files"].([]any)
+	first := files[0].(map[string]any)
+	assert.Equal(ids[2], first["id"], "Most recent file should be first")
+	assert.Equal("127.0.0.1", first["ip_address"], "Uploader IP address should be listed")
+	assert.Equal(float64(len("Hello, cat_100%.txt")), first["size"], "Size should be listed")
+
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/admin/api/files?q=cat", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Searching files should succeed")
+	assert.Equal(float64(2), res["total"], "Search should match the filename")
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/admin/api/files?q=_100%25", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Searching files should succeed")
+	assert.Equal(float64(1), res["total"], "Wildcards in the search should match literally")
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/admin/api/files?limit=1&offset=1", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Paging files should succeed")
+	assert.Len(res["files"], 1, "Page should be limited")
+	assert.Equal(ids[1], res["files"].([]any)[0].(map[string]any)["id"], "Page should be offset")
+
+	// Files can be extended past the maximum TTL
+	status, res = doRequest(t, http.MethodPatch, srv.URL+"/admin/api/files/"+ids[0], "admin-token", map[string]any{"expiry": "30d"})
+	assert.Equal(http.StatusOK, status, "Extending a file should succeed")
+	expiresAt, err := time.Parse(time.RFC3339, res["expires_at"].(string))
+	assert.Nil(err, "Failed to parse expiry")
+	assert.WithinDuration(time.Now().Add(30*24*time.Hour), expiresAt, time.Minute, "Expiry should be extended")
+
+	// Quarantined files are not served until released
+	status, res = doRequest(t, http.MethodPatch, srv.URL+"/admin/api/files/"+ids[0], "admin-token", map[string]any{"quarantined": true})
+	assert.Equal(http.StatusOK, status, "Quarantining a file should succeed")
+	assert.Equal("quarantined", res["scan_status"], "File should be quarantined")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+ids[0], "", nil)
+	assert.Equal(http.StatusForbidden, status, "Quarantined file should not be served")
+
+	status, _ = doRequest(t, http.MethodPatch, srv.URL+"/admin/api/files/"+ids[0], "admin-token", map[string]any{"quarantined": false})
+	assert.Equal(http.StatusOK, status, "Releasing a file should succeed")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+ids[0], "", nil)
+	assert.Equal(http.StatusOK, status, "Released file should be served")
+
+	// Deleted files are listed as removed
+	status, _ = doRequest(t, http.MethodDelete, srv.URL+"/admin/api/files/"+ids[1], "admin-token", nil)
+	assert.Equal(http.StatusNoContent, status, "Deleting a file should succeed")
+	status, _ = doRequest(t, http.MethodDelete, srv.URL+"/admin/api/files/"+ids[1], "admin-token", nil)
+	assert.Equal(http.StatusNotFound, status, "Deleting a file twice should fail")
+
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/admin/api/files?removed=true", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Listing removed files should succeed")
+	assert.Equal(float64(1), res["total"], "Deleted file should be listed as removed")
+	removed := res["files"].([]any)[0].(map[string]any)
+	assert.Equal(ids[1], removed["id"], "Removed file mismatch")
+	assert.NotEmpty(removed["removed_at"], "Removal time should be recorded")
+
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/admin/api/files/"+ids[1], "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Removed files should be found")
+	assert.Equal(true, res["removed"], "File should be removed")
+
+	// Storage usage counts the live files
+	usage, err := db.GetStorageUsage(ctx)
+	assert.Nil(err, "Failed to get storage usage")
+	assert.Equal(int64(2), usage.Files, "Live files should be counted")
+
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/admin/api/usage", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Getting usage should succeed")
+	assert.Equal(float64(2), res["files"], "Usage should count live files")
+	assert.Equal(float64(usage.Bytes), res["bytes"], "Usage should count stored bytes")
+}
+
+func TestServerAdminReleaseRescans(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	fs, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err, "Failed to listen on TCP")
+	fakeClamd(t, l)
+
+	// The scan loop is not running, so uploads stay pending until scanned
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, AdminToken: "admin-token"}
+	scans := hako.NewScanQueue(db, fs, hako.NewClamdScanner(l.Addr().String()))
+	server := hako.NewServer(db, fs, hako.NewLiveConfig(cfg), scans, hako.NewEvents())
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	id := upload["id"].(string)
+	assert.Equal("pending", upload["scan_status"], "Upload should wait for its scan")
+
+	// A file quarantined before its scan is still scanned once released
+	status, res := doRequest(t, http.MethodPatch, srv.URL+"/admin/api/files/"+id, "admin-token", map[string]any{"quarantined": true})
+	assert.Equal(http.StatusOK, status, "Quarantining a file should succeed")
+	assert.Equal("quarantined", res["scan_status"], "File should be quarantined")
+	status, res = doRequest(t, http.MethodPatch, srv.URL+"/admin/api/files/"+id, "admin-token", map[string]any{"quarantined": false})
+	assert.Equal(http.StatusOK, status, "Releasing a file should succeed")
+	assert.Equal("pending", res["scan_status"], "Released file should be scanned again")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+id, "", nil)
+	assert.Equal(http.StatusLocked, status, "Released file should not be served before its scan")
+
+	assert.Nil(scans.ScanFile(ctx, mustFileID(t, id)), "Failed to scan file")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+id, "", nil)
+	assert.Equal(http.StatusOK, status, "Scanned file should be served")
+}
+
+func TestServerAdminGCRuns(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, AdminToken: "admin-token"}
+	srv, db, fs := newTestServer(t, cfg)
+
+	status, _ := doRequest(t, http.MethodPut, srv.URL+"/file.txt", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+
+	// Rounds of garbage collection are recorded with the storage usage
+	gc := hako.NewGC(db, fs, hako.NewEvents())
+	gc.Interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	go gc.LoopForever(ctx)
+	assert.Eventually(func() bool {
+		_, res := doRequest(t, http.MethodGet, srv.URL+"/admin/api/gc?limit=2", "admin-token", nil)
+		runs, _ := res["runs"].([]any)
+		return len(runs) == 2
+	}, time.Second, 5*time.Millisecond, "GC runs should be recorded")
+	cancel()
+	<-gc.Done()
+
+	status, res := doRequest(t, http.MethodGet, srv.URL+"/admin/api/gc", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Listing GC runs should succeed")
+	run := res["runs"].([]any)[0].(map[string]any)
+	assert.Equal(float64(1), run["files"], "Run should record the live files")
+	assert.Equal(float64(len("Hello, World!")), run["bytes"], "Run should record the stored bytes")
+
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/admin/api/usage", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Getting usage should succeed")
+	assert.NotEmpty(res["history"], "Usage history should come from the GC runs")
+
+	// Old records are deleted
+	assert.Nil(db.DeleteGCRuns(context.Background(), time.Now().Add(time.Hour)), "Failed to delete GC runs")
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/admin/api/gc", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Listing GC runs should succeed")
+	assert.Empty(res["runs"], "Old GC runs should be deleted")
+}
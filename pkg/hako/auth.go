@@ -0,0 +1,95 @@
+package hako
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NewToken returns a random URL-safe token with 128 bits of entropy.
+func NewToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// HashToken returns the hex-encoded SHA-256 hash of a token, for storage in
+// the database.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequestToken returns the token presented by the client, either as a bearer
+// token in the Authorization header or in the X-Hako-Token header.
+func RequestToken(c *gin.Context) string {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return c.GetHeader("X-Hako-Token")
+}
+
+// HasClientCert reports whether the client authenticated with a certificate
+// signed by the configured client CA, which grants the same access as an API
+// key.
+func HasClientCert(c *gin.Context) bool {
+	return c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) > 0
+}
+
+// IsAPIKey reports whether the token is one of the configured API keys.
+func (c *Config) IsAPIKey(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	match := 0
+	for _, key := range c.APIKeys {
+		match |= subtle.ConstantTimeCompare([]byte(token), []byte(key))
+	}
+	return match == 1
+}
+
+// IsAdminToken reports whether the token is the configured admin token.
+func (c *Config) IsAdminToken(token string) bool {
+	if token == "" || c.AdminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.AdminToken)) == 1
+}
+
+// CanManageFile reports whether the token is allowed to manage the file,
+// either because it is an API key or the delete token of the file.
+func (c *Config) CanManageFile(token string, file *DbFile) bool {
+	if token == "" {
+		return false
+	}
+	if c.IsAPIKey(token) {
+		return true
+	}
+	return file.DeleteTokenHash != "" &&
+		subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(file.DeleteTokenHash)) == 1
+}
+
+// AccessKeyParam is the query parameter in which the key of a private file is
+// passed.
+const AccessKeyParam = "k"
+
+// canAccessFile reports whether the client can access the file. Private files
+// need their key or a signed URL, unless the client can manage them.
+func canAccessFile(c *gin.Context, cfg *Config, file *DbFile) bool {
+	if file.AccessKeyHash == "" {
+		return true
+	}
+	if key := c.Query(AccessKeyParam); key != "" &&
+		subtle.ConstantTimeCompare([]byte(HashToken(key)), []byte(file.AccessKeyHash)) == 1 {
+		return true
+	}
+	return hasValidSignature(c, cfg, file) || HasClientCert(c) || cfg.CanManageFile(RequestToken(c), file)
+}
@@ -0,0 +1,159 @@
+package hako
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+)
+
+// BlocklistKind is the kind of hash in a blocklist entry.
+type BlocklistKind string
+
+const (
+	// BlockSha256 blocks contents by their SHA-256 hash.
+	BlockSha256 BlocklistKind = "sha256"
+	// BlockDHash blocks images by their perceptual hash, along with images
+	// that look like them.
+	BlockDHash BlocklistKind = "dhash"
+)
+
+// BlocklistEntry is a line of a blocklist file.
+type BlocklistEntry struct {
+	Kind BlocklistKind
+
+	// Hash is the hex-encoded hash.
+	Hash string
+
+	Reason string
+}
+
+// String formats the entry as a line of a blocklist file.
+func (e BlocklistEntry) String() string {
+	line := string(e.Kind) + ":" + e.Hash
+	if e.Reason != "" {
+		line += " " + e.Reason
+	}
+	return line
+}
+
+// ParseBlocklist reads a blocklist file. Each line is a hash, as
+// `sha256:<hex>` or `dhash:<hex>`, optionally followed by a reason. Bare
+// SHA-256 hashes are accepted too, so that the output of sha256sum can be
+// imported as is. Empty lines and lines starting with # are skipped.
+func ParseBlocklist(r io.Reader) ([]BlocklistEntry, error) {
+	var entries []BlocklistEntry
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hash, reason, _ := strings.Cut(line, " ")
+		entry := BlocklistEntry{Kind: BlockSha256, Reason: strings.TrimSpace(reason)}
+		if kind, rest, ok := strings.Cut(hash, ":"); ok {
+			entry.Kind, hash = BlocklistKind(strings.ToLower(kind)), rest
+		}
+
+		var ok bool
+		switch entry.Kind {
+		case BlockSha256:
+			entry.Hash, ok = parseSha256(hash)
+		case BlockDHash:
+			entry.Hash = strings.ToLower(hash)
+			_, ok = ParseDHash(entry.Hash)
+		}
+		if !ok {
+			return nil, fmt.Errorf("line %d: invalid hash %q", lineNo, hash)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// WriteBlocklist writes the entries as a blocklist file.
+func WriteBlocklist(w io.Writer, entries []BlocklistEntry) error {
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries {
+		if _, err := fmt.Fprintln(bw, entry.String()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// checkUploadBlocked writes an error response and returns false if uploaded
+// contents with the given hash are blocked, or if they are an image that
+// looks like a blocked one. Without the stored blob, only the hash is
+// checked. Rejected uploads are logged along with the uploader.
+func (s *Server) checkUploadBlocked(c *gin.Context, sha256 string, blob *Blob, detected *mimetype.MIME) bool {
+	ctx := c.Request.Context()
+	cfg := s.config.Load()
+	reject := func(attrs ...any) bool {
+		attrs = append(attrs, "ip", c.ClientIP(), "user_agent", c.GetHeader("User-Agent"))
+		RequestLogger(c).Warn("Rejecting upload of blocked contents", attrs...)
+		c.JSON(http.StatusUnavailableForLegalReasons, gin.H{"error": "These contents have been taken down"})
+		return false
+	}
+
+	blocked, err := s.db.IsHashBlocked(ctx, sha256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if blocked {
+		return reject("sha256", sha256)
+	}
+
+	if blob == nil || detected == nil || !slices.ContainsFunc(DHashMimes, detected.Is) {
+		return true
+	}
+	hashes, err := s.db.ListBlockedImageHashes(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if len(hashes) == 0 {
+		return true
+	}
+
+	// Images that cannot be decoded cannot look like a blocked one
+	dhash, err := s.imageDHash(ctx, blob.Path)
+	if err != nil {
+		RequestLogger(c).Debug("Failed to compute perceptual hash", "sha256", sha256, "error", err)
+		return true
+	}
+	for _, hash := range hashes {
+		if distance := DHashDistance(dhash, hash.DHash); distance <= cfg.BlocklistImageDistance {
+			return reject("sha256", sha256, "dhash", FormatDHash(dhash), "blocked_dhash", FormatDHash(hash.DHash), "distance", distance)
+		}
+	}
+	return true
+}
+
+// imageDHash computes the perceptual hash of a stored image.
+func (s *Server) imageDHash(ctx context.Context, filePath string) (uint64, error) {
+	r, err := readFileTraced(ctx, s.fs, filePath)
+	if err != nil {
+		return 0, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	_, span := tracer.Start(ctx, "ImageDHash")
+	dhash, err := ImageDHash(r)
+	endSpan(span, err)
+	return dhash, err
+}
@@ -0,0 +1,159 @@
+package hako_test
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+// testImage draws a w by h image of soft blobs, whose layout depends on seed.
+func testImage(w, h int, seed float64) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx, fy := float64(x)/float64(w), float64(y)/float64(h)
+			v := 0.5 + 0.25*math.Sin(6*fx+seed) + 0.25*math.Cos(5*fy*seed+fx)
+			c := uint8(math.Max(0, math.Min(255, v*255)))
+			img.Set(x, y, color.RGBA{c, c / 2, 255 - c, 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) string {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	return buf.String()
+}
+
+func TestParseBlocklist(t *testing.T) {
+	assert := assert.New(t)
+
+	sha := strings.Repeat("ab", 32)
+	entries, err := hako.ParseBlocklist(strings.NewReader(`
+# Known bad contents
+sha256:` + strings.ToUpper(sha) + ` court order
+dhash:00ff00ff00ff00ff
+` + strings.Repeat("cd", 32) + `  evil.bin
+`))
+	assert.Nil(err, "Failed to parse blocklist")
+	assert.Equal([]hako.BlocklistEntry{
+		{Kind: hako.BlockSha256, Hash: sha, Reason: "court order"},
+		{Kind: hako.BlockDHash, Hash: "00ff00ff00ff00ff"},
+		{Kind: hako.BlockSha256, Hash: strings.Repeat("cd", 32), Reason: "evil.bin"},
+	}, entries, "Entries mismatch")
+
+	var buf bytes.Buffer
+	assert.Nil(hako.WriteBlocklist(&buf, entries), "Failed to write blocklist")
+	again, err := hako.ParseBlocklist(&buf)
+	assert.Nil(err, "Failed to parse written blocklist")
+	assert.Equal(entries, again, "Blocklist should survive a round trip")
+
+	_, err = hako.ParseBlocklist(strings.NewReader("sha256:nope\n"))
+	assert.ErrorContains(err, "line 1", "Invalid hashes should be rejected")
+	_, err = hako.ParseBlocklist(strings.NewReader("md5:" + strings.Repeat("ab", 16) + "\n"))
+	assert.NotNil(err, "Unknown kinds should be rejected")
+}
+
+func TestDHash(t *testing.T) {
+	assert := assert.New(t)
+
+	original := testImage(320, 240, 1)
+	hash, err := hako.ImageDHash(bytes.NewReader([]byte(encodePNG(t, original))))
+	assert.Nil(err, "Failed to hash image")
+
+	// Resized and recompressed copies look the same
+	var buf bytes.Buffer
+	assert.Nil(jpeg.Encode(&buf, testImage(160, 120, 1), &jpeg.Options{Quality: 60}), "Failed to encode JPEG")
+	resized, err := hako.ImageDHash(bytes.NewReader(buf.Bytes()))
+	assert.Nil(err, "Failed to hash resized image")
+	assert.LessOrEqual(hako.DHashDistance(hash, resized), 4, "Resized image should be close")
+
+	other := hako.DHash(testImage(320, 240, 4))
+	assert.Greater(hako.DHashDistance(hash, other), 10, "Different image should be far")
+
+	parsed, ok := hako.ParseDHash(hako.FormatDHash(hash))
+	assert.True(ok, "Failed to parse hash")
+	assert.Equal(hash, parsed, "Hash should survive a round trip")
+
+	_, err = hako.ImageDHash(strings.NewReader("not an image"))
+	assert.NotNil(err, "Non-images should not be hashed")
+}
+
+func TestImportBlocklist(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	srv, db, _ := newTestServer(t, &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour})
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+
+	entries := []hako.BlocklistEntry{
+		{Kind: hako.BlockSha256, Hash: sha256Hex("Hello, World!"), Reason: "imported"},
+		{Kind: hako.BlockDHash, Hash: "00ff00ff00ff00ff"},
+	}
+	added, expired, err := db.ImportBlocklist(ctx, entries)
+	assert.Nil(err, "Failed to import blocklist")
+	assert.Equal(2, added, "Both entries should be added")
+	assert.Equal(1, expired, "Stored file should be expired")
+
+	// Expired files are collected as usual
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+upload["id"].(string), "", nil)
+	assert.Equal(http.StatusNotFound, status, "Blocked file should no longer be served")
+	expiredFiles, err := db.ListExpiredFiles(ctx)
+	assert.Nil(err, "Failed to list expired files")
+	assert.Len(expiredFiles, 1, "Blocked file should be up for garbage collection")
+
+	added, _, err = db.ImportBlocklist(ctx, entries)
+	assert.Nil(err, "Failed to import blocklist again")
+	assert.Zero(added, "Entries should not be added twice")
+
+	exported, err := db.ExportBlocklist(ctx)
+	assert.Nil(err, "Failed to export blocklist")
+	assert.ElementsMatch(entries, exported, "Exported blocklist mismatch")
+
+	_, _, err = db.ImportBlocklist(ctx, []hako.BlocklistEntry{{Kind: hako.BlockDHash, Hash: "nope"}})
+	assert.NotNil(err, "Invalid entries should be rejected")
+}
+
+func TestServerBlockImage(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, AdminToken: "admin-token", BlocklistImageDistance: 4}
+	srv, _, _ := newTestServer(t, cfg)
+
+	status, _ := doRequest(t, http.MethodPost, srv.URL+"/admin/api/blocklist", "admin-token",
+		map[string]any{"dhash": hako.FormatDHash(hako.DHash(testImage(320, 240, 1))), "reason": "known abuse"})
+	assert.Equal(http.StatusOK, status, "Blocking an image hash should succeed")
+
+	// Copies of the image are rejected, other images are not
+	var buf bytes.Buffer
+	assert.Nil(jpeg.Encode(&buf, testImage(160, 120, 1), &jpeg.Options{Quality: 60}), "Failed to encode JPEG")
+	status, _ = doRequest(t, http.MethodPut, srv.URL+"/copy.jpg", "", buf.String())
+	assert.Equal(http.StatusUnavailableForLegalReasons, status, "Copy of a blocked image should be rejected")
+	status, _ = doRequest(t, http.MethodPut, srv.URL+"/other.png", "", encodePNG(t, testImage(320, 240, 4)))
+	assert.Equal(http.StatusOK, status, "Other images should be accepted")
+
+	status, res := doRequest(t, http.MethodGet, srv.URL+"/admin/api/blocklist", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Listing the blocklist should succeed")
+	blocked := res["image_hashes"].([]any)[0].(map[string]any)
+	assert.Equal("known abuse", blocked["reason"], "Reason should be recorded")
+
+	status, _ = doRequest(t, http.MethodDelete, srv.URL+"/admin/api/blocklist/"+blocked["dhash"].(string), "admin-token", nil)
+	assert.Equal(http.StatusNoContent, status, "Unblocking should succeed")
+	status, _ = doRequest(t, http.MethodPut, srv.URL+"/copy.jpg", "", buf.String())
+	assert.Equal(http.StatusOK, status, "Unblocked image should be accepted")
+}
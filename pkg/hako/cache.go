@@ -0,0 +1,55 @@
+package hako
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/gin-gonic/gin"
+)
+
+// CreatedAt returns the upload time of the file, which is encoded in its ID.
+func (f *DbFile) CreatedAt() time.Time {
+	return time.UnixMilli(snowflake.ID(f.ID).Time())
+}
+
+// setCacheHeaders sets the Last-Modified and Cache-Control headers of a
+// download. Caches may keep the file until it expires, but not files with a
+// download limit, since downloads served from a cache would not be counted.
+// Private files are only kept by the browser, and signed URLs not at all, so
+// that they stop working when they expire. Browsers are told not to leak their
+// key or signature to other sites in the Referer header.
+func setCacheHeaders(c *gin.Context, file *DbFile) {
+	c.Header("Last-Modified", file.CreatedAt().UTC().Format(http.TimeFormat))
+
+	scope := "public"
+	if file.AccessKeyHash != "" {
+		scope = "private"
+	}
+	if file.AccessKeyHash != "" || isSigned(c) {
+		c.Header("Referrer-Policy", "no-referrer")
+	}
+
+	maxAge := int64(time.Until(file.ExpiresAt) / time.Second)
+	if file.MaxDownloads > 0 || maxAge <= 0 || isSigned(c) {
+		c.Header("Cache-Control", "no-store")
+		return
+	}
+	c.Header("Cache-Control", scope+", max-age="+strconv.FormatInt(maxAge, 10))
+}
+
+// notModified evaluates the If-None-Match and If-Modified-Since headers of a
+// download, and reports whether the client already has the file.
+// If-Modified-Since is ignored when If-None-Match is present.
+func notModified(c *gin.Context, file *DbFile, encoding string) bool {
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		return ETagMatches(inm, file.ETag(encoding))
+	}
+
+	ims, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !file.CreatedAt().Truncate(time.Second).After(ims)
+}
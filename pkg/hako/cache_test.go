@@ -0,0 +1,125 @@
+package hako_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerCacheHeaders(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour}
+	srv, db, _ := newTestServer(t, cfg)
+
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt?expiry=1h", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	id := upload["id"].(string)
+	url := srv.URL + "/" + id
+
+	file, err := db.GetFile(ctx, mustFileID(t, id))
+	assert.Nil(err, "Failed to get file")
+	assert.WithinDuration(time.Now(), file.CreatedAt(), time.Minute, "Upload time should be encoded in the ID")
+
+	// HEAD returns the headers without counting a download
+	res, err := http.Head(url)
+	assert.Nil(err, "Failed to send HEAD request")
+	assert.Equal(http.StatusOK, res.StatusCode, "HEAD should succeed")
+	assert.Equal(int64(13), res.ContentLength, "HEAD should return the content length")
+	assert.Equal(file.CreatedAt().UTC().Format(http.TimeFormat), res.Header.Get("Last-Modified"), "Last-Modified should be the upload time")
+	assert.NotEmpty(res.Header.Get("ETag"), "HEAD should return the ETag")
+
+	cacheControl := res.Header.Get("Cache-Control")
+	maxAge, err := strconv.Atoi(strings.TrimPrefix(cacheControl, "public, max-age="))
+	assert.Nil(err, "Cache-Control should have a max-age")
+	assert.InDelta(3600, maxAge, 5, "max-age should be bounded by the remaining TTL")
+
+	// If-Modified-Since returns not modified without counting a download
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("If-Modified-Since", res.Header.Get("Last-Modified"))
+	res, err = http.DefaultClient.Do(req)
+	assert.Nil(err, "Failed to revalidate file")
+	res.Body.Close()
+	assert.Equal(http.StatusNotModified, res.StatusCode, "File should not be modified")
+
+	req.Header.Set("If-Modified-Since", file.CreatedAt().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	res, err = http.DefaultClient.Do(req)
+	assert.Nil(err, "Failed to download file")
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode, "File should be modified since before the upload")
+
+	// If-Range with the Last-Modified date serves the range
+	req, _ = http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Range", "bytes=7-11")
+	req.Header.Set("If-Range", file.CreatedAt().UTC().Format(http.TimeFormat))
+	res, err = http.DefaultClient.Do(req)
+	assert.Nil(err, "Failed to download range")
+	data, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(http.StatusPartialContent, res.StatusCode, "Range should be served")
+	assert.Equal("World", string(data), "Range contents mismatch")
+
+	file, err = db.GetFile(ctx, file.ID)
+	assert.Nil(err, "Failed to get file")
+	assert.Equal(int64(1), file.Downloads, "Only the full download should be counted")
+
+	// Files with a download limit are not cached
+	status, upload = doRequest(t, http.MethodPut, srv.URL+"/once.txt?max_downloads=1", "", "secret")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	res, err = http.Head(srv.URL + "/" + upload["id"].(string))
+	assert.Nil(err, "Failed to send HEAD request")
+	assert.Equal("no-store", res.Header.Get("Cache-Control"), "Limited files should not be cached")
+}
+
+func TestServerRangeDownloadLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour}
+	srv, _, _ := newTestServer(t, cfg)
+
+	download := func(url, rng string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Range", rng)
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(err, "Failed to download range")
+		data, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode, string(data)
+	}
+
+	// A suffix range as long as the file is a whole download
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/once.txt?max_downloads=1", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	url := srv.URL + "/" + upload["id"].(string)
+
+	status, data := download(url, "bytes=-999999999")
+	assert.Equal(http.StatusPartialContent, status, "Suffix range covering the file should be served")
+	assert.Equal("Hello, World!", data, "Contents mismatch")
+	status, _ = download(url, "bytes=-999999999")
+	assert.Equal(http.StatusNotFound, status, "Suffix range should count as a download")
+
+	// Later parts can only be fetched after downloading the start
+	status, upload = doRequest(t, http.MethodPut, srv.URL+"/twice.txt?max_downloads=2", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	url = srv.URL + "/" + upload["id"].(string)
+
+	status, _ = download(url, "bytes=1-")
+	assert.Equal(http.StatusRequestedRangeNotSatisfiable, status, "Later part should be refused before a download")
+	status, _ = download(url, "bytes=0-4")
+	assert.Equal(http.StatusPartialContent, status, "Range from the start should be served")
+	status, data = download(url, "bytes=7-")
+	assert.Equal(http.StatusPartialContent, status, "Later part should be served after a download")
+	assert.Equal("World!", data, "Range contents mismatch")
+	status, _ = download(url, "bytes=0-")
+	assert.Equal(http.StatusPartialContent, status, "Second download should be served")
+	status, _ = download(url, "bytes=0-")
+	assert.Equal(http.StatusNotFound, status, "Used up file should be gone")
+}
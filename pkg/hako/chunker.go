@@ -0,0 +1,127 @@
+package hako
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// gearTable maps each byte to a random 64-bit value for the gear hash. It is
+// generated with splitmix64 from a fixed seed, so that chunk boundaries are
+// stable across restarts and versions.
+var gearTable = func() (table [256]uint64) {
+	seed := uint64(0x6861_6b6f_6764_6372)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker splits a stream into content-defined chunks with the FastCDC
+// algorithm, so that an insertion or deletion only changes the chunks around
+// it. Chunks are between MinSize and MaxSize bytes long, and AvgSize on
+// average.
+type Chunker struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+
+	// maskS is used before the chunk reaches AvgSize, and has more bits set
+	// to make a cut less likely. maskL is used after, and has fewer.
+	maskS uint64
+	maskL uint64
+}
+
+// NewChunker returns a chunker that reads from r. The average size is
+// rounded down to a power of two.
+func NewChunker(r io.Reader, minSize, avgSize, maxSize int) (*Chunker, error) {
+	if minSize <= 0 || minSize > avgSize || avgSize > maxSize {
+		return nil, errors.New("chunk sizes must satisfy 0 < min <= avg <= max")
+	}
+
+	avgBits := bits.Len(uint(avgSize)) - 1
+	if avgBits < 2 {
+		return nil, errors.New("average chunk size too small")
+	}
+
+	return &Chunker{
+		MinSize: minSize,
+		AvgSize: avgSize,
+		MaxSize: maxSize,
+		r:       r,
+		buf:     make([]byte, 2*maxSize),
+		maskS:   ^uint64(0) << (64 - avgBits - 1),
+		maskL:   ^uint64(0) << (64 - avgBits + 1),
+	}, nil
+}
+
+// Next returns the next chunk, or io.EOF when the stream is exhausted. The
+// chunk is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	// Make sure a full chunk is buffered, unless the stream is exhausted
+	if c.end-c.start < c.MaxSize && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+
+		for c.end < len(c.buf) && !c.eof {
+			n, err := c.r.Read(c.buf[c.end:])
+			c.end += n
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.MinSize {
+		return n
+	}
+	if n > c.MaxSize {
+		n = c.MaxSize
+	}
+	normal := c.AvgSize
+	if normal > n {
+		normal = n
+	}
+
+	var hash uint64
+	i := c.MinSize
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskS == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskL == 0 {
+			return i
+		}
+	}
+	return n
+}
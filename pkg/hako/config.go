@@ -1,9 +1,9 @@
 package hako
 
 import (
-	"log"
+	"log/slog"
+	"net/netip"
 	"os"
-	"strconv"
 	"time"
 )
 
@@ -13,26 +13,131 @@ type Config struct {
 	FsRoot         string
 	FsMaxFileSize  int64
 	FsMaxTTL       time.Duration
-}
 
-func ConfigFromEnv() *Config {
-	fileSizeMax, err := strconv.ParseInt(os.Getenv("HAKO_FS_MAX_FILE_SIZE"), 10, 64)
-	if err != nil {
-		log.Printf("failed to parse HAKO_FS_MAX_FILE_SIZE: %v", err)
-		fileSizeMax = 0
-	}
-
-	ttlMax, err := ParseExpiry(os.Getenv("HAKO_FS_MAX_TTL"))
-	if err != nil {
-		log.Printf("failed to parse HAKO_FS_MAX_TTL: %v", err)
-		ttlMax = 0
-	}
-
-	return &Config{
-		HttpListenAddr: os.Getenv("HAKO_HTTP_LISTEN_ADDR"),
-		DbLocation:     os.Getenv("HAKO_DB_LOCATION"),
-		FsRoot:         os.Getenv("HAKO_FS_ROOT"),
-		FsMaxFileSize:  fileSizeMax,
-		FsMaxTTL:       ttlMax,
-	}
+	// HttpSocketMode is the permissions of the socket when HttpListenAddr is
+	// a unix socket. See Listen for the supported addresses.
+	HttpSocketMode os.FileMode
+
+	// FsBackend selects how files are stored under FsRoot, either `local`
+	// (the default) to store each file whole, or `chunked` to split files
+	// into chunks shared between similar files. The backends store files in
+	// different layouts, so it cannot be changed on an existing FsRoot.
+	FsBackend string
+
+	// FsCompressMime lists the mime types of files that are stored gzipped.
+	// See MatchMime for the pattern syntax. Compression is disabled when
+	// empty.
+	FsCompressMime []string
+
+	// ScrubInterval is how often the contents of each file are re-hashed to
+	// detect corruption, or 0 to disable scrubbing.
+	ScrubInterval time.Duration
+
+	// UploadAllowMime and UploadDenyMime restrict uploads by their sniffed
+	// mime type. See MatchMime for the pattern syntax.
+	UploadAllowMime []string
+	UploadDenyMime  []string
+
+	// UploadMimeLimits overrides FsMaxFileSize and FsMaxTTL per mime type.
+	UploadMimeLimits []MimeLimit
+
+	// ScannerClamdAddr is the address of a clamd daemon used to scan uploads,
+	// either `unix:/path/to/clamd.sock` or `host:port`. Scanning is disabled
+	// when empty, and files still waiting for a scan are then marked clean on
+	// startup.
+	ScannerClamdAddr string
+
+	// WebhookURLs receive a POST request for every file lifecycle event, signed
+	// with WebhookSecret.
+	WebhookURLs   []string
+	WebhookSecret string
+
+	// EventsStreamEnabled enables streaming file lifecycle events on
+	// /events. Upload progress events are always available to the uploader.
+	EventsStreamEnabled bool
+
+	// APIKeys can manage any file, in addition to the per-file delete token
+	// returned on upload.
+	APIKeys []string
+
+	// AdminToken grants access to the admin dashboard and API on /admin,
+	// which are disabled when it is empty.
+	AdminToken string
+
+	// BlocklistImageDistance is the number of bits the perceptual hash of an
+	// uploaded image can differ by from a blocked one and still match it.
+	BlocklistImageDistance int
+
+	// TrustedProxies are the networks of the reverse proxies whose
+	// ClientIPHeaders are believed to tell the address of the client.
+	// Requests over a unix socket always come from a trusted proxy.
+	TrustedProxies  []netip.Prefix
+	ClientIPHeaders []string
+
+	// DenyIPs bans clients in these networks from everything but the health
+	// checks.
+	DenyIPs []netip.Prefix
+
+	// UploadIPs restricts the clients that can upload and manage files,
+	// DownloadIPs the clients that can download them, and AdminIPs the
+	// clients that can use the admin dashboard and API.
+	UploadIPs   IPRules
+	DownloadIPs IPRules
+	AdminIPs    IPRules
+
+	// IDFormat is how the IDs that new files are linked by are generated,
+	// unless the uploader picks a slug. See the IDFormat constants.
+	IDFormat IDFormat
+
+	// PrivateLinks makes new uploads private by default, so that they can
+	// only be accessed with the random key in their link. Uploaders can opt
+	// in or out with the private query parameter.
+	PrivateLinks bool
+
+	// SigningSecret is the key that signed download URLs are signed with.
+	// Signed URLs are disabled when it is empty.
+	SigningSecret string
+
+	// RequireSignedURLs only lets files be downloaded with a signed URL, or by
+	// clients that can manage them.
+	RequireSignedURLs bool
+
+	// DedupMode controls which existing contents a client can reuse by hash
+	// instead of uploading them again. See the DedupMode constants.
+	DedupMode DedupMode
+
+	// LogFormat is the format of log lines, either `text` or `json`, and
+	// LogLevel the minimum level of logs that are written.
+	LogFormat string
+	LogLevel  slog.Level
+
+	// HealthGCMaxMissed is the number of garbage collection intervals that can
+	// pass without a completed round before /livez reports the server as
+	// stuck.
+	HealthGCMaxMissed int
+
+	// ShutdownTimeout is how long requests in flight, such as uploads, are
+	// given to finish on shutdown before they are aborted.
+	ShutdownTimeout time.Duration
+
+	// TLSCertFile and TLSKeyFile enable HTTPS on HttpListenAddr with the
+	// certificate in the given PEM files, which is reloaded when they change.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSClientCAFile lets clients authenticate with a certificate signed by
+	// one of the CAs in the given PEM file, as an alternative to an API key.
+	TLSClientCAFile string
+
+	// TLSRedirectAddr is the address of a plain HTTP listener that redirects
+	// to HTTPS, or empty to disable it.
+	TLSRedirectAddr string
+
+	// TLSHSTSMaxAge is the max-age of the Strict-Transport-Security header
+	// sent over HTTPS, or 0 to not send it.
+	TLSHSTSMaxAge time.Duration
+
+	// TracingEndpoint is the OTLP/HTTP endpoint that traces are exported to.
+	// Tracing is disabled when empty.
+	TracingEndpoint string
 }
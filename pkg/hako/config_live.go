@@ -0,0 +1,135 @@
+package hako
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"go.uber.org/fx"
+)
+
+// LiveConfig holds the current configuration, which can be swapped while the
+// server is running. Readers should Load the configuration once per request
+// or round of work, and use that snapshot throughout, so that they never see
+// a mix of old and new values.
+type LiveConfig struct {
+	current atomic.Pointer[Config]
+
+	// args are the command-line flags the configuration was loaded with, which
+	// keep overriding the config file and environment on reload.
+	args []string
+
+	Logger *slog.Logger
+}
+
+func NewLiveConfig(cfg *Config) *LiveConfig {
+	l := &LiveConfig{Logger: slog.Default().With("component", "config")}
+	l.current.Store(cfg)
+	return l
+}
+
+// Load returns the current configuration. It must not be modified.
+func (l *LiveConfig) Load() *Config {
+	return l.current.Load()
+}
+
+// Reload loads the configuration again from the config file, environment and
+// the flags it was first loaded with. The current configuration is kept if
+// the new one is invalid. Options that are only read on startup keep their
+// current values. It returns the changes that were applied.
+func (l *LiveConfig) Reload() ([]string, error) {
+	cfg, err := LoadConfig(l.args)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, ignored := diffConfig(l.Load(), cfg)
+	for _, key := range ignored {
+		l.Logger.Warn("Ignoring change until restart", "option", key)
+	}
+	l.current.Store(cfg)
+	return changes, nil
+}
+
+// diffConfig describes the options that differ between old and cfg, and
+// resets the options that need a restart to their old values in cfg, which
+// are returned separately.
+func diffConfig(old, cfg *Config) (changes, ignored []string) {
+	for _, o := range configOptions {
+		from, to := o.get(old), o.get(cfg)
+		if from == to {
+			continue
+		}
+
+		if o.Restart {
+			ignored = append(ignored, o.Key)
+			if err := o.set(cfg, from); err != nil {
+				panic(fmt.Sprintf("failed to restore %s: %v", o.Key, err))
+			}
+			continue
+		}
+
+		if o.Secret {
+			changes = append(changes, o.Key+" changed")
+		} else {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", o.Key, from, to))
+		}
+	}
+	return changes, ignored
+}
+
+// ReloadOnSignal reloads the configuration whenever the process receives
+// SIGHUP, until the context is cancelled.
+func (l *LiveConfig) ReloadOnSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+
+		changes, err := l.Reload()
+		if err != nil {
+			l.Logger.Error("Failed to reload configuration, keeping the current one", "error", err)
+			continue
+		}
+		if len(changes) == 0 {
+			l.Logger.Info("Reloaded configuration, nothing changed")
+		}
+		for _, change := range changes {
+			l.Logger.Info("Changed configuration", "change", change)
+		}
+	}
+}
+
+// FxNewLiveConfig creates a LiveConfig for Fx, which is reloaded on SIGHUP
+// with the same command-line flags.
+func FxNewLiveConfig(cfg *Config, args ConfigArgs, lc fx.Lifecycle) *LiveConfig {
+	l := NewLiveConfig(cfg)
+	l.args = args
+	ctx, cancel := context.WithCancel(context.Background())
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go l.ReloadOnSignal(ctx)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			return nil
+		},
+	})
+
+	return l
+}
+
+// ConfigArgs are the command-line flags the configuration was loaded with.
+type ConfigArgs []string
@@ -0,0 +1,559 @@
+package hako
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// configOption describes a configuration option, which can be set with a key
+// in the config file, an environment variable or a command-line flag, in
+// increasing order of precedence.
+type configOption struct {
+	// Key is the name of the option in the config file. The flag name is the
+	// key with underscores replaced by dashes.
+	Key     string
+	Env     string
+	Default string
+	Usage   string
+
+	// Bool options can be given as a flag without a value.
+	Bool bool
+
+	// Secret options are redacted when the configuration is printed.
+	Secret bool
+
+	// Restart options are only read on startup, and are not changed when the
+	// configuration is reloaded.
+	Restart bool
+
+	set func(c *Config, v string) error
+	get func(c *Config) string
+}
+
+func (o *configOption) flagName() string {
+	return strings.ReplaceAll(o.Key, "_", "-")
+}
+
+// newOption returns the option with the given setter and getter.
+func newOption(o configOption, set func(c *Config, v string) error, get func(c *Config) string) *configOption {
+	o.set, o.get = set, get
+	return &o
+}
+
+func stringOption(o configOption, p func(c *Config) *string) *configOption {
+	return newOption(o, func(c *Config, v string) error {
+		*p(c) = v
+		return nil
+	}, func(c *Config) string {
+		return *p(c)
+	})
+}
+
+func listOption(o configOption, p func(c *Config) *[]string) *configOption {
+	return newOption(o, func(c *Config, v string) error {
+		*p(c) = splitList(v)
+		return nil
+	}, func(c *Config) string {
+		return strings.Join(*p(c), ",")
+	})
+}
+
+func prefixListOption(o configOption, p func(c *Config) *[]netip.Prefix) *configOption {
+	return newOption(o, func(c *Config, v string) error {
+		prefixes, err := ParsePrefixes(splitList(v))
+		if err != nil {
+			return err
+		}
+		*p(c) = prefixes
+		return nil
+	}, func(c *Config) string {
+		entries := make([]string, len(*p(c)))
+		for i, prefix := range *p(c) {
+			entries[i] = prefix.String()
+		}
+		return strings.Join(entries, ",")
+	})
+}
+
+func durationOption(o configOption, p func(c *Config) *time.Duration) *configOption {
+	return newOption(o, func(c *Config, v string) error {
+		d, err := ParseExpiry(v)
+		if err != nil {
+			return err
+		}
+		*p(c) = d
+		return nil
+	}, func(c *Config) string {
+		return FormatExpiry(*p(c))
+	})
+}
+
+func boolOption(o configOption, p func(c *Config) *bool) *configOption {
+	o.Bool = true
+	return newOption(o, func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		*p(c) = b
+		return nil
+	}, func(c *Config) string {
+		return strconv.FormatBool(*p(c))
+	})
+}
+
+// configOptions is the list of all configuration options.
+var configOptions = []*configOption{
+	stringOption(configOption{Key: "http_listen_addr", Env: "HAKO_HTTP_LISTEN_ADDR", Default: ":8080", Restart: true,
+		Usage: "address to listen on for HTTP: host:port, unix:/path/to.sock, or systemd[:name] for socket activation"},
+		func(c *Config) *string { return &c.HttpListenAddr }),
+	newOption(configOption{Key: "http_socket_mode", Env: "HAKO_HTTP_SOCKET_MODE", Default: "0660", Restart: true,
+		Usage: "permissions of unix sockets, in octal"},
+		func(c *Config, v string) error {
+			mode, err := strconv.ParseUint(v, 8, 32)
+			if err != nil || mode > 0777 {
+				return errors.New("must be octal permissions such as 0660")
+			}
+			c.HttpSocketMode = os.FileMode(mode)
+			return nil
+		}, func(c *Config) string {
+			return fmt.Sprintf("%04o", uint32(c.HttpSocketMode))
+		}),
+	stringOption(configOption{Key: "db_location", Env: "HAKO_DB_LOCATION", Default: "hako.sqlite3", Restart: true,
+		Usage: "path to the SQLite database"},
+		func(c *Config) *string { return &c.DbLocation }),
+	stringOption(configOption{Key: "fs_root", Env: "HAKO_FS_ROOT", Default: "data", Restart: true,
+		Usage: "directory to store files in"},
+		func(c *Config) *string { return &c.FsRoot }),
+	newOption(configOption{Key: "fs_max_file_size", Env: "HAKO_FS_MAX_FILE_SIZE", Default: "104857600",
+		Usage: "maximum size of an upload in bytes"},
+		func(c *Config, v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return errors.New("must be a number of bytes")
+			}
+			c.FsMaxFileSize = n
+			return nil
+		}, func(c *Config) string {
+			return strconv.FormatInt(c.FsMaxFileSize, 10)
+		}),
+	durationOption(configOption{Key: "fs_max_ttl", Env: "HAKO_FS_MAX_TTL", Default: "24h",
+		Usage: "maximum time to keep a file, e.g. 3600s, 24h or 7d"},
+		func(c *Config) *time.Duration { return &c.FsMaxTTL }),
+	stringOption(configOption{Key: "fs_backend", Env: "HAKO_FS_BACKEND", Default: "local", Restart: true,
+		Usage: "how files are stored: local or chunked"},
+		func(c *Config) *string { return &c.FsBackend }),
+	listOption(configOption{Key: "fs_compress_mime", Env: "HAKO_FS_COMPRESS_MIME", Restart: true,
+		Usage: "comma-separated mime types of files to store gzipped"},
+		func(c *Config) *[]string { return &c.FsCompressMime }),
+	durationOption(configOption{Key: "scrub_interval", Env: "HAKO_SCRUB_INTERVAL", Default: FormatExpiry(DefaultScrubInterval),
+		Usage: "how often stored files are re-hashed to detect corruption, or 0s to disable"},
+		func(c *Config) *time.Duration { return &c.ScrubInterval }),
+	listOption(configOption{Key: "upload_allow_mime", Env: "HAKO_UPLOAD_ALLOW_MIME",
+		Usage: "comma-separated mime types allowed for upload, or empty to allow all"},
+		func(c *Config) *[]string { return &c.UploadAllowMime }),
+	listOption(configOption{Key: "upload_deny_mime", Env: "HAKO_UPLOAD_DENY_MIME",
+		Usage: "comma-separated mime types denied for upload"},
+		func(c *Config) *[]string { return &c.UploadDenyMime }),
+	newOption(configOption{Key: "upload_mime_limits", Env: "HAKO_UPLOAD_MIME_LIMITS",
+		Usage: "comma-separated per-mime limits in the form pattern=ttl[:size]"},
+		func(c *Config, v string) error {
+			limits, err := ParseMimeLimits(v)
+			if err != nil {
+				return err
+			}
+			c.UploadMimeLimits = limits
+			return nil
+		}, func(c *Config) string {
+			entries := make([]string, len(c.UploadMimeLimits))
+			for i, limit := range c.UploadMimeLimits {
+				entries[i] = limit.String()
+			}
+			return strings.Join(entries, ",")
+		}),
+	stringOption(configOption{Key: "scanner_clamd_addr", Env: "HAKO_SCANNER_CLAMD_ADDR", Restart: true,
+		Usage: "clamd address to scan uploads with, unix:/path or host:port; if unset, pending files are served unscanned"},
+		func(c *Config) *string { return &c.ScannerClamdAddr }),
+	listOption(configOption{Key: "webhook_urls", Env: "HAKO_WEBHOOK_URLS", Restart: true,
+		Usage: "comma-separated URLs to send file events to"},
+		func(c *Config) *[]string { return &c.WebhookURLs }),
+	stringOption(configOption{Key: "webhook_secret", Env: "HAKO_WEBHOOK_SECRET", Secret: true, Restart: true,
+		Usage: "secret to sign webhook requests with"},
+		func(c *Config) *string { return &c.WebhookSecret }),
+	boolOption(configOption{Key: "events_stream", Env: "HAKO_EVENTS_STREAM", Default: "false",
+		Usage: "stream file events on /events"},
+		func(c *Config) *bool { return &c.EventsStreamEnabled }),
+	listOption(configOption{Key: "api_keys", Env: "HAKO_API_KEYS", Secret: true,
+		Usage: "comma-separated keys that can manage any file"},
+		func(c *Config) *[]string { return &c.APIKeys }),
+	stringOption(configOption{Key: "admin_token", Env: "HAKO_ADMIN_TOKEN", Secret: true,
+		Usage: "token to access the admin dashboard on /admin with, or empty to disable it"},
+		func(c *Config) *string { return &c.AdminToken }),
+	newOption(configOption{Key: "blocklist_image_distance", Env: "HAKO_BLOCKLIST_IMAGE_DISTANCE", Default: "4",
+		Usage: "number of bits the perceptual hash of an image can differ by from a blocked one"},
+		func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return errors.New("must be a number")
+			}
+			c.BlocklistImageDistance = n
+			return nil
+		}, func(c *Config) string {
+			return strconv.Itoa(c.BlocklistImageDistance)
+		}),
+	prefixListOption(configOption{Key: "trusted_proxies", Env: "HAKO_TRUSTED_PROXIES",
+		Usage: "comma-separated networks of reverse proxies whose client IP headers are trusted"},
+		func(c *Config) *[]netip.Prefix { return &c.TrustedProxies }),
+	listOption(configOption{Key: "client_ip_headers", Env: "HAKO_CLIENT_IP_HEADERS", Default: "X-Forwarded-For,X-Real-IP",
+		Usage: "comma-separated headers that trusted proxies pass the client IP in"},
+		func(c *Config) *[]string { return &c.ClientIPHeaders }),
+	prefixListOption(configOption{Key: "deny_ips", Env: "HAKO_DENY_IPS",
+		Usage: "comma-separated networks banned from all routes"},
+		func(c *Config) *[]netip.Prefix { return &c.DenyIPs }),
+	prefixListOption(configOption{Key: "upload_allow_ips", Env: "HAKO_UPLOAD_ALLOW_IPS",
+		Usage: "comma-separated networks allowed to upload and manage files, or empty to allow all"},
+		func(c *Config) *[]netip.Prefix { return &c.UploadIPs.Allow }),
+	prefixListOption(configOption{Key: "upload_deny_ips", Env: "HAKO_UPLOAD_DENY_IPS",
+		Usage: "comma-separated networks denied from uploading and managing files"},
+		func(c *Config) *[]netip.Prefix { return &c.UploadIPs.Deny }),
+	prefixListOption(configOption{Key: "download_allow_ips", Env: "HAKO_DOWNLOAD_ALLOW_IPS",
+		Usage: "comma-separated networks allowed to download files, or empty to allow all"},
+		func(c *Config) *[]netip.Prefix { return &c.DownloadIPs.Allow }),
+	prefixListOption(configOption{Key: "download_deny_ips", Env: "HAKO_DOWNLOAD_DENY_IPS",
+		Usage: "comma-separated networks denied from downloading files"},
+		func(c *Config) *[]netip.Prefix { return &c.DownloadIPs.Deny }),
+	prefixListOption(configOption{Key: "admin_allow_ips", Env: "HAKO_ADMIN_ALLOW_IPS",
+		Usage: "comma-separated networks allowed to use the admin dashboard, or empty to allow all"},
+		func(c *Config) *[]netip.Prefix { return &c.AdminIPs.Allow }),
+	prefixListOption(configOption{Key: "admin_deny_ips", Env: "HAKO_ADMIN_DENY_IPS",
+		Usage: "comma-separated networks denied from using the admin dashboard"},
+		func(c *Config) *[]netip.Prefix { return &c.AdminIPs.Deny }),
+	newOption(configOption{Key: "id_format", Env: "HAKO_ID_FORMAT", Default: string(IDBase36),
+		Usage: "how the IDs of new files are generated: base36, words or crockford"},
+		func(c *Config, v string) error {
+			format, err := ParseIDFormat(v)
+			if err != nil {
+				return err
+			}
+			c.IDFormat = format
+			return nil
+		}, func(c *Config) string {
+			return string(c.IDFormat)
+		}),
+	boolOption(configOption{Key: "private_links", Env: "HAKO_PRIVATE_LINKS", Default: "false",
+		Usage: "make new uploads private, accessible only with the key in their link"},
+		func(c *Config) *bool { return &c.PrivateLinks }),
+	stringOption(configOption{Key: "signing_secret", Env: "HAKO_SIGNING_SECRET", Secret: true,
+		Usage: "secret to sign download URLs with, or empty to disable signed URLs"},
+		func(c *Config) *string { return &c.SigningSecret }),
+	boolOption(configOption{Key: "require_signed_urls", Env: "HAKO_REQUIRE_SIGNED_URLS", Default: "false",
+		Usage: "only serve downloads with a signed URL"},
+		func(c *Config) *bool { return &c.RequireSignedURLs }),
+	newOption(configOption{Key: "dedup_mode", Env: "HAKO_DEDUP_MODE", Default: string(DedupPrivate),
+		Usage: "which stored contents clients can reuse by hash: off, public or private"},
+		func(c *Config, v string) error {
+			mode, err := ParseDedupMode(v)
+			if err != nil {
+				return err
+			}
+			c.DedupMode = mode
+			return nil
+		}, func(c *Config) string {
+			return string(c.DedupMode)
+		}),
+	stringOption(configOption{Key: "log_format", Env: "HAKO_LOG_FORMAT", Default: "text", Restart: true,
+		Usage: "format of log lines: text or json"},
+		func(c *Config) *string { return &c.LogFormat }),
+	newOption(configOption{Key: "log_level", Env: "HAKO_LOG_LEVEL", Default: "info",
+		Usage: "minimum level of logs: debug, info, warn or error"},
+		func(c *Config, v string) error {
+			return c.LogLevel.UnmarshalText([]byte(v))
+		}, func(c *Config) string {
+			return strings.ToLower(c.LogLevel.String())
+		}),
+	newOption(configOption{Key: "health_gc_max_missed", Env: "HAKO_HEALTH_GC_MAX_MISSED", Default: "3",
+		Usage: "number of garbage collection intervals without a completed round before /livez fails"},
+		func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return errors.New("must be a number")
+			}
+			c.HealthGCMaxMissed = n
+			return nil
+		}, func(c *Config) string {
+			return strconv.Itoa(c.HealthGCMaxMissed)
+		}),
+	durationOption(configOption{Key: "shutdown_timeout", Env: "HAKO_SHUTDOWN_TIMEOUT", Default: "30s", Restart: true,
+		Usage: "how long requests in flight are given to finish on shutdown"},
+		func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	stringOption(configOption{Key: "tls_cert_file", Env: "HAKO_TLS_CERT_FILE", Restart: true,
+		Usage: "PEM certificate to serve HTTPS with, reloaded when it changes"},
+		func(c *Config) *string { return &c.TLSCertFile }),
+	stringOption(configOption{Key: "tls_key_file", Env: "HAKO_TLS_KEY_FILE", Restart: true,
+		Usage: "PEM private key of the certificate"},
+		func(c *Config) *string { return &c.TLSKeyFile }),
+	stringOption(configOption{Key: "tls_client_ca_file", Env: "HAKO_TLS_CLIENT_CA_FILE", Restart: true,
+		Usage: "PEM CA certificates that client certificates are accepted from, as an alternative to API keys"},
+		func(c *Config) *string { return &c.TLSClientCAFile }),
+	stringOption(configOption{Key: "tls_redirect_addr", Env: "HAKO_TLS_REDIRECT_ADDR", Restart: true,
+		Usage: "address to listen on for HTTP and redirect to HTTPS, or empty to disable"},
+		func(c *Config) *string { return &c.TLSRedirectAddr }),
+	durationOption(configOption{Key: "tls_hsts_max_age", Env: "HAKO_TLS_HSTS_MAX_AGE", Default: "0s",
+		Usage: "max-age of the Strict-Transport-Security header, or 0s to not send it"},
+		func(c *Config) *time.Duration { return &c.TLSHSTSMaxAge }),
+	stringOption(configOption{Key: "tracing_endpoint", Env: "HAKO_TRACING_ENDPOINT", Restart: true,
+		Usage: "OTLP/HTTP endpoint to export traces to, e.g. http://localhost:4318, or empty to disable tracing"},
+		func(c *Config) *string { return &c.TracingEndpoint }),
+}
+
+// DefaultConfig returns the configuration with every option set to its
+// default.
+func DefaultConfig() *Config {
+	cfg := &Config{}
+	for _, o := range configOptions {
+		if err := o.set(cfg, o.Default); err != nil {
+			panic(fmt.Sprintf("invalid default for %s: %v", o.Key, err))
+		}
+	}
+	return cfg
+}
+
+// LoadConfig loads the configuration from defaults, the config file given by
+// the --config flag or HAKO_CONFIG, environment variables and the
+// command-line flags in args, each overriding the previous. It fails on
+// unknown or invalid values rather than falling back to defaults.
+func LoadConfig(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	// Parse the flags first to find the config file, but apply them last
+	flags := flag.NewFlagSet("hako", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a TOML or YAML config file (env HAKO_CONFIG)")
+	flagValues := make(map[*configOption]string)
+	for _, o := range configOptions {
+		usage := fmt.Sprintf("%s (env %s)", o.Usage, o.Env)
+		record := func(v string) error {
+			flagValues[o] = v
+			return nil
+		}
+		if o.Bool {
+			flags.BoolFunc(o.flagName(), usage, record)
+		} else {
+			flags.Func(o.flagName(), usage, record)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	if *configPath == "" {
+		*configPath = os.Getenv("HAKO_CONFIG")
+	}
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, o := range configOptions {
+		if v := os.Getenv(o.Env); v != "" {
+			if err := o.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s: %v", v, o.Env, err)
+			}
+		}
+	}
+
+	for _, o := range configOptions {
+		if v, ok := flagValues[o]; ok {
+			if err := o.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("invalid value %q for --%s: %v", v, o.flagName(), err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile applies the options in a TOML or YAML config file, depending on its
+// extension.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	values := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("unsupported config file format %q, expected .toml, .yaml or .yml", filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	options := make(map[string]*configOption)
+	for _, o := range configOptions {
+		options[o.Key] = o
+	}
+
+	// Apply the keys in a stable order, so that errors are reproducible
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		o, ok := options[key]
+		if !ok {
+			return fmt.Errorf("unknown option %q in config file %s", key, path)
+		}
+
+		v, err := fileValue(values[key])
+		if err != nil {
+			return fmt.Errorf("invalid value for %s in config file %s: %v", key, path, err)
+		}
+		if err := o.set(c, v); err != nil {
+			return fmt.Errorf("invalid value %q for %s in config file %s: %v", v, key, path, err)
+		}
+	}
+
+	return nil
+}
+
+// fileValue converts a value from a config file to the string form used by
+// environment variables. Lists are joined with commas.
+func fileValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := fileValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported type %T", v)
+	}
+}
+
+// Validate checks that the configuration is usable.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.HttpListenAddr == "" {
+		errs = append(errs, errors.New("http_listen_addr must not be empty"))
+	}
+	if c.DbLocation == "" {
+		errs = append(errs, errors.New("db_location must not be empty"))
+	}
+	if c.FsRoot == "" {
+		errs = append(errs, errors.New("fs_root must not be empty"))
+	}
+	if c.FsMaxFileSize <= 0 {
+		errs = append(errs, errors.New("fs_max_file_size must be positive"))
+	}
+	if c.FsMaxTTL <= 0 {
+		errs = append(errs, errors.New("fs_max_ttl must be positive"))
+	}
+	if c.HealthGCMaxMissed <= 0 {
+		errs = append(errs, errors.New("health_gc_max_missed must be positive"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	if c.BlocklistImageDistance < 0 || c.BlocklistImageDistance > 64 {
+		errs = append(errs, errors.New("blocklist_image_distance must be between 0 and 64"))
+	}
+	if c.ScrubInterval < 0 {
+		errs = append(errs, errors.New("scrub_interval must not be negative"))
+	}
+	switch c.FsBackend {
+	case "local", "chunked":
+	default:
+		errs = append(errs, fmt.Errorf("fs_backend must be local or chunked, got %q", c.FsBackend))
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("log_format must be text or json, got %q", c.LogFormat))
+	}
+	for _, limit := range c.UploadMimeLimits {
+		if limit.MaxFileSize < 0 || limit.MaxTTL < 0 {
+			errs = append(errs, fmt.Errorf("upload_mime_limits entry %q must not be negative", limit.String()))
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("tls_cert_file and tls_key_file must be set together"))
+	}
+	if c.TLSCertFile == "" && (c.TLSClientCAFile != "" || c.TLSRedirectAddr != "") {
+		errs = append(errs, errors.New("tls_client_ca_file and tls_redirect_addr require tls_cert_file"))
+	}
+	if c.TLSHSTSMaxAge < 0 {
+		errs = append(errs, errors.New("tls_hsts_max_age must not be negative"))
+	}
+	if c.RequireSignedURLs && c.SigningSecret == "" {
+		errs = append(errs, errors.New("require_signed_urls requires signing_secret"))
+	}
+	if c.TracingEndpoint != "" {
+		parsed, err := url.Parse(c.TracingEndpoint)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing_endpoint %q must be an http or https URL", c.TracingEndpoint))
+		}
+	}
+	for _, u := range c.WebhookURLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("webhook_urls entry %q must be an http or https URL", u))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PrintConfig writes the configuration in the config file format, with
+// secrets redacted.
+func PrintConfig(w io.Writer, c *Config) error {
+	for _, o := range configOptions {
+		v := o.get(c)
+		if o.Secret && v != "" {
+			v = "<redacted>"
+		}
+
+		line, err := toml.Marshal(map[string]string{o.Key: v})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "# %s\n%s", o.Usage, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
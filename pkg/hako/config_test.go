@@ -0,0 +1,155 @@
+package hako_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := hako.LoadConfig(nil)
+	assert.Nil(err, "Defaults should be valid")
+	assert.Equal(":8080", cfg.HttpListenAddr, "Default listen address mismatch")
+	assert.Equal(24*time.Hour, cfg.FsMaxTTL, "Default max TTL mismatch")
+	assert.Equal(hako.DedupPrivate, cfg.DedupMode, "Default dedup mode mismatch")
+	assert.Equal("local", cfg.FsBackend, "Default backend mismatch")
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	tomlPath := filepath.Join(dir, "hako.toml")
+	assert.Nil(os.WriteFile(tomlPath, []byte(`
+http_listen_addr = ":9000"
+fs_max_ttl = "7d"
+fs_max_file_size = 1000
+api_keys = ["a", "b"]
+events_stream = true
+`), 0644), "Failed to write config file")
+
+	// The file overrides the defaults
+	cfg, err := hako.LoadConfig([]string{"--config", tomlPath})
+	assert.Nil(err, "Failed to load config")
+	assert.Equal(":9000", cfg.HttpListenAddr, "File should override defaults")
+	assert.Equal(7*24*time.Hour, cfg.FsMaxTTL, "Duration from file mismatch")
+	assert.Equal(int64(1000), cfg.FsMaxFileSize, "Number from file mismatch")
+	assert.Equal([]string{"a", "b"}, cfg.APIKeys, "List from file mismatch")
+	assert.True(cfg.EventsStreamEnabled, "Bool from file mismatch")
+
+	// Env overrides the file, and flags override env
+	t.Setenv("HAKO_CONFIG", tomlPath)
+	t.Setenv("HAKO_HTTP_LISTEN_ADDR", ":9001")
+	t.Setenv("HAKO_FS_MAX_TTL", "2h")
+	cfg, err = hako.LoadConfig([]string{"--fs-max-ttl", "1h", "--events-stream=false"})
+	assert.Nil(err, "Failed to load config")
+	assert.Equal(":9001", cfg.HttpListenAddr, "Env should override the file")
+	assert.Equal(time.Hour, cfg.FsMaxTTL, "Flag should override env")
+	assert.False(cfg.EventsStreamEnabled, "Flag should override the file")
+
+	// YAML works the same
+	yamlPath := filepath.Join(dir, "hako.yaml")
+	assert.Nil(os.WriteFile(yamlPath, []byte("dedup_mode: public\nupload_deny_mime:\n  - application/zip\n"), 0644), "Failed to write config file")
+	cfg, err = hako.LoadConfig([]string{"--config", yamlPath})
+	assert.Nil(err, "Failed to load config")
+	assert.Equal(hako.DedupPublic, cfg.DedupMode, "Value from YAML mismatch")
+	assert.Equal([]string{"application/zip"}, cfg.UploadDenyMime, "List from YAML mismatch")
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("HAKO_FS_MAX_TTL", "24hours")
+	_, err := hako.LoadConfig(nil)
+	assert.ErrorContains(err, "HAKO_FS_MAX_TTL", "Invalid env value should fail")
+
+	t.Setenv("HAKO_FS_MAX_TTL", "")
+	_, err = hako.LoadConfig([]string{"--fs-backend", "s3"})
+	assert.ErrorContains(err, "fs_backend", "Invalid backend should fail")
+
+	_, err = hako.LoadConfig([]string{"--fs-max-file-size", "0"})
+	assert.ErrorContains(err, "fs_max_file_size", "Zero size should fail")
+
+	_, err = hako.LoadConfig([]string{"--webhook-urls", "ftp://example.com"})
+	assert.ErrorContains(err, "webhook_urls", "Non-HTTP webhook should fail")
+
+	path := filepath.Join(t.TempDir(), "hako.toml")
+	assert.Nil(os.WriteFile(path, []byte(`fs_max_tll = "1h"`), 0644), "Failed to write config file")
+	_, err = hako.LoadConfig([]string{"--config", path})
+	assert.ErrorContains(err, "unknown option \"fs_max_tll\"", "Unknown key should fail")
+}
+
+func TestPrintConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := hako.LoadConfig([]string{
+		"--api-keys", "secret-key",
+		"--upload-mime-limits", "image/*=7d:500,*=24h",
+	})
+	assert.Nil(err, "Failed to load config")
+
+	var buf bytes.Buffer
+	assert.Nil(hako.PrintConfig(&buf, cfg), "Failed to print config")
+	out := buf.String()
+	assert.NotContains(out, "secret-key", "Secrets should be redacted")
+	assert.Contains(out, "api_keys = '<redacted>'", "Redacted secret mismatch")
+	assert.Contains(out, "upload_mime_limits = 'image/*=7d:500,*=1d'", "Mime limits should round-trip")
+
+	// The printed config can be loaded back
+	path := filepath.Join(t.TempDir(), "hako.toml")
+	assert.Nil(os.WriteFile(path, buf.Bytes(), 0644), "Failed to write config file")
+	loaded, err := hako.LoadConfig([]string{"--config", path})
+	assert.Nil(err, "Printed config should load")
+	assert.Equal(cfg.UploadMimeLimits, loaded.UploadMimeLimits, "Mime limits mismatch")
+}
+
+func TestLiveConfigReload(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "hako.toml")
+	write := func(contents string) {
+		assert.Nil(os.WriteFile(path, []byte(contents), 0644), "Failed to write config file")
+	}
+	write(`
+http_listen_addr = ":9000"
+fs_max_ttl = "1h"
+api_keys = ["old-key"]
+`)
+	t.Setenv("HAKO_CONFIG", path)
+
+	cfg, err := hako.LoadConfig(nil)
+	assert.Nil(err, "Failed to load config")
+	live := hako.NewLiveConfig(cfg)
+
+	// Nothing changed
+	changes, err := live.Reload()
+	assert.Nil(err, "Failed to reload config")
+	assert.Empty(changes, "Reload without changes should report none")
+
+	// Changes are applied, except for those that need a restart
+	write(`
+http_listen_addr = ":9001"
+fs_max_ttl = "7d"
+api_keys = ["new-key"]
+`)
+	changes, err = live.Reload()
+	assert.Nil(err, "Failed to reload config")
+	assert.Equal([]string{`fs_max_ttl: "1h" -> "7d"`, "api_keys changed"}, changes, "Changes mismatch")
+	assert.Equal(7*24*time.Hour, live.Load().FsMaxTTL, "New TTL should be applied")
+	assert.True(live.Load().IsAPIKey("new-key"), "New API key should be applied")
+	assert.Equal(":9000", live.Load().HttpListenAddr, "Listen address should need a restart")
+	assert.Equal(time.Hour, cfg.FsMaxTTL, "Old snapshot should not be modified")
+
+	// Invalid configuration is not applied
+	write(`fs_max_ttl = "forever"`)
+	_, err = live.Reload()
+	assert.ErrorContains(err, "fs_max_ttl", "Invalid config should fail to reload")
+	assert.Equal(7*24*time.Hour, live.Load().FsMaxTTL, "Current config should be kept")
+}
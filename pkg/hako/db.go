@@ -1,17 +1,28 @@
 package hako
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strconv"
 	"time"
 
 	"github.com/bwmarrin/snowflake"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 type DB struct {
 	db        *sql.DB
 	snowflake *snowflake.Node
+
+	// DownloadGracePeriod is how long a file that has used up its downloads
+	// is kept after its last download, so that the download can finish
+	// before the garbage collector deletes the contents.
+	DownloadGracePeriod time.Duration
+
+	Logger *slog.Logger
 }
 
 func NewDB(dbPath string) (*DB, error) {
@@ -20,52 +31,255 @@ func NewDB(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
+	// Each connection to an in-memory database gets its own database, so make
+	// sure all queries go through the same connection.
+	if dbPath == ":memory:" {
+		db.SetMaxOpenConns(1)
+	}
+
 	node, err := snowflake.NewNode(1)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create snowflake node: %v", err)
 	}
 
 	return &DB{
-		db:        db,
-		snowflake: node,
+		db:                  db,
+		snowflake:           node,
+		DownloadGracePeriod: 1 * time.Hour,
+		Logger:              slog.Default().With("component", "db"),
 	}, nil
 }
 
-func FxNewDB(cfg *Config) (*DB, error) {
-	return NewDB(cfg.DbLocation)
+func FxNewDB(cfg *Config, logger *slog.Logger) (*DB, error) {
+	db, err := NewDB(cfg.DbLocation)
+	if err != nil {
+		return nil, err
+	}
+	db.Logger = logger.With("component", "db")
+	return db, nil
+}
+
+// migrations is the list of schema migrations, applied in order. The index of
+// the last applied migration is tracked in the user_version pragma.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS files (
+		id INTEGER PRIMARY KEY,
+		file_path TEXT,
+		original_filename TEXT,
+		mime_type TEXT,
+		expires_at INTEGER,
+		removed BOOLEAN DEFAULT FALSE,
+		ip_address TEXT,
+		user_agent TEXT
+	)`,
+	`ALTER TABLE files ADD COLUMN scan_status TEXT NOT NULL DEFAULT 'clean'`,
+	`CREATE TABLE webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		delivered_at INTEGER,
+		last_error TEXT
+	);
+	CREATE INDEX webhook_deliveries_pending ON webhook_deliveries (next_attempt_at) WHERE delivered_at IS NULL`,
+	`ALTER TABLE files ADD COLUMN delete_token_hash TEXT NOT NULL DEFAULT '';
+	ALTER TABLE files ADD COLUMN downloads INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE files ADD COLUMN max_downloads INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN sha256 TEXT NOT NULL DEFAULT '';
+	ALTER TABLE files ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX files_sha256 ON files (sha256) WHERE sha256 != ''`,
+	`ALTER TABLE files ADD COLUMN scrubbed_at INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN removed_at INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX files_removed_at ON files (removed_at) WHERE removed = TRUE;
+	CREATE TABLE gc_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		started_at INTEGER NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		removed INTEGER NOT NULL,
+		scrubbed INTEGER NOT NULL,
+		corrupt INTEGER NOT NULL,
+		live_files INTEGER NOT NULL,
+		live_blobs INTEGER NOT NULL,
+		live_bytes INTEGER NOT NULL,
+		error TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX gc_runs_started_at ON gc_runs (started_at)`,
+	`CREATE TABLE reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		message TEXT NOT NULL DEFAULT '',
+		contact TEXT NOT NULL DEFAULT '',
+		ip_address TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		status TEXT NOT NULL DEFAULT 'open',
+		resolved_at INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX reports_status ON reports (status, created_at);
+	CREATE UNIQUE INDEX reports_open ON reports (file_id, ip_address) WHERE status = 'open';
+	CREATE TABLE blocked_hashes (
+		sha256 TEXT PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE blocked_image_hashes (
+		dhash INTEGER PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	)`,
+	`ALTER TABLE files ADD COLUMN slug TEXT;
+	CREATE UNIQUE INDEX files_slug ON files (slug) WHERE removed = FALSE`,
+	`ALTER TABLE files ADD COLUMN access_key_hash TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE file_downloaders (
+		file_id INTEGER NOT NULL,
+		ip_address TEXT NOT NULL,
+		PRIMARY KEY (file_id, ip_address)
+	)`,
+	`ALTER TABLE files ADD COLUMN delete_pending BOOLEAN NOT NULL DEFAULT FALSE;
+	CREATE INDEX files_delete_pending ON files (id) WHERE delete_pending = TRUE`,
+	`ALTER TABLE files ADD COLUMN last_download_at INTEGER NOT NULL DEFAULT 0`,
+}
+
+// deadFileCondition matches files that can no longer be downloaded and are up
+// for garbage collection, given the current time and the latest time the last
+// download may have been counted at, both in milliseconds, as returned by
+// deadFileArgs.
+const deadFileCondition = `(expires_at < ?
+	OR scan_status = 'infected'
+	OR (max_downloads > 0 AND downloads >= max_downloads AND last_download_at <= ?))`
+
+// deadFileArgs returns the arguments of deadFileCondition at the given time.
+// Files that have used up their downloads are only dead once the grace period
+// after their last download has passed.
+func (d *DB) deadFileArgs(now time.Time) (int64, int64) {
+	return now.UnixMilli(), now.Add(-d.DownloadGracePeriod).UnixMilli()
 }
 
 func (d *DB) Migrate() error {
-	_, err := d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS files (
-			id INTEGER PRIMARY KEY,
-			file_path TEXT,
-			original_filename TEXT,
-			mime_type TEXT,
-			expires_at INTEGER,
-			removed BOOLEAN DEFAULT FALSE,
-			ip_address TEXT,
-			user_agent TEXT
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create table: %v", err)
+	var version int
+	if err := d.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to get schema version: %v", err)
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := d.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration: %v", err)
+		}
+
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %v", version+1, err)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to set schema version: %v", err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %v", version+1, err)
+		}
+		d.Logger.Info("Applied migration", "version", version+1)
 	}
 
 	return nil
 }
 
+// CheckSchema checks that the database is reachable and that all migrations
+// have been applied.
+func (d *DB) CheckSchema(ctx context.Context) error {
+	var version int
+	if err := d.db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to get schema version: %v", err)
+	}
+	if version < len(migrations) {
+		return fmt.Errorf("schema version %d is behind %d", version, len(migrations))
+	}
+	return nil
+}
+
 // CreateFile creates a new file record in the database.
-func (d *DB) CreateFile(filePath, originalFilename, mimeType string, expiresAt time.Time, ipAddress, userAgent string) (int64, error) {
+func (d *DB) CreateFile(ctx context.Context, filePath, originalFilename, mimeType string, expiresAt time.Time, ipAddress, userAgent string) (int64, error) {
+	return d.InsertFile(ctx, &DbFile{
+		FilePath:         filePath,
+		OriginalFilename: originalFilename,
+		MimeType:         mimeType,
+		ExpiresAt:        expiresAt,
+		IPAddress:        ipAddress,
+		UserAgent:        userAgent,
+		ScanStatus:       ScanClean,
+	})
+}
+
+// ErrSlugTaken is returned when inserting a file whose slug is already used by
+// a file that has not been removed.
+var ErrSlugTaken = errors.New("slug is already taken")
+
+// ErrContentsGone is returned when inserting a file that shares the contents
+// of other files, after none of them are live anymore.
+var ErrContentsGone = errors.New("shared contents are no longer available")
+
+// InsertFile creates a new file record in the database from the given file,
+// ignoring its ID and Removed fields. The ID of the new record is returned.
+func (d *DB) InsertFile(ctx context.Context, file *DbFile) (int64, error) {
+	ctx, span := d.startSpan(ctx, "InsertFile")
+	defer span.End()
+
+	return d.insertFile(ctx, file, false)
+}
+
+// InsertSharedFile is like InsertFile, for a file that reuses the contents of
+// a live file. The record is only created if a live file still references the
+// contents when it is inserted, so that the garbage collector cannot delete
+// them from under the new file. Otherwise, ErrContentsGone is returned.
+func (d *DB) InsertSharedFile(ctx context.Context, file *DbFile) (int64, error) {
+	ctx, span := d.startSpan(ctx, "InsertSharedFile")
+	defer span.End()
+
+	return d.insertFile(ctx, file, true)
+}
+
+// insertFile inserts the file record, checking that the contents are still
+// referenced by a live file in the same statement if shared is set.
+func (d *DB) insertFile(ctx context.Context, file *DbFile, shared bool) (int64, error) {
+	var slug sql.NullString
+	if file.Slug != "" {
+		slug = sql.NullString{String: file.Slug, Valid: true}
+	}
+
 	id := d.snowflake.Generate().Int64()
-	_, err := d.db.Exec(`
-		INSERT INTO files (id, file_path, original_filename, mime_type, expires_at, ip_address, user_agent)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, id, filePath, originalFilename, mimeType, expiresAt.UnixMilli(), ipAddress, userAgent)
+	now, cutoff := d.deadFileArgs(time.Now())
+	res, err := d.db.ExecContext(ctx, `
+		INSERT INTO files (id, file_path, original_filename, mime_type, expires_at, ip_address, user_agent, scan_status, delete_token_hash, max_downloads, sha256, size, slug, access_key_hash)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT ? OR EXISTS (
+			SELECT 1 FROM files
+			WHERE file_path = ?
+			AND removed = FALSE
+			AND NOT `+deadFileCondition+`
+		)
+	`, id, file.FilePath, file.OriginalFilename, file.MimeType, file.ExpiresAt.UnixMilli(), file.IPAddress, file.UserAgent, file.ScanStatus, file.DeleteTokenHash, file.MaxDownloads,
+		file.Sha256, file.Size, slug, file.AccessKeyHash, shared, file.FilePath, now, cutoff)
 	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return 0, ErrSlugTaken
+		}
 		return 0, fmt.Errorf("failed to create file: %v", err)
 	}
 
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %v", err)
+	}
+	if n == 0 {
+		return 0, ErrContentsGone
+	}
+
 	return id, nil
 }
 
@@ -79,15 +293,94 @@ type DbFile struct {
 	Removed          bool
 	IPAddress        string
 	UserAgent        string
+	ScanStatus       ScanStatus
+
+	// DeleteTokenHash is the hex-encoded SHA-256 hash of the token that lets
+	// the uploader manage the file.
+	DeleteTokenHash string
+
+	// Downloads is the number of times the file has been downloaded, and
+	// MaxDownloads the number of downloads allowed, or 0 for unlimited.
+	Downloads    int64
+	MaxDownloads int64
+
+	// Sha256 is the hex-encoded SHA-256 hash of the contents and Size their
+	// size in bytes. Both are unset for files uploaded before they were
+	// recorded.
+	Sha256 string
+	Size   int64
+
+	// RemovedAt is the time the file was removed, which is zero for files
+	// that are not removed, or were removed before it was recorded.
+	RemovedAt time.Time
+
+	// Slug is the custom or generated ID the file is linked by, or empty if
+	// it is linked by its ID in base36.
+	Slug string
+
+	// AccessKeyHash is the hex-encoded SHA-256 hash of the key that private
+	// files can only be accessed with, or empty for files that anyone with
+	// their ID can access.
+	AccessKeyHash string
 }
 
-// GetFile returns a file record from the database based on the given file ID.
-func (d *DB) GetFile(id int64) (*DbFile, error) {
+// PublicID returns the ID the file is linked by.
+func (f *DbFile) PublicID() string {
+	if f.Slug != "" {
+		return f.Slug
+	}
+	return strconv.FormatInt(f.ID, 36)
+}
+
+// ScanStatus is the quarantine state of a file.
+type ScanStatus string
+
+const (
+	// ScanPending means the file has not been scanned yet.
+	ScanPending ScanStatus = "pending"
+	// ScanClean means the file was scanned, or scanning is disabled.
+	ScanClean ScanStatus = "clean"
+	// ScanInfected means the scanner flagged the file.
+	ScanInfected ScanStatus = "infected"
+	// ScanCorrupt means the contents no longer match their hash. The file is
+	// kept for inspection, but not served.
+	ScanCorrupt ScanStatus = "corrupt"
+	// ScanQuarantined means an admin has put the file on hold. It is kept
+	// until it expires, but not served.
+	ScanQuarantined ScanStatus = "quarantined"
+)
+
+// fileColumns is the list of columns scanned by scanFile.
+const fileColumns = `id, file_path, original_filename, mime_type, expires_at, removed, ip_address, user_agent,
+	scan_status, delete_token_hash, downloads, max_downloads, sha256, size, removed_at, slug, access_key_hash`
+
+// scanFile scans a row selected with fileColumns.
+func scanFile(row interface{ Scan(dest ...any) error }) (*DbFile, error) {
 	var file DbFile
-	var expiresAt int64
+	var expiresAt, removedAt int64
+	var slug sql.NullString
 
-	row := d.db.QueryRow(`SELECT id, file_path, original_filename, mime_type, expires_at, removed, ip_address, user_agent FROM files WHERE id = ?`, id)
-	err := row.Scan(&file.ID, &file.FilePath, &file.OriginalFilename, &file.MimeType, &expiresAt, &file.Removed, &file.IPAddress, &file.UserAgent)
+	err := row.Scan(&file.ID, &file.FilePath, &file.OriginalFilename, &file.MimeType, &expiresAt, &file.Removed, &file.IPAddress, &file.UserAgent,
+		&file.ScanStatus, &file.DeleteTokenHash, &file.Downloads, &file.MaxDownloads, &file.Sha256, &file.Size, &removedAt, &slug, &file.AccessKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	file.Slug = slug.String
+
+	file.ExpiresAt = time.Unix(0, expiresAt*int64(time.Millisecond))
+	if removedAt != 0 {
+		file.RemovedAt = time.UnixMilli(removedAt)
+	}
+
+	return &file, nil
+}
+
+// GetFile returns a file record from the database based on the given file ID.
+func (d *DB) GetFile(ctx context.Context, id int64) (*DbFile, error) {
+	ctx, span := d.startSpan(ctx, "GetFile")
+	defer span.End()
+
+	file, err := scanFile(d.db.QueryRowContext(ctx, `SELECT `+fileColumns+` FROM files WHERE id = ?`, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("file not found")
@@ -95,9 +388,65 @@ func (d *DB) GetFile(id int64) (*DbFile, error) {
 		return nil, fmt.Errorf("failed to get file: %v", err)
 	}
 
-	file.ExpiresAt = time.Unix(0, expiresAt*int64(time.Millisecond))
+	return file, nil
+}
 
-	return &file, nil
+// GetFileBySlug returns the file with the given slug. The file that has not
+// been removed is preferred, followed by the latest removed one.
+func (d *DB) GetFileBySlug(ctx context.Context, slug string) (*DbFile, error) {
+	ctx, span := d.startSpan(ctx, "GetFileBySlug")
+	defer span.End()
+
+	file, err := scanFile(d.db.QueryRowContext(ctx, `SELECT `+fileColumns+` FROM files WHERE slug = ?
+		ORDER BY removed, id DESC LIMIT 1`, slug))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("file not found")
+		}
+		return nil, fmt.Errorf("failed to get file: %v", err)
+	}
+
+	return file, nil
+}
+
+// IsSlugTaken reports whether a file that has not been removed uses the slug.
+func (d *DB) IsSlugTaken(ctx context.Context, slug string) (bool, error) {
+	ctx, span := d.startSpan(ctx, "IsSlugTaken")
+	defer span.End()
+
+	var taken bool
+	err := d.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM files WHERE slug = ? AND removed = FALSE)`, slug).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("failed to check slug: %v", err)
+	}
+	return taken, nil
+}
+
+// FindLiveBlob returns a live file with the given content hash, so that its
+// contents can be shared with a new file. If ipAddress is not empty, only
+// files uploaded from that address are considered. If there is no such file,
+// nil is returned.
+func (d *DB) FindLiveBlob(ctx context.Context, sha256, ipAddress string) (*DbFile, error) {
+	ctx, span := d.startSpan(ctx, "FindLiveBlob")
+	defer span.End()
+
+	now, cutoff := d.deadFileArgs(time.Now())
+	file, err := scanFile(d.db.QueryRowContext(ctx, `SELECT `+fileColumns+` FROM files
+		WHERE sha256 = ?
+		AND (? = '' OR ip_address = ?)
+		AND scan_status NOT IN ('corrupt', 'quarantined')
+		AND removed = FALSE
+		AND NOT `+deadFileCondition+`
+		ORDER BY expires_at DESC LIMIT 1`,
+		sha256, ipAddress, ipAddress, now, cutoff))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find blob: %v", err)
+	}
+
+	return file, nil
 }
 
 type ExpiredFile struct {
@@ -105,12 +454,17 @@ type ExpiredFile struct {
 	FilePath string
 }
 
-// ListExpiredFiles returns a list of files that have expired.
-func (d *DB) ListExpiredFiles() ([]ExpiredFile, error) {
+// ListExpiredFiles returns a list of files that have expired, have been
+// flagged as infected, or have used up their downloads.
+func (d *DB) ListExpiredFiles(ctx context.Context) ([]ExpiredFile, error) {
+	ctx, span := d.startSpan(ctx, "ListExpiredFiles")
+	defer span.End()
+
 	var expiredFiles []ExpiredFile
 
-	rows, err := d.db.Query(`SELECT id, file_path FROM files WHERE expires_at < ? AND removed = FALSE`,
-		time.Now().UnixMilli())
+	now, cutoff := d.deadFileArgs(time.Now())
+	rows, err := d.db.QueryContext(ctx, `SELECT id, file_path FROM files WHERE `+deadFileCondition+` AND removed = FALSE`,
+		now, cutoff)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list expired files: %v", err)
 	}
@@ -132,9 +486,14 @@ func (d *DB) ListExpiredFiles() ([]ExpiredFile, error) {
 	return expiredFiles, nil
 }
 
-// RemoveFile marks a file as removed in the database.
-func (d *DB) RemoveFile(id int64) error {
-	_, err := d.db.Exec(`UPDATE files SET removed = TRUE WHERE id = ?`, id)
+// RemoveFile marks a file as removed in the database. Its contents are left
+// pending deletion until MarkContentsDeleted is called.
+func (d *DB) RemoveFile(ctx context.Context, id int64) error {
+	ctx, span := d.startSpan(ctx, "RemoveFile")
+	defer span.End()
+
+	_, err := d.db.ExecContext(ctx, `UPDATE files SET removed = TRUE, removed_at = ?, delete_pending = TRUE WHERE id = ?;
+		DELETE FROM file_downloaders WHERE file_id = ?`, time.Now().UnixMilli(), id, id)
 	if err != nil {
 		return fmt.Errorf("failed to remove file: %v", err)
 	}
@@ -142,16 +501,207 @@ func (d *DB) RemoveFile(id int64) error {
 	return nil
 }
 
-// RefCount returns the number of references to a file in the database.
-func (d *DB) RefCount(fileName string) (int, error) {
+// ClaimExpiredFile marks an expired file as removed, and reports whether it
+// did so. The file is left untouched if it has been extended or otherwise
+// brought back to life since it was listed by ListExpiredFiles, so that the
+// caller can safely delete its contents. As with RemoveFile, the contents are
+// pending deletion until MarkContentsDeleted is called.
+func (d *DB) ClaimExpiredFile(ctx context.Context, id int64) (bool, error) {
+	ctx, span := d.startSpan(ctx, "ClaimExpiredFile")
+	defer span.End()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now, cutoff := d.deadFileArgs(time.Now())
+	res, err := tx.ExecContext(ctx, `UPDATE files SET removed = TRUE, removed_at = ?, delete_pending = TRUE WHERE id = ? AND removed = FALSE AND `+deadFileCondition,
+		now, id, now, cutoff)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim file: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim file: %v", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM file_downloaders WHERE file_id = ?`, id); err != nil {
+		return false, fmt.Errorf("failed to delete downloaders: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit claim: %v", err)
+	}
+
+	return true, nil
+}
+
+// ListPendingDeletes returns the removed files whose contents have not been
+// deleted yet, such as because deleting them failed.
+func (d *DB) ListPendingDeletes(ctx context.Context) ([]ExpiredFile, error) {
+	ctx, span := d.startSpan(ctx, "ListPendingDeletes")
+	defer span.End()
+
+	var files []ExpiredFile
+
+	rows, err := d.db.QueryContext(ctx, `SELECT id, file_path FROM files WHERE delete_pending = TRUE`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending deletes: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var file ExpiredFile
+		if err := rows.Scan(&file.ID, &file.FilePath); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over rows: %v", err)
+	}
+
+	return files, nil
+}
+
+// MarkContentsDeleted records that the contents of a removed file have been
+// deleted, or are still used by another file, so that they are no longer
+// pending deletion.
+func (d *DB) MarkContentsDeleted(ctx context.Context, id int64) error {
+	ctx, span := d.startSpan(ctx, "MarkContentsDeleted")
+	defer span.End()
+
+	_, err := d.db.ExecContext(ctx, `UPDATE files SET delete_pending = FALSE WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to mark contents deleted: %v", err)
+	}
+
+	return nil
+}
+
+// FileUpdate is a set of changes to a file record. Nil fields are left
+// unchanged.
+type FileUpdate struct {
+	ExpiresAt        *time.Time
+	OriginalFilename *string
+	MaxDownloads     *int64
+}
+
+// UpdateFile applies the changes to a live file, and reports whether the file
+// was updated. Files that have been removed, or that are up for garbage
+// collection, are not updated.
+func (d *DB) UpdateFile(ctx context.Context, id int64, update FileUpdate) (bool, error) {
+	ctx, span := d.startSpan(ctx, "UpdateFile")
+	defer span.End()
+
+	var expiresAt *int64
+	if update.ExpiresAt != nil {
+		ms := update.ExpiresAt.UnixMilli()
+		expiresAt = &ms
+	}
+
+	now, cutoff := d.deadFileArgs(time.Now())
+	res, err := d.db.ExecContext(ctx, `
+		UPDATE files SET
+			expires_at = COALESCE(?, expires_at),
+			original_filename = COALESCE(?, original_filename),
+			max_downloads = COALESCE(?, max_downloads)
+		WHERE id = ? AND removed = FALSE AND NOT `+deadFileCondition,
+		expiresAt, update.OriginalFilename, update.MaxDownloads, id, now, cutoff)
+	if err != nil {
+		return false, fmt.Errorf("failed to update file: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to update file: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// CountDownload increments the download counter of a file, and reports whether
+// the download is allowed by the file's download limit. For files with a
+// download limit, the address of the client is recorded, so that it can
+// resume the download later with HasDownloaded.
+func (d *DB) CountDownload(ctx context.Context, id int64, ipAddress string) (bool, error) {
+	ctx, span := d.startSpan(ctx, "CountDownload")
+	defer span.End()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE files SET downloads = downloads + 1, last_download_at = ?
+		WHERE id = ? AND (max_downloads = 0 OR downloads < max_downloads)
+	`, time.Now().UnixMilli(), id)
+	if err != nil {
+		return false, fmt.Errorf("failed to count download: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to count download: %v", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT OR IGNORE INTO file_downloaders (file_id, ip_address)
+		SELECT id, ? FROM files WHERE id = ? AND max_downloads > 0
+	`, ipAddress, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to record downloader: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit download: %v", err)
+	}
+
+	return true, nil
+}
+
+// HasDownloaded reports whether a download of a file with a download limit
+// has been counted for the client with the given address.
+func (d *DB) HasDownloaded(ctx context.Context, id int64, ipAddress string) (bool, error) {
+	ctx, span := d.startSpan(ctx, "HasDownloaded")
+	defer span.End()
+
+	var downloaded bool
+	err := d.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM file_downloaders WHERE file_id = ? AND ip_address = ?)`,
+		id, ipAddress).Scan(&downloaded)
+	if err != nil {
+		return false, fmt.Errorf("failed to check downloader: %v", err)
+	}
+	return downloaded, nil
+}
+
+// RefCount returns the number of live references to a file in the database.
+func (d *DB) RefCount(ctx context.Context, fileName string) (int, error) {
+	ctx, span := d.startSpan(ctx, "RefCount")
+	defer span.End()
+
 	var count int
-	err := d.db.QueryRow(
+	now, cutoff := d.deadFileArgs(time.Now())
+	err := d.db.QueryRowContext(ctx,
 		`SELECT COUNT(*) FROM files
 		WHERE file_path = ?
 		AND removed = FALSE
-		AND expires_at > ?`,
+		AND NOT `+deadFileCondition,
 		fileName,
-		time.Now().UnixMilli(),
+		now,
+		cutoff,
 	).Scan(&count)
 	if err != nil {
 		return 0, fmt.Errorf("failed to get reference count: %v", err)
@@ -159,3 +709,122 @@ func (d *DB) RefCount(fileName string) (int, error) {
 
 	return count, nil
 }
+
+// ListPendingScans returns the IDs of live files that are waiting to be
+// scanned.
+func (d *DB) ListPendingScans(ctx context.Context) ([]int64, error) {
+	ctx, span := d.startSpan(ctx, "ListPendingScans")
+	defer span.End()
+
+	var ids []int64
+
+	rows, err := d.db.QueryContext(ctx, `SELECT id FROM files WHERE scan_status = ? AND removed = FALSE AND expires_at > ?`,
+		ScanPending, time.Now().UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending scans: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over rows: %v", err)
+	}
+
+	return ids, nil
+}
+
+// ReleasePendingScans marks every file that is waiting to be scanned as
+// clean, and returns the number of files released.
+func (d *DB) ReleasePendingScans(ctx context.Context) (int64, error) {
+	ctx, span := d.startSpan(ctx, "ReleasePendingScans")
+	defer span.End()
+
+	res, err := d.db.ExecContext(ctx, `UPDATE files SET scan_status = ? WHERE scan_status = ?`, ScanClean, ScanPending)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release pending scans: %v", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// SetScanStatus sets the scan status of every file stored at the given path,
+// since they all share the same content.
+func (d *DB) SetScanStatus(ctx context.Context, filePath string, status ScanStatus) error {
+	ctx, span := d.startSpan(ctx, "SetScanStatus")
+	defer span.End()
+
+	_, err := d.db.ExecContext(ctx, `UPDATE files SET scan_status = ? WHERE file_path = ?`, status, filePath)
+	if err != nil {
+		return fmt.Errorf("failed to set scan status: %v", err)
+	}
+
+	return nil
+}
+
+// ScrubTarget is stored contents due for an integrity check.
+type ScrubTarget struct {
+	FilePath string
+	Sha256   string
+}
+
+// ListScrubDue returns up to limit distinct contents of live files that have
+// not been checked since the given time, least recently checked first.
+// Contents without a recorded hash, and those already found corrupt, are
+// skipped.
+func (d *DB) ListScrubDue(ctx context.Context, before time.Time, limit int) ([]ScrubTarget, error) {
+	ctx, span := d.startSpan(ctx, "ListScrubDue")
+	defer span.End()
+
+	var targets []ScrubTarget
+
+	now, cutoff := d.deadFileArgs(time.Now())
+	rows, err := d.db.QueryContext(ctx, `SELECT file_path, sha256 FROM files
+		WHERE sha256 != ''
+		AND scan_status != 'corrupt'
+		AND removed = FALSE
+		AND NOT `+deadFileCondition+`
+		GROUP BY file_path, sha256
+		HAVING MIN(scrubbed_at) < ?
+		ORDER BY MIN(scrubbed_at)
+		LIMIT ?`,
+		now, cutoff, before.UnixMilli(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list scrub targets: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var target ScrubTarget
+		if err := rows.Scan(&target.FilePath, &target.Sha256); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		targets = append(targets, target)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over rows: %v", err)
+	}
+
+	return targets, nil
+}
+
+// MarkScrubbed records that the contents stored at the given path were
+// checked at the given time.
+func (d *DB) MarkScrubbed(ctx context.Context, filePath string, at time.Time) error {
+	ctx, span := d.startSpan(ctx, "MarkScrubbed")
+	defer span.End()
+
+	_, err := d.db.ExecContext(ctx, `UPDATE files SET scrubbed_at = ? WHERE file_path = ?`, at.UnixMilli(), filePath)
+	if err != nil {
+		return fmt.Errorf("failed to mark file scrubbed: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package hako
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FileQuery selects the files listed by ListFiles.
+type FileQuery struct {
+	// Search matches files whose filename, slug, mime type, uploader IP
+	// address, user agent or hash contains it. All files match when it is
+	// empty.
+	Search string
+
+	// Removed lists removed files, most recently removed first, instead of
+	// the files that are not removed, most recently uploaded first.
+	Removed bool
+
+	Limit  int
+	Offset int
+}
+
+// ListFiles returns the files matching the query, and the number of matching
+// files regardless of the limit and offset.
+func (d *DB) ListFiles(ctx context.Context, query FileQuery) ([]*DbFile, int, error) {
+	ctx, span := d.startSpan(ctx, "ListFiles")
+	defer span.End()
+
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query.Search) + "%"
+	where := `WHERE removed = ? AND (? = ''
+		OR original_filename LIKE ? ESCAPE '\'
+		OR slug LIKE ? ESCAPE '\'
+		OR mime_type LIKE ? ESCAPE '\'
+		OR ip_address LIKE ? ESCAPE '\'
+		OR user_agent LIKE ? ESCAPE '\'
+		OR sha256 LIKE ? ESCAPE '\')`
+	args := []any{query.Removed, query.Search, pattern, pattern, pattern, pattern, pattern, pattern}
+
+	var total int
+	if err := d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM files `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count files: %v", err)
+	}
+
+	order := `id DESC`
+	if query.Removed {
+		order = `removed_at DESC, id DESC`
+	}
+	rows, err := d.db.QueryContext(ctx, `SELECT `+fileColumns+` FROM files `+where+` ORDER BY `+order+` LIMIT ? OFFSET ?`,
+		append(args, query.Limit, query.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list files: %v", err)
+	}
+	defer rows.Close()
+
+	var files []*DbFile
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan row: %v", err)
+		}
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to iterate over rows: %v", err)
+	}
+
+	return files, total, nil
+}
+
+// StorageUsage is the number of files that are not removed, and the distinct
+// contents they are stored in.
+type StorageUsage struct {
+	Files int64
+	Blobs int64
+	Bytes int64
+}
+
+// GetStorageUsage returns the current storage usage. Contents shared between
+// files are only counted once.
+func (d *DB) GetStorageUsage(ctx context.Context) (StorageUsage, error) {
+	ctx, span := d.startSpan(ctx, "GetStorageUsage")
+	defer span.End()
+
+	var usage StorageUsage
+	err := d.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(files), 0), COUNT(*), COALESCE(SUM(size), 0) FROM (
+			SELECT COUNT(*) AS files, MAX(size) AS size FROM files
+			WHERE removed = FALSE
+			GROUP BY file_path
+		)
+	`).Scan(&usage.Files, &usage.Blobs, &usage.Bytes)
+	if err != nil {
+		return usage, fmt.Errorf("failed to get storage usage: %v", err)
+	}
+
+	return usage, nil
+}
+
+// GCRun is the record of a round of garbage collection.
+type GCRun struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	Removed   int
+	Scrubbed  int
+	Corrupt   int
+
+	// Usage is the storage usage at the end of the round.
+	Usage StorageUsage
+
+	// Error is the error that cut the round short, if any.
+	Error string
+}
+
+// InsertGCRun records a round of garbage collection.
+func (d *DB) InsertGCRun(ctx context.Context, run *GCRun) error {
+	ctx, span := d.startSpan(ctx, "InsertGCRun")
+	defer span.End()
+
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO gc_runs (started_at, duration_ms, removed, scrubbed, corrupt, live_files, live_blobs, live_bytes, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, run.StartedAt.UnixMilli(), run.Duration.Milliseconds(), run.Removed, run.Scrubbed, run.Corrupt,
+		run.Usage.Files, run.Usage.Blobs, run.Usage.Bytes, run.Error)
+	if err != nil {
+		return fmt.Errorf("failed to insert GC run: %v", err)
+	}
+
+	return nil
+}
+
+// ListGCRuns returns the rounds of garbage collection started since the given
+// time, most recent first, up to limit.
+func (d *DB) ListGCRuns(ctx context.Context, since time.Time, limit int) ([]GCRun, error) {
+	ctx, span := d.startSpan(ctx, "ListGCRuns")
+	defer span.End()
+
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT started_at, duration_ms, removed, scrubbed, corrupt, live_files, live_blobs, live_bytes, error FROM gc_runs
+		WHERE started_at >= ?
+		ORDER BY started_at DESC LIMIT ?
+	`, since.UnixMilli(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list GC runs: %v", err)
+	}
+	defer rows.Close()
+
+	var runs []GCRun
+	for rows.Next() {
+		var run GCRun
+		var startedAt, durationMs int64
+		err := rows.Scan(&startedAt, &durationMs, &run.Removed, &run.Scrubbed, &run.Corrupt,
+			&run.Usage.Files, &run.Usage.Blobs, &run.Usage.Bytes, &run.Error)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		run.StartedAt = time.UnixMilli(startedAt)
+		run.Duration = time.Duration(durationMs) * time.Millisecond
+		runs = append(runs, run)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over rows: %v", err)
+	}
+
+	return runs, nil
+}
+
+// UsagePoint is the storage usage at a point in time.
+type UsagePoint struct {
+	Time  time.Time
+	Files int64
+	Bytes int64
+}
+
+// ListUsageHistory returns the storage usage recorded by garbage collection
+// since the given time, with one point per interval, oldest first.
+func (d *DB) ListUsageHistory(ctx context.Context, since time.Time, interval time.Duration) ([]UsagePoint, error) {
+	ctx, span := d.startSpan(ctx, "ListUsageHistory")
+	defer span.End()
+
+	bucket := interval.Milliseconds()
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT started_at / ? * ?, MAX(live_files), MAX(live_bytes) FROM gc_runs
+		WHERE started_at >= ?
+		GROUP BY started_at / ?
+		ORDER BY started_at / ?
+	`, bucket, bucket, since.UnixMilli(), bucket, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list usage history: %v", err)
+	}
+	defer rows.Close()
+
+	var points []UsagePoint
+	for rows.Next() {
+		var point UsagePoint
+		var at int64
+		if err := rows.Scan(&at, &point.Files, &point.Bytes); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		point.Time = time.UnixMilli(at)
+		points = append(points, point)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over rows: %v", err)
+	}
+
+	return points, nil
+}
+
+// DeleteGCRuns deletes the records of garbage collection rounds started
+// before the given time.
+func (d *DB) DeleteGCRuns(ctx context.Context, before time.Time) error {
+	ctx, span := d.startSpan(ctx, "DeleteGCRuns")
+	defer span.End()
+
+	_, err := d.db.ExecContext(ctx, `DELETE FROM gc_runs WHERE started_at < ?`, before.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to delete GC runs: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,259 @@
+package hako
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// BlockedHash is a content hash that can no longer be uploaded.
+type BlockedHash struct {
+	Sha256    string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// BlockHash adds a content hash to the blocklist, and reports whether it was
+// not already blocked. Blocking a hash that is already blocked keeps the
+// original reason.
+func (d *DB) BlockHash(ctx context.Context, sha256, reason string) (bool, error) {
+	ctx, span := d.startSpan(ctx, "BlockHash")
+	defer span.End()
+
+	res, err := d.db.ExecContext(ctx, `INSERT INTO blocked_hashes (sha256, reason, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+		sha256, reason, time.Now().UnixMilli())
+	if err != nil {
+		return false, fmt.Errorf("failed to block hash: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to block hash: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// UnblockHash removes a content hash from the blocklist, and reports whether
+// it was blocked.
+func (d *DB) UnblockHash(ctx context.Context, sha256 string) (bool, error) {
+	ctx, span := d.startSpan(ctx, "UnblockHash")
+	defer span.End()
+
+	res, err := d.db.ExecContext(ctx, `DELETE FROM blocked_hashes WHERE sha256 = ?`, sha256)
+	if err != nil {
+		return false, fmt.Errorf("failed to unblock hash: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to unblock hash: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// IsHashBlocked reports whether a content hash is on the blocklist.
+func (d *DB) IsHashBlocked(ctx context.Context, sha256 string) (bool, error) {
+	ctx, span := d.startSpan(ctx, "IsHashBlocked")
+	defer span.End()
+
+	var blocked bool
+	err := d.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM blocked_hashes WHERE sha256 = ?)`, sha256).Scan(&blocked)
+	if err != nil {
+		return false, fmt.Errorf("failed to check blocklist: %v", err)
+	}
+
+	return blocked, nil
+}
+
+// ListBlockedHashes returns the blocklist, most recently blocked first.
+func (d *DB) ListBlockedHashes(ctx context.Context) ([]BlockedHash, error) {
+	ctx, span := d.startSpan(ctx, "ListBlockedHashes")
+	defer span.End()
+
+	rows, err := d.db.QueryContext(ctx, `SELECT sha256, reason, created_at FROM blocked_hashes ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocked hashes: %v", err)
+	}
+	defer rows.Close()
+
+	var hashes []BlockedHash
+	for rows.Next() {
+		var hash BlockedHash
+		var createdAt int64
+		if err := rows.Scan(&hash.Sha256, &hash.Reason, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		hash.CreatedAt = time.UnixMilli(createdAt)
+		hashes = append(hashes, hash)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over rows: %v", err)
+	}
+
+	return hashes, nil
+}
+
+// BlockedImageHash is the perceptual hash of an image that can no longer be
+// uploaded, along with images that look like it.
+type BlockedImageHash struct {
+	DHash     uint64
+	Reason    string
+	CreatedAt time.Time
+}
+
+// BlockImageHash adds a perceptual hash to the blocklist, and reports whether
+// it was not already blocked.
+func (d *DB) BlockImageHash(ctx context.Context, dhash uint64, reason string) (bool, error) {
+	ctx, span := d.startSpan(ctx, "BlockImageHash")
+	defer span.End()
+
+	res, err := d.db.ExecContext(ctx, `INSERT INTO blocked_image_hashes (dhash, reason, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+		int64(dhash), reason, time.Now().UnixMilli())
+	if err != nil {
+		return false, fmt.Errorf("failed to block image hash: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to block image hash: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// UnblockImageHash removes a perceptual hash from the blocklist, and reports
+// whether it was blocked.
+func (d *DB) UnblockImageHash(ctx context.Context, dhash uint64) (bool, error) {
+	ctx, span := d.startSpan(ctx, "UnblockImageHash")
+	defer span.End()
+
+	res, err := d.db.ExecContext(ctx, `DELETE FROM blocked_image_hashes WHERE dhash = ?`, int64(dhash))
+	if err != nil {
+		return false, fmt.Errorf("failed to unblock image hash: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to unblock image hash: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// ListBlockedImageHashes returns the perceptual hashes on the blocklist, most
+// recently blocked first.
+func (d *DB) ListBlockedImageHashes(ctx context.Context) ([]BlockedImageHash, error) {
+	ctx, span := d.startSpan(ctx, "ListBlockedImageHashes")
+	defer span.End()
+
+	rows, err := d.db.QueryContext(ctx, `SELECT dhash, reason, created_at FROM blocked_image_hashes ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocked image hashes: %v", err)
+	}
+	defer rows.Close()
+
+	var hashes []BlockedImageHash
+	for rows.Next() {
+		var hash BlockedImageHash
+		var dhash, createdAt int64
+		if err := rows.Scan(&dhash, &hash.Reason, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		hash.DHash = uint64(dhash)
+		hash.CreatedAt = time.UnixMilli(createdAt)
+		hashes = append(hashes, hash)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over rows: %v", err)
+	}
+
+	return hashes, nil
+}
+
+// ImportBlocklist adds the entries to the blocklist in a single transaction,
+// and returns the number of entries that were not already blocked. Files that
+// are not removed and have blocked contents are expired, so that garbage
+// collection removes them, and their number is returned too.
+func (d *DB) ImportBlocklist(ctx context.Context, entries []BlocklistEntry) (int, int, error) {
+	ctx, span := d.startSpan(ctx, "ImportBlocklist")
+	defer span.End()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMilli()
+	var added, expired int64
+	for _, entry := range entries {
+		var res sql.Result
+		switch entry.Kind {
+		case BlockSha256:
+			res, err = tx.ExecContext(ctx, `INSERT INTO blocked_hashes (sha256, reason, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+				entry.Hash, entry.Reason, now)
+		case BlockDHash:
+			dhash, ok := ParseDHash(entry.Hash)
+			if !ok {
+				return 0, 0, fmt.Errorf("invalid image hash %q", entry.Hash)
+			}
+			res, err = tx.ExecContext(ctx, `INSERT INTO blocked_image_hashes (dhash, reason, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+				int64(dhash), entry.Reason, now)
+		default:
+			return 0, 0, fmt.Errorf("unknown blocklist entry kind %q", entry.Kind)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to block hash: %v", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to block hash: %v", err)
+		}
+		added += n
+
+		if entry.Kind != BlockSha256 {
+			continue
+		}
+		res, err = tx.ExecContext(ctx, `UPDATE files SET expires_at = ? WHERE sha256 = ? AND removed = FALSE AND expires_at >= ?`,
+			now-1, entry.Hash, now)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to expire files: %v", err)
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return 0, 0, fmt.Errorf("failed to expire files: %v", err)
+		}
+		expired += n
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return int(added), int(expired), nil
+}
+
+// ExportBlocklist returns every entry of the blocklist.
+func (d *DB) ExportBlocklist(ctx context.Context) ([]BlocklistEntry, error) {
+	hashes, err := d.ListBlockedHashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	imageHashes, err := d.ListBlockedImageHashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []BlocklistEntry
+	for _, hash := range hashes {
+		entries = append(entries, BlocklistEntry{Kind: BlockSha256, Hash: hash.Sha256, Reason: hash.Reason})
+	}
+	for _, hash := range imageHashes {
+		entries = append(entries, BlocklistEntry{Kind: BlockDHash, Hash: FormatDHash(hash.DHash), Reason: hash.Reason})
+	}
+	return entries, nil
+}
@@ -0,0 +1,224 @@
+package hako
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReportStatus is the review state of an abuse report.
+type ReportStatus string
+
+const (
+	// ReportOpen means the report has not been reviewed yet.
+	ReportOpen ReportStatus = "open"
+	// ReportDismissed means an admin reviewed the report and kept the file.
+	ReportDismissed ReportStatus = "dismissed"
+	// ReportTakenDown means the reported file was taken down.
+	ReportTakenDown ReportStatus = "taken_down"
+)
+
+// DbReport represents an abuse report in the database.
+type DbReport struct {
+	ID        int64
+	FileID    int64
+	Reason    string
+	Message   string
+	Contact   string
+	IPAddress string
+	UserAgent string
+	CreatedAt time.Time
+	Status    ReportStatus
+
+	// ResolvedAt is the time the report was dismissed or its file taken
+	// down, which is zero for open reports.
+	ResolvedAt time.Time
+}
+
+// reportColumns is the list of columns scanned by scanReport.
+const reportColumns = `id, file_id, reason, message, contact, ip_address, user_agent, created_at, status, resolved_at`
+
+// scanReport scans a row selected with reportColumns.
+func scanReport(row interface{ Scan(dest ...any) error }) (*DbReport, error) {
+	var report DbReport
+	var createdAt, resolvedAt int64
+
+	err := row.Scan(&report.ID, &report.FileID, &report.Reason, &report.Message, &report.Contact, &report.IPAddress, &report.UserAgent,
+		&createdAt, &report.Status, &resolvedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	report.CreatedAt = time.UnixMilli(createdAt)
+	if resolvedAt != 0 {
+		report.ResolvedAt = time.UnixMilli(resolvedAt)
+	}
+
+	return &report, nil
+}
+
+// InsertReport records a new open report, ignoring its ID, CreatedAt, Status
+// and ResolvedAt fields. The ID of the new report is returned, or 0 if the
+// same IP address already has an open report on the file.
+func (d *DB) InsertReport(ctx context.Context, report *DbReport) (int64, error) {
+	ctx, span := d.startSpan(ctx, "InsertReport")
+	defer span.End()
+
+	res, err := d.db.ExecContext(ctx, `
+		INSERT INTO reports (file_id, reason, message, contact, ip_address, user_agent, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
+	`, report.FileID, report.Reason, report.Message, report.Contact, report.IPAddress, report.UserAgent, time.Now().UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("failed to create report: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create report: %v", err)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create report: %v", err)
+	}
+
+	return id, nil
+}
+
+// GetReport returns the report with the given ID.
+func (d *DB) GetReport(ctx context.Context, id int64) (*DbReport, error) {
+	ctx, span := d.startSpan(ctx, "GetReport")
+	defer span.End()
+
+	report, err := scanReport(d.db.QueryRowContext(ctx, `SELECT `+reportColumns+` FROM reports WHERE id = ?`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("report not found")
+		}
+		return nil, fmt.Errorf("failed to get report: %v", err)
+	}
+
+	return report, nil
+}
+
+// ListReports returns the reports with the given status, oldest first for
+// open reports so that they are reviewed in order, and most recently resolved
+// first otherwise, along with the number of reports with that status
+// regardless of the limit and offset.
+func (d *DB) ListReports(ctx context.Context, status ReportStatus, limit, offset int) ([]*DbReport, int, error) {
+	ctx, span := d.startSpan(ctx, "ListReports")
+	defer span.End()
+
+	var total int
+	if err := d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM reports WHERE status = ?`, status).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count reports: %v", err)
+	}
+
+	order := `created_at, id`
+	if status != ReportOpen {
+		order = `resolved_at DESC, id DESC`
+	}
+	rows, err := d.db.QueryContext(ctx, `SELECT `+reportColumns+` FROM reports WHERE status = ? ORDER BY `+order+` LIMIT ? OFFSET ?`,
+		status, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list reports: %v", err)
+	}
+	defer rows.Close()
+
+	var reports []*DbReport
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan row: %v", err)
+		}
+		reports = append(reports, report)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to iterate over rows: %v", err)
+	}
+
+	return reports, total, nil
+}
+
+// ResolveReport resolves an open report with the given status, and reports
+// whether it was open.
+func (d *DB) ResolveReport(ctx context.Context, id int64, status ReportStatus) (bool, error) {
+	ctx, span := d.startSpan(ctx, "ResolveReport")
+	defer span.End()
+
+	res, err := d.db.ExecContext(ctx, `UPDATE reports SET status = ?, resolved_at = ? WHERE id = ? AND status = 'open'`,
+		status, time.Now().UnixMilli(), id)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve report: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve report: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// ResolveReports resolves the open reports on the given files with the given
+// status, and returns the number of reports resolved.
+func (d *DB) ResolveReports(ctx context.Context, fileIDs []int64, status ReportStatus) (int, error) {
+	ctx, span := d.startSpan(ctx, "ResolveReports")
+	defer span.End()
+
+	if len(fileIDs) == 0 {
+		return 0, nil
+	}
+
+	args := []any{status, time.Now().UnixMilli()}
+	for _, id := range fileIDs {
+		args = append(args, id)
+	}
+	res, err := d.db.ExecContext(ctx, `UPDATE reports SET status = ?, resolved_at = ?
+		WHERE status = 'open' AND file_id IN (?`+strings.Repeat(", ?", len(fileIDs)-1)+`)`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve reports: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve reports: %v", err)
+	}
+
+	return int(n), nil
+}
+
+// ListFilesBySha256 returns the files with the given content hash that are
+// not removed, including those up for garbage collection.
+func (d *DB) ListFilesBySha256(ctx context.Context, sha256 string) ([]*DbFile, error) {
+	ctx, span := d.startSpan(ctx, "ListFilesBySha256")
+	defer span.End()
+
+	rows, err := d.db.QueryContext(ctx, `SELECT `+fileColumns+` FROM files WHERE sha256 = ? AND removed = FALSE`, sha256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+	defer rows.Close()
+
+	var files []*DbFile
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over rows: %v", err)
+	}
+
+	return files, nil
+}
@@ -1,6 +1,7 @@
 package hako_test
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 
 func TestDB(t *testing.T) {
 	assert := assert.New(t)
+	ctx := context.Background()
 
 	db, err := hako.NewDB(":memory:")
 	assert.Nil(err, "Failed to create database")
@@ -24,25 +26,70 @@ func TestDB(t *testing.T) {
 	expiresAt := time.Now().Add(1 * time.Hour)
 	ipAddress := "127.0.0.1"
 	userAgent := "TestAgent"
-	id, err := db.CreateFile(filePath, originalFilename, mimeType, expiresAt, ipAddress, userAgent)
+	id, err := db.CreateFile(ctx, filePath, originalFilename, mimeType, expiresAt, ipAddress, userAgent)
 	assert.Nil(err, "Failed to create file")
 	assert.NotZero(id, "File ID should not be zero")
 
 	// Test listing expired files
-	paths, err := db.ListExpiredFiles()
+	paths, err := db.ListExpiredFiles(ctx)
 	assert.Nil(err, "Failed to list expired files")
 	assert.Empty(paths, "Expired files should be empty")
 
 	// Create an expired file
 	expiresAt = time.Now().Add(-1 * time.Hour)
-	_, err = db.CreateFile(filePath, originalFilename, mimeType, expiresAt, ipAddress, userAgent)
+	_, err = db.CreateFile(ctx, filePath, originalFilename, mimeType, expiresAt, ipAddress, userAgent)
 	assert.Nil(err, "Failed to create expired file")
-	paths, err = db.ListExpiredFiles()
+	paths, err = db.ListExpiredFiles(ctx)
 	assert.Nil(err, "Failed to list expired files")
 	assert.NotEmpty(paths, "Expired files should not be empty")
 
 	// Test getting file
-	file, err := db.GetFile(id)
+	file, err := db.GetFile(ctx, id)
 	assert.Nil(err, "Failed to get file")
 	assert.Equal(filePath, file.FilePath, "File path mismatch")
 }
+
+func TestDBMigrateIdempotent(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+	assert.Nil(db.Migrate(), "Failed to migrate database a second time")
+
+	// Files created through CreateFile are considered clean
+	id, err := db.CreateFile(ctx, "/path/to/file", "file.txt", "text/plain", time.Now().Add(1*time.Hour), "127.0.0.1", "TestAgent")
+	assert.Nil(err, "Failed to create file")
+	file, err := db.GetFile(ctx, id)
+	assert.Nil(err, "Failed to get file")
+	assert.Equal(hako.ScanClean, file.ScanStatus, "File should be clean")
+}
+
+func TestDBInsertSharedFile(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	id, err := db.CreateFile(ctx, "/path/to/file", "file.txt", "text/plain", time.Now().Add(1*time.Hour), "127.0.0.1", "TestAgent")
+	assert.Nil(err, "Failed to create file")
+
+	shared := &hako.DbFile{FilePath: "/path/to/file", OriginalFilename: "copy.txt", ExpiresAt: time.Now().Add(1 * time.Hour), ScanStatus: hako.ScanClean}
+	sharedId, err := db.InsertSharedFile(ctx, shared)
+	assert.Nil(err, "Contents of a live file should be shared")
+	assert.NotZero(sharedId, "File ID should not be zero")
+
+	// Once no live file references the contents, they cannot be shared
+	assert.Nil(db.RemoveFile(ctx, id), "Failed to remove file")
+	assert.Nil(db.RemoveFile(ctx, sharedId), "Failed to remove file")
+	_, err = db.InsertSharedFile(ctx, shared)
+	assert.ErrorIs(err, hako.ErrContentsGone, "Contents of removed files should not be shared")
+
+	refs, err := db.RefCount(ctx, "/path/to/file")
+	assert.Nil(err, "Failed to get reference count")
+	assert.Zero(refs, "Refused file should not reference the contents")
+}
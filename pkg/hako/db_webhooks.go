@@ -0,0 +1,169 @@
+package hako
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// WebhookDelivery is a queued webhook request.
+type WebhookDelivery struct {
+	ID       int64
+	URL      string
+	Event    EventType
+	Payload  []byte
+	Attempts int
+
+	// DeliveredAt is nil until the webhook has been delivered.
+	DeliveredAt *time.Time
+	LastError   string
+}
+
+// EnqueueWebhook queues a webhook payload for delivery to each of the URLs.
+func (d *DB) EnqueueWebhook(ctx context.Context, urls []string, event EventType, payload []byte) error {
+	ctx, span := d.startSpan(ctx, "EnqueueWebhook")
+	defer span.End()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMilli()
+	for _, url := range urls {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO webhook_deliveries (url, event, payload, next_attempt_at)
+			VALUES (?, ?, ?, ?)
+		`, url, event, string(payload), now)
+		if err != nil {
+			return fmt.Errorf("failed to enqueue webhook: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit webhooks: %v", err)
+	}
+
+	return nil
+}
+
+// ListDueWebhooks returns up to limit undelivered webhooks whose next attempt
+// is due at the given time, skipping those that have used up maxAttempts.
+func (d *DB) ListDueWebhooks(ctx context.Context, now time.Time, maxAttempts, limit int) ([]WebhookDelivery, error) {
+	ctx, span := d.startSpan(ctx, "ListDueWebhooks")
+	defer span.End()
+
+	var deliveries []WebhookDelivery
+
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT id, url, event, payload, attempts FROM webhook_deliveries
+		WHERE delivered_at IS NULL AND next_attempt_at <= ? AND attempts < ?
+		ORDER BY next_attempt_at
+		LIMIT ?
+	`, now.UnixMilli(), maxAttempts, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var payload string
+		err := rows.Scan(&delivery.ID, &delivery.URL, &delivery.Event, &payload, &delivery.Attempts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		delivery.Payload = []byte(payload)
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over rows: %v", err)
+	}
+
+	return deliveries, nil
+}
+
+// MarkWebhookDelivered marks a webhook as successfully delivered.
+func (d *DB) MarkWebhookDelivered(ctx context.Context, id int64) error {
+	ctx, span := d.startSpan(ctx, "MarkWebhookDelivered")
+	defer span.End()
+
+	_, err := d.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET attempts = attempts + 1, delivered_at = ?, last_error = NULL
+		WHERE id = ?
+	`, time.Now().UnixMilli(), id)
+	if err != nil {
+		return fmt.Errorf("failed to mark webhook delivered: %v", err)
+	}
+
+	return nil
+}
+
+// MarkWebhookFailed records a failed delivery attempt and schedules the next
+// attempt.
+func (d *DB) MarkWebhookFailed(ctx context.Context, id int64, nextAttemptAt time.Time, lastError string) error {
+	ctx, span := d.startSpan(ctx, "MarkWebhookFailed")
+	defer span.End()
+
+	_, err := d.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at = ?, last_error = ?
+		WHERE id = ?
+	`, nextAttemptAt.UnixMilli(), lastError, id)
+	if err != nil {
+		return fmt.Errorf("failed to mark webhook failed: %v", err)
+	}
+
+	return nil
+}
+
+// GetWebhookDelivery returns a webhook delivery by ID.
+func (d *DB) GetWebhookDelivery(ctx context.Context, id int64) (*WebhookDelivery, error) {
+	ctx, span := d.startSpan(ctx, "GetWebhookDelivery")
+	defer span.End()
+
+	var delivery WebhookDelivery
+	var payload string
+	var deliveredAt sql.NullInt64
+	var lastError sql.NullString
+
+	err := d.db.QueryRowContext(ctx, `
+		SELECT id, url, event, payload, attempts, delivered_at, last_error
+		FROM webhook_deliveries WHERE id = ?
+	`, id).Scan(&delivery.ID, &delivery.URL, &delivery.Event, &payload, &delivery.Attempts, &deliveredAt, &lastError)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("webhook delivery not found")
+		}
+		return nil, fmt.Errorf("failed to get webhook delivery: %v", err)
+	}
+
+	delivery.Payload = []byte(payload)
+	delivery.LastError = lastError.String
+	if deliveredAt.Valid {
+		t := time.UnixMilli(deliveredAt.Int64)
+		delivery.DeliveredAt = &t
+	}
+
+	return &delivery, nil
+}
+
+// PruneWebhookDeliveries deletes delivered webhooks, and webhooks that have
+// used up maxAttempts, that were queued before the given time.
+func (d *DB) PruneWebhookDeliveries(ctx context.Context, before time.Time, maxAttempts int) (int64, error) {
+	ctx, span := d.startSpan(ctx, "PruneWebhookDeliveries")
+	defer span.End()
+
+	res, err := d.db.ExecContext(ctx, `
+		DELETE FROM webhook_deliveries
+		WHERE (delivered_at IS NOT NULL OR attempts >= ?)
+		AND COALESCE(delivered_at, next_attempt_at) < ?
+	`, maxAttempts, before.UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune webhooks: %v", err)
+	}
+
+	return res.RowsAffected()
+}
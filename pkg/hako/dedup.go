@@ -0,0 +1,142 @@
+package hako
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+)
+
+// DedupMode controls which existing contents a client can reuse by hash.
+type DedupMode string
+
+const (
+	// DedupOff disables reusing contents by hash. Identical uploads still
+	// share storage, but the client has to send the contents every time.
+	DedupOff DedupMode = "off"
+	// DedupPublic lets any client reuse any live contents. Anyone who knows
+	// the hash of a file can find out whether it has been uploaded.
+	DedupPublic DedupMode = "public"
+	// DedupPrivate lets a client reuse only contents uploaded from its own IP
+	// address, unless it authenticates with an API key.
+	DedupPrivate DedupMode = "private"
+)
+
+// ParseDedupMode parses a dedup mode, defaulting to DedupPrivate when empty.
+func ParseDedupMode(s string) (DedupMode, error) {
+	switch mode := DedupMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case "":
+		return DedupPrivate, nil
+	case DedupOff, DedupPublic, DedupPrivate:
+		return mode, nil
+	default:
+		return DedupPrivate, fmt.Errorf("unknown dedup mode %q", s)
+	}
+}
+
+// HashHeader is the request header in which a client announces the SHA-256
+// hash of the contents it is about to upload.
+const HashHeader = "X-Hako-Sha256"
+
+// parseSha256 normalizes a hex-encoded SHA-256 hash, and reports whether it
+// is valid.
+func parseSha256(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) != 64 {
+		return "", false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return "", false
+		}
+	}
+	return s, true
+}
+
+// findBlob returns a live file with the given contents that the client is
+// allowed to reuse, or nil if there is none.
+func (s *Server) findBlob(c *gin.Context, sha256 string) (*DbFile, error) {
+	ctx := c.Request.Context()
+	cfg := s.config.Load()
+	var ipAddress string
+	switch cfg.DedupMode {
+	case DedupPublic:
+	case DedupPrivate:
+		if !HasClientCert(c) && !cfg.IsAPIKey(RequestToken(c)) {
+			ipAddress = c.ClientIP()
+		}
+	default:
+		return nil, nil
+	}
+
+	return s.db.FindLiveBlob(ctx, sha256, ipAddress)
+}
+
+// sniffBlob detects the mime type of contents that are already stored.
+func (s *Server) sniffBlob(ctx context.Context, filePath string) (*mimetype.MIME, error) {
+	r, err := readFileTraced(ctx, s.fs, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+	return mimetype.DetectReader(r)
+}
+
+// discardBlob deletes contents that were written for a file that was not
+// saved, unless they are shared with a live file.
+func (s *Server) discardBlob(c *gin.Context, filePath string) {
+	// Clean up even if the client has gone away
+	ctx := context.WithoutCancel(c.Request.Context())
+	refs, err := s.db.RefCount(ctx, filePath)
+	if err != nil {
+		RequestLogger(c).Error("Failed to get reference count", "path", filePath, "error", err)
+		return
+	}
+	if refs > 0 {
+		return
+	}
+	if err := deleteFileTraced(ctx, s.fs, filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		RequestLogger(c).Error("Failed to delete file contents", "path", filePath, "error", err)
+	}
+}
+
+// headBlob reports whether contents with the given digest, in the form
+// sha256:<hex>, can be reused by the client with the X-Hako-Sha256 header on
+// upload, without sending them again.
+func (s *Server) headBlob(c *gin.Context) {
+	hash, ok := strings.CutPrefix(c.Param("digest"), "sha256:")
+	if ok {
+		hash, ok = parseSha256(hash)
+	}
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	if !s.checkBlocked(c, hash) {
+		return
+	}
+
+	file, err := s.findBlob(c, hash)
+	if err != nil {
+		RequestLogger(c).Error("Failed to find blob", "sha256", hash, "error", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if file == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Content-Length", strconv.FormatInt(file.Size, 10))
+	c.Status(http.StatusOK)
+}
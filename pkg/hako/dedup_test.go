@@ -0,0 +1,172 @@
+package hako_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+// watchedReader records whether it has been read from.
+type watchedReader struct {
+	io.Reader
+	read bool
+}
+
+func (r *watchedReader) Read(p []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(p)
+}
+
+// putWithHash uploads the contents with the X-Hako-Sha256 header and
+// `Expect: 100-continue`, and reports whether the body was sent.
+func putWithHash(t *testing.T, url, hash, token, contents string) (int, map[string]any, bool) {
+	body := &watchedReader{Reader: strings.NewReader(contents)}
+	req, err := http.NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.ContentLength = int64(len(contents))
+	req.Header.Set("Expect", "100-continue")
+	req.Header.Set(hako.HashHeader, hash)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	var result map[string]any
+	json.NewDecoder(res.Body).Decode(&result)
+	return res.StatusCode, result, body.read
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestServerDedup(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, DedupMode: hako.DedupPublic}
+	srv, db, _ := newTestServer(t, cfg)
+
+	contents := "Hello, World!"
+	hash := sha256Hex(contents)
+
+	status, _ := doRequest(t, http.MethodHead, srv.URL+"/blob/sha256:"+hash, "", nil)
+	assert.Equal(http.StatusNotFound, status, "Unknown blob should not be found")
+	status, _ = doRequest(t, http.MethodHead, srv.URL+"/blob/md5:"+hash, "", nil)
+	assert.Equal(http.StatusBadRequest, status, "Unsupported digest should be rejected")
+
+	// Contents that were not stored before have to be sent
+	status, first, sent := putWithHash(t, srv.URL+"/first.txt", hash, "", contents)
+	assert.Equal(http.StatusOK, status, "First upload should succeed")
+	assert.True(sent, "First upload should send the body")
+	assert.Equal(false, first["deduplicated"], "First upload should not be deduplicated")
+
+	res, err := http.Head(srv.URL + "/blob/sha256:" + hash)
+	assert.Nil(err, "Failed to check blob")
+	assert.Equal(http.StatusOK, res.StatusCode, "Uploaded blob should be found")
+	assert.Equal(int64(len(contents)), res.ContentLength, "Blob size mismatch")
+
+	// The second upload reuses the contents without sending them
+	status, second, sent := putWithHash(t, srv.URL+"/second.txt", hash, "", contents)
+	assert.Equal(http.StatusOK, status, "Second upload should succeed")
+	assert.False(sent, "Second upload should not send the body")
+	assert.Equal(true, second["deduplicated"], "Second upload should be deduplicated")
+
+	res, err = http.Get(srv.URL + "/" + second["id"].(string))
+	assert.Nil(err, "Failed to download file")
+	data, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(contents, string(data), "Deduplicated file contents mismatch")
+	assert.Contains(res.Header.Get("Content-Disposition"), "second.txt", "Deduplicated file should have its own filename")
+
+	// Both files share the contents
+	file, err := db.GetFile(ctx, mustFileID(t, second["id"].(string)))
+	assert.Nil(err, "Failed to get file")
+	refs, err := db.RefCount(ctx, file.FilePath)
+	assert.Nil(err, "Failed to get reference count")
+	assert.Equal(2, refs, "Contents should be shared by both files")
+	assert.Equal(hash, file.Sha256, "Hash should be recorded")
+
+	// Contents that do not match the announced hash are rejected
+	status, _, _ = putWithHash(t, srv.URL+"/third.txt", sha256Hex("other"), "", "not other")
+	assert.Equal(http.StatusBadRequest, status, "Mismatched hash should be rejected")
+	status, _, _ = putWithHash(t, srv.URL+"/third.txt", "nothex", "", contents)
+	assert.Equal(http.StatusBadRequest, status, "Invalid hash should be rejected")
+}
+
+func TestServerDedupPrivate(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, DedupMode: hako.DedupPrivate, APIKeys: []string{"admin-key"}}
+	srv, db, fs := newTestServer(t, cfg)
+
+	// Contents uploaded by someone else
+	contents := "Someone else's secret"
+	hash := sha256Hex(contents)
+	blob, err := fs.WriteFile(strings.NewReader(contents))
+	assert.Nil(err, "Failed to write file")
+	_, err = db.InsertFile(ctx, &hako.DbFile{
+		FilePath:   blob.Path,
+		MimeType:   "text/plain",
+		ExpiresAt:  time.Now().Add(time.Hour),
+		IPAddress:  "192.0.2.1",
+		ScanStatus: hako.ScanClean,
+		Sha256:     blob.Sha256,
+		Size:       blob.Size,
+	})
+	assert.Nil(err, "Failed to insert file")
+
+	status, _ := doRequest(t, http.MethodHead, srv.URL+"/blob/sha256:"+hash, "", nil)
+	assert.Equal(http.StatusNotFound, status, "Other users' blobs should be hidden")
+	status, _, sent := putWithHash(t, srv.URL+"/probe.txt", hash, "", contents)
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	assert.True(sent, "Upload should send the body when the blob is hidden")
+
+	status, _ = doRequest(t, http.MethodHead, srv.URL+"/blob/sha256:"+hash, "admin-key", nil)
+	assert.Equal(http.StatusOK, status, "API keys should see all blobs")
+
+	// The client now has its own copy, which it can reuse
+	status, upload, sent := putWithHash(t, srv.URL+"/again.txt", hash, "", contents)
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	assert.False(sent, "Own blob should be reused")
+	assert.Equal(true, upload["deduplicated"], "Upload should be deduplicated")
+
+	// Dedup can be turned off entirely
+	cfg.DedupMode = hako.DedupOff
+	status, _ = doRequest(t, http.MethodHead, srv.URL+"/blob/sha256:"+hash, "admin-key", nil)
+	assert.Equal(http.StatusNotFound, status, "Blobs should be hidden when dedup is off")
+}
+
+func TestParseDedupMode(t *testing.T) {
+	assert := assert.New(t)
+
+	mode, err := hako.ParseDedupMode("")
+	assert.Nil(err, "Empty mode should be accepted")
+	assert.Equal(hako.DedupPrivate, mode, "Default mode should be private")
+
+	mode, err = hako.ParseDedupMode("Public")
+	assert.Nil(err, "Mode should be case-insensitive")
+	assert.Equal(hako.DedupPublic, mode, "Mode mismatch")
+
+	_, err = hako.ParseDedupMode("shared")
+	assert.NotNil(err, "Unknown mode should be rejected")
+}
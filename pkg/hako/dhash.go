@@ -0,0 +1,101 @@
+package hako
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"strconv"
+)
+
+// maxDHashPixels is the largest image that is decoded to compute its
+// perceptual hash, so that small files that decode to huge images cannot
+// exhaust memory.
+const maxDHashPixels = 50_000_000
+
+// DHashMimes are the mime types of the images that perceptual hashes can be
+// computed for.
+var DHashMimes = []string{"image/png", "image/jpeg", "image/gif"}
+
+// ImageDHash decodes a PNG, JPEG or GIF image and returns its difference hash,
+// a 64-bit perceptual hash that changes little when the image is resized,
+// recompressed or slightly edited.
+func ImageDHash(r io.ReadSeeker) (uint64, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %v", err)
+	}
+	if cfg.Width*cfg.Height > maxDHashPixels {
+		return 0, fmt.Errorf("image too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	return DHash(img), nil
+}
+
+// DHash returns the difference hash of an image. The image is shrunk to 9x8
+// grayscale cells, and each bit tells whether a cell is brighter than the one
+// to its right.
+func DHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	var cells [h][w]uint64
+
+	// Average a grid of samples over each cell, which is much cheaper than
+	// visiting every pixel of a large image
+	const samples = 4
+	bounds := img.Bounds()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum uint64
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					px := bounds.Min.X + ((x*samples+sx)*bounds.Dx()+bounds.Dx()/2)/(w*samples)
+					py := bounds.Min.Y + ((y*samples+sy)*bounds.Dy()+bounds.Dy()/2)/(h*samples)
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += (299*uint64(r) + 587*uint64(g) + 114*uint64(b)) / 1000
+				}
+			}
+			cells[y][x] = sum
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// DHashDistance returns the number of bits that differ between two hashes.
+func DHashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// FormatDHash formats a perceptual hash as 16 hex digits.
+func FormatDHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParseDHash parses a perceptual hash formatted with FormatDHash.
+func ParseDHash(s string) (uint64, bool) {
+	if len(s) != 16 {
+		return 0, false
+	}
+	hash, err := strconv.ParseUint(s, 16, 64)
+	return hash, err == nil
+}
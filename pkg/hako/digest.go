@@ -0,0 +1,60 @@
+package hako
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ETag returns the strong entity tag of a file sent with the given
+// Content-Encoding, or an empty string if the hash of the file is unknown.
+// Encoded responses have different contents, so they get a different tag.
+func (f *DbFile) ETag(encoding string) string {
+	if f.Sha256 == "" {
+		return ""
+	}
+	if encoding != "" {
+		return `"` + f.Sha256 + "-" + encoding + `"`
+	}
+	return `"` + f.Sha256 + `"`
+}
+
+// setDigestHeaders sets the ETag, Digest and Repr-Digest headers of a
+// download. The digests are only known for the unencoded contents, so they
+// are left out of encoded responses.
+func setDigestHeaders(c *gin.Context, file *DbFile, encoding string) {
+	etag := file.ETag(encoding)
+	if etag == "" {
+		return
+	}
+	c.Header("ETag", etag)
+
+	if encoding != "" {
+		return
+	}
+	sum, err := hex.DecodeString(file.Sha256)
+	if err != nil {
+		return
+	}
+	digest := base64.StdEncoding.EncodeToString(sum)
+	c.Header("Digest", "sha-256="+digest)
+	c.Header("Repr-Digest", "sha-256=:"+digest+":")
+}
+
+// ETagMatches reports whether an If-None-Match header matches the entity tag,
+// using the weak comparison required for If-None-Match.
+func ETagMatches(header, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
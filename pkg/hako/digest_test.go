@@ -0,0 +1,57 @@
+package hako_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerDigestHeaders(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour}
+	srv, db, _ := newTestServer(t, cfg)
+
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt?max_downloads=2", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	url := srv.URL + "/" + upload["id"].(string)
+
+	res, err := http.Get(url)
+	assert.Nil(err, "Failed to download file")
+	res.Body.Close()
+	etag := res.Header.Get("ETag")
+	assert.Equal(`"dffd6021bb2bd5b0af676290809ec3a53191dd81c7f70a4b28688a362182986f"`, etag, "ETag should be the hash")
+	assert.Equal("sha-256=3/1gIbsr1bCvZ2KQgJ7DpTGR3YHH9wpLKGiKNiGCmG8=", res.Header.Get("Digest"), "Digest mismatch")
+	assert.Equal("sha-256=:3/1gIbsr1bCvZ2KQgJ7DpTGR3YHH9wpLKGiKNiGCmG8=:", res.Header.Get("Repr-Digest"), "Repr-Digest mismatch")
+
+	// Revalidating does not count as a download
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("If-None-Match", `"other", `+etag)
+		res, err = http.DefaultClient.Do(req)
+		assert.Nil(err, "Failed to revalidate file")
+		res.Body.Close()
+		assert.Equal(http.StatusNotModified, res.StatusCode, "Matching ETag should not be modified")
+	}
+
+	file, err := db.GetFile(ctx, mustFileID(t, upload["id"].(string)))
+	assert.Nil(err, "Failed to get file")
+	assert.Equal(int64(1), file.Downloads, "Revalidations should not be counted")
+	assert.Equal(int64(13), file.Size, "Size should be recorded")
+}
+
+func TestETagMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(hako.ETagMatches(`"abc"`, `"abc"`), "Same tag should match")
+	assert.True(hako.ETagMatches(`W/"abc"`, `"abc"`), "Weak tag should match for If-None-Match")
+	assert.True(hako.ETagMatches(`"x", "abc"`, `"abc"`), "Tag in a list should match")
+	assert.True(hako.ETagMatches(`*`, `"abc"`), "Wildcard should match")
+	assert.False(hako.ETagMatches(`"abcd"`, `"abc"`), "Different tag should not match")
+	assert.False(hako.ETagMatches(`*`, ""), "Unknown tag should not match")
+}
@@ -0,0 +1,176 @@
+package hako
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventType is the type of a file lifecycle event.
+type EventType string
+
+const (
+	EventFileUploaded   EventType = "file.uploaded"
+	EventFileDownloaded EventType = "file.downloaded"
+	EventFileDeleted    EventType = "file.deleted"
+	EventFileExpired    EventType = "file.expired"
+	EventFileReported   EventType = "file.reported"
+
+	// EventUploadProgress reports the number of bytes received for an
+	// in-flight upload.
+	EventUploadProgress EventType = "upload.progress"
+)
+
+// Event is a file lifecycle or upload progress event.
+type Event struct {
+	Type   EventType       `json:"type"`
+	Time   time.Time       `json:"time"`
+	File   *FileInfo       `json:"file,omitempty"`
+	Upload *UploadProgress `json:"upload,omitempty"`
+}
+
+// Public returns the event without the details of the uploader, for streams
+// that anyone can read.
+func (ev Event) Public() Event {
+	if ev.File != nil {
+		info := *ev.File
+		info.IPAddress, info.UserAgent = "", ""
+		ev.File = &info
+	}
+	return ev
+}
+
+// UploadProgress is the server-side progress of an upload, keyed by the
+// upload ID chosen by the client.
+type UploadProgress struct {
+	ID       string `json:"id"`
+	Received int64  `json:"received"`
+
+	// Total is the expected size of the upload, or -1 if unknown.
+	Total int64 `json:"total"`
+
+	// Done is set on the final event of an upload, along with either the ID of
+	// the created file or an error.
+	Done   bool   `json:"done,omitempty"`
+	FileID string `json:"file_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// FileInfo is the JSON representation of a file record exposed to webhooks
+// and other consumers. The address and user agent of the uploader are left
+// out of events sent to the public event stream, and private files are not
+// sent to it at all.
+type FileInfo struct {
+	ID        string    `json:"id"`
+	Slug      string    `json:"slug,omitempty"`
+	Filename  string    `json:"filename"`
+	MimeType  string    `json:"mime_type"`
+	ExpiresAt time.Time `json:"expires_at"`
+	IPAddress string    `json:"ip_address,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Private   bool      `json:"private,omitempty"`
+}
+
+// Info returns the JSON representation of the file.
+func (f *DbFile) Info() FileInfo {
+	return FileInfo{
+		ID:        strconv.FormatInt(f.ID, 36),
+		Slug:      f.Slug,
+		Filename:  f.OriginalFilename,
+		MimeType:  f.MimeType,
+		ExpiresAt: f.ExpiresAt,
+		IPAddress: f.IPAddress,
+		UserAgent: f.UserAgent,
+		Private:   f.AccessKeyHash != "",
+	}
+}
+
+// Events dispatches file lifecycle events to subscribers.
+type Events struct {
+	mu          sync.RWMutex
+	nextId      int
+	subscribers map[int]func(Event)
+}
+
+func NewEvents() *Events {
+	return &Events{subscribers: make(map[int]func(Event))}
+}
+
+// Subscribe registers fn to be called for every published event, and returns
+// a function that removes the subscription. Subscribers are called
+// synchronously from the publishing goroutine, so they must not block.
+func (e *Events) Subscribe(fn func(Event)) func() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := e.nextId
+	e.nextId++
+	e.subscribers[id] = fn
+
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.subscribers, id)
+	}
+}
+
+// Publish sends an event about the file to all subscribers.
+func (e *Events) Publish(typ EventType, file *DbFile) {
+	info := file.Info()
+	e.publish(Event{Type: typ, Time: time.Now(), File: &info})
+}
+
+// PublishProgress sends an upload progress event to all subscribers.
+func (e *Events) PublishProgress(progress UploadProgress) {
+	e.publish(Event{Type: EventUploadProgress, Time: time.Now(), Upload: &progress})
+}
+
+func (e *Events) publish(ev Event) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, fn := range e.subscribers {
+		fn(ev)
+	}
+}
+
+// ProgressReader is an io.Reader that publishes upload progress events as data
+// is read from it, at most once per interval.
+type ProgressReader struct {
+	r        io.Reader
+	events   *Events
+	progress UploadProgress
+	interval time.Duration
+	last     time.Time
+}
+
+func NewProgressReader(r io.Reader, events *Events, uploadId string, total int64) *ProgressReader {
+	return &ProgressReader{
+		r:        r,
+		events:   events,
+		progress: UploadProgress{ID: uploadId, Total: total},
+		interval: 100 * time.Millisecond,
+	}
+}
+
+// Read implements io.Reader.
+func (p *ProgressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.progress.Received += int64(n)
+	if time.Since(p.last) >= p.interval || err == io.EOF {
+		p.last = time.Now()
+		p.events.PublishProgress(p.progress)
+	}
+	return n, err
+}
+
+// Finish publishes the final progress event with the ID of the created file,
+// or the error that aborted the upload.
+func (p *ProgressReader) Finish(fileId string, err error) {
+	p.progress.Done = true
+	p.progress.FileID = fileId
+	if err != nil {
+		p.progress.Error = err.Error()
+	}
+	p.events.PublishProgress(p.progress)
+}
@@ -1,16 +1,72 @@
 package hako
 
 import (
+	"fmt"
 	"io"
+	"log/slog"
 )
 
+// tempPrefix is the filename prefix of files that are still being written.
+// They are removed on error, and any that are left over from a crash are
+// removed when the FS is opened.
+const tempPrefix = ".tmp-"
+
+// Blob describes the contents of a file written to an FS.
+type Blob struct {
+	// Path is the filename to pass to ReadFile and DeleteFile.
+	Path string
+
+	// Sha256 is the hex-encoded SHA-256 hash of the contents.
+	Sha256 string
+
+	// Size is the size of the contents in bytes.
+	Size int64
+}
+
 type FS interface {
 	// ReadFile reads the file named by filename and returns the contents.
 	ReadFile(filename string) (io.ReadSeeker, error)
 
-	// WriteFile writes data to the file with the given expiry.
-	WriteFile(data io.Reader) (string, error)
+	// WriteFile writes data to a new file and returns where it was stored.
+	WriteFile(data io.Reader) (*Blob, error)
 
 	// DeleteFile deletes the file with the given filename.
 	DeleteFile(filename string) error
 }
+
+// EncodedFS is implemented by an FS that stores some files encoded, such as
+// compressed, and can return them without decoding.
+type EncodedFS interface {
+	FS
+
+	// ReadEncoded returns the stored contents of the file along with their
+	// Content-Encoding, which is empty if the contents are not encoded.
+	ReadEncoded(filename string) (io.ReadSeeker, string, error)
+}
+
+// FxNewFS is a constructor for the FS selected by the FsBackend option that
+// is compatible with the fx framework. The logger is the default logger by the
+// time it is passed in, so it is also used while the FS is being opened.
+func FxNewFS(config *Config, logger *slog.Logger) (FS, error) {
+	var fs FS
+	var err error
+	switch config.FsBackend {
+	case "", "local":
+		fs, err = NewLocalFS(config.FsRoot)
+	case "chunked":
+		var chunked *ChunkedFS
+		if chunked, err = NewChunkedFS(config.FsRoot); err == nil {
+			chunked.Logger = logger.With("component", "fs")
+			fs = chunked
+		}
+	default:
+		err = fmt.Errorf("unknown fs backend %q", config.FsBackend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Files stored compressed must stay readable after compression is
+	// disabled, so the FS is wrapped even without any patterns
+	return NewCompressedFS(fs, config.FsCompressMime), nil
+}
@@ -0,0 +1,410 @@
+package hako
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Default chunk sizes of ChunkedFS, suited to large files.
+const (
+	DefaultChunkMinSize = 256 << 10
+	DefaultChunkAvgSize = 1 << 20
+	DefaultChunkMaxSize = 4 << 20
+)
+
+// ChunkedFS is an FS that splits files into content-defined chunks and stores
+// each distinct chunk once, so that files which differ in a few places share
+// most of their storage. Each file is stored as a manifest listing its chunks.
+//
+// Chunks are reference counted by the manifests that use them, and deleted
+// along with the last manifest that does.
+type ChunkedFS struct {
+	Root    string
+	MinSize int
+	AvgSize int
+	MaxSize int
+
+	// mu guards refs, and orders adding and removing chunks with changes to
+	// their reference counts.
+	mu   sync.Mutex
+	refs map[string]int
+
+	Logger *slog.Logger
+}
+
+// chunkManifest lists the chunks of a file, in order.
+type chunkManifest struct {
+	Size   int64        `json:"size"`
+	Chunks []chunkEntry `json:"chunks"`
+}
+
+type chunkEntry struct {
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+func NewChunkedFS(root string) (*ChunkedFS, error) {
+	c := &ChunkedFS{
+		Root:    root,
+		MinSize: DefaultChunkMinSize,
+		AvgSize: DefaultChunkAvgSize,
+		MaxSize: DefaultChunkMaxSize,
+		refs:    make(map[string]int),
+		Logger:  slog.Default().With("component", "fs"),
+	}
+
+	for _, dir := range []string{c.manifestDir(), c.chunkDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.loadRefs(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *ChunkedFS) manifestDir() string {
+	return filepath.Join(c.Root, "manifests")
+}
+
+func (c *ChunkedFS) chunkDir() string {
+	return filepath.Join(c.Root, "chunks")
+}
+
+func (c *ChunkedFS) chunkPath(hash string) string {
+	return filepath.Join(c.chunkDir(), hash[:2], hash)
+}
+
+// loadRefs counts the references to each chunk from the stored manifests, and
+// deletes chunks that are not referenced and temporary files, such as those
+// left behind by an interrupted upload.
+func (c *ChunkedFS) loadRefs() error {
+	err := filepath.WalkDir(c.manifestDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), tempPrefix) {
+			return os.Remove(path)
+		}
+		manifest, err := readManifest(path)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range manifest.Chunks {
+			c.refs[chunk.Sha256]++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load manifests: %w", err)
+	}
+
+	return filepath.WalkDir(c.chunkDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if c.refs[d.Name()] == 0 {
+			if !strings.HasPrefix(d.Name(), tempPrefix) {
+				c.Logger.Info("Removing unreferenced chunk", "sha256", d.Name())
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func readManifest(path string) (*chunkManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest chunkManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// ReadFile implements FS.
+func (c *ChunkedFS) ReadFile(filename string) (io.ReadSeeker, error) {
+	manifest, err := readManifest(filepath.Join(c.manifestDir(), filename))
+	if err != nil {
+		return nil, err
+	}
+	return newChunkedReader(c, manifest), nil
+}
+
+// WriteFile implements FS.
+func (c *ChunkedFS) WriteFile(data io.Reader) (*Blob, error) {
+	hash := sha256.New()
+	chunker, err := NewChunker(io.TeeReader(data, hash), c.MinSize, c.AvgSize, c.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store each chunk, holding a reference to it until the manifest is
+	// written so that it cannot be deleted in the meantime
+	var manifest chunkManifest
+	release := func() {
+		for _, chunk := range manifest.Chunks {
+			c.unref(chunk.Sha256)
+		}
+	}
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		chunkHash, err := c.writeChunk(chunk)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		manifest.Chunks = append(manifest.Chunks, chunkEntry{Sha256: chunkHash, Size: int64(len(chunk))})
+		manifest.Size += int64(len(chunk))
+	}
+
+	hashValue := hex.EncodeToString(hash.Sum(nil))
+	relPath := filepath.Join(hashValue[:2], hashValue)
+
+	if err := c.writeManifest(relPath, &manifest); err != nil {
+		release()
+		return nil, err
+	}
+
+	return &Blob{Path: relPath, Sha256: hashValue, Size: manifest.Size}, nil
+}
+
+// writeChunk stores a chunk unless it already exists, takes a reference to
+// it, and returns its hash.
+func (c *ChunkedFS) writeChunk(chunk []byte) (string, error) {
+	sum := sha256.Sum256(chunk)
+	hash := hex.EncodeToString(sum[:])
+	path := c.chunkPath(hash)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.refs[hash] == 0 {
+		// Write the chunk without holding the lock. Another upload may store
+		// the same chunk in the meantime, which is harmless since the
+		// contents are identical.
+		c.mu.Unlock()
+		tmpPath, err := writeTemp(filepath.Dir(path), chunk)
+		c.mu.Lock()
+		if err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			os.Remove(tmpPath)
+			return "", err
+		}
+	}
+	c.refs[hash]++
+	return hash, nil
+}
+
+// writeManifest stores the manifest of a file. The references to its chunks
+// are kept, unless an identical file is already stored and holds them.
+func (c *ChunkedFS) writeManifest(relPath string, manifest *chunkManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.manifestDir(), relPath)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		for _, chunk := range manifest.Chunks {
+			c.unrefLocked(chunk.Sha256)
+		}
+		return nil
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// DeleteFile implements FS.
+func (c *ChunkedFS) DeleteFile(filename string) error {
+	path := filepath.Join(c.manifestDir(), filename)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	manifest, err := readManifest(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	for _, chunk := range manifest.Chunks {
+		c.unrefLocked(chunk.Sha256)
+	}
+	return nil
+}
+
+func (c *ChunkedFS) unref(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unrefLocked(hash)
+}
+
+// unrefLocked drops a reference to a chunk, and deletes the chunk if it was
+// the last one. It must be called with mu held.
+func (c *ChunkedFS) unrefLocked(hash string) {
+	c.refs[hash]--
+	if c.refs[hash] > 0 {
+		return
+	}
+
+	delete(c.refs, hash)
+	if err := os.Remove(c.chunkPath(hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.Logger.Error("Failed to remove chunk", "sha256", hash, "error", err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place,
+// so that readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath, err := writeTemp(filepath.Dir(path), data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes data to a new temporary file in dir, and returns its path.
+func writeTemp(dir string, data []byte) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp(dir, tempPrefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// chunkedReader reads a file from its chunks, opening one chunk at a time.
+type chunkedReader struct {
+	fs       *ChunkedFS
+	manifest *chunkManifest
+
+	// offsets holds the offset of each chunk in the file.
+	offsets []int64
+	pos     int64
+
+	// current is the open chunk, with index currentIdx.
+	current    *os.File
+	currentIdx int
+}
+
+func newChunkedReader(c *ChunkedFS, manifest *chunkManifest) *chunkedReader {
+	offsets := make([]int64, len(manifest.Chunks))
+	var offset int64
+	for i, chunk := range manifest.Chunks {
+		offsets[i] = offset
+		offset += chunk.Size
+	}
+	return &chunkedReader{fs: c, manifest: manifest, offsets: offsets, currentIdx: -1}
+}
+
+// Read implements io.Reader.
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if r.pos >= r.manifest.Size {
+		return 0, io.EOF
+	}
+
+	// Find the chunk that contains the current position
+	idx := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > r.pos }) - 1
+	if idx != r.currentIdx {
+		if r.current != nil {
+			r.current.Close()
+			r.current = nil
+		}
+		file, err := os.Open(r.fs.chunkPath(r.manifest.Chunks[idx].Sha256))
+		if err != nil {
+			return 0, err
+		}
+		r.current, r.currentIdx = file, idx
+	}
+
+	n, err := r.current.ReadAt(p[:min(int64(len(p)), r.offsets[idx]+r.manifest.Chunks[idx].Size-r.pos)], r.pos-r.offsets[idx])
+	r.pos += int64(n)
+	if err == io.EOF {
+		if n == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *chunkedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.manifest.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close implements io.Closer.
+func (r *chunkedReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current, r.currentIdx = nil, -1
+	return err
+}
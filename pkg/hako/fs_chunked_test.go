@@ -0,0 +1,156 @@
+package hako_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+// randomBytes returns n deterministic pseudo-random bytes.
+func randomBytes(seed int64, n int) []byte {
+	buf := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(buf)
+	return buf
+}
+
+// countChunks returns the number of chunks stored by a ChunkedFS.
+func countChunks(t *testing.T, root string) int {
+	count := 0
+	err := filepath.WalkDir(filepath.Join(root, "chunks"), func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk chunks: %v", err)
+	}
+	return count
+}
+
+func newTestChunkedFS(t *testing.T, root string) *hako.ChunkedFS {
+	fs, err := hako.NewChunkedFS(root)
+	if err != nil {
+		t.Fatalf("Failed to create ChunkedFS: %v", err)
+	}
+	fs.MinSize, fs.AvgSize, fs.MaxSize = 1<<10, 4<<10, 16<<10
+	return fs
+}
+
+func TestChunker(t *testing.T) {
+	assert := assert.New(t)
+
+	data := randomBytes(1, 1<<20)
+	chunker, err := hako.NewChunker(bytes.NewReader(data), 1<<10, 4<<10, 16<<10)
+	assert.Nil(err, "Failed to create chunker")
+
+	var joined []byte
+	var sizes []int
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(err, "Failed to read chunk")
+		joined = append(joined, chunk...)
+		sizes = append(sizes, len(chunk))
+	}
+	assert.Equal(data, joined, "Chunks should add up to the input")
+	for _, size := range sizes[:len(sizes)-1] {
+		assert.GreaterOrEqual(size, 1<<10, "Chunk smaller than the minimum")
+		assert.LessOrEqual(size, 16<<10, "Chunk larger than the maximum")
+	}
+	avg := len(data) / len(sizes)
+	assert.InDelta(4<<10, avg, 2<<10, "Average chunk size should be close to the target")
+
+	_, err = hako.NewChunker(nil, 10, 5, 20)
+	assert.NotNil(err, "Invalid sizes should be rejected")
+}
+
+func TestChunkedFS(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	fs := newTestChunkedFS(t, root)
+
+	_, err := fs.ReadFile("nonexistent")
+	assert.True(errors.Is(err, os.ErrNotExist), "Expected error when reading nonexistent file")
+
+	// Write a file, then a copy with some bytes inserted in the middle
+	original := randomBytes(2, 256<<10)
+	modified := append(append(append([]byte{}, original[:100<<10]...), []byte("inserted")...), original[100<<10:]...)
+
+	blob1, err := fs.WriteFile(bytes.NewReader(original))
+	assert.Nil(err, "Failed to write file")
+	assert.Equal(int64(len(original)), blob1.Size, "Size mismatch")
+	chunks1 := countChunks(t, root)
+
+	blob2, err := fs.WriteFile(bytes.NewReader(modified))
+	assert.Nil(err, "Failed to write file")
+	assert.NotEqual(blob1.Sha256, blob2.Sha256, "Files should have different hashes")
+	added := countChunks(t, root) - chunks1
+	assert.Greater(added, 0, "Modified file should add chunks")
+	assert.Less(added, chunks1/4, "Modified file should share most chunks")
+
+	// Read the whole file, and seek around
+	file, err := fs.ReadFile(blob2.Path)
+	assert.Nil(err, "Failed to read file")
+	data, err := io.ReadAll(file)
+	assert.Nil(err, "Failed to read contents")
+	assert.Equal(modified, data, "File contents mismatch")
+
+	end, err := file.Seek(0, io.SeekEnd)
+	assert.Nil(err, "Failed to seek to end")
+	assert.Equal(int64(len(modified)), end, "Seek to end should return the size")
+
+	_, err = file.Seek(100<<10-4, io.SeekStart)
+	assert.Nil(err, "Failed to seek")
+	buf := make([]byte, 16)
+	_, err = io.ReadFull(file, buf)
+	assert.Nil(err, "Failed to read after seek")
+	assert.Equal(modified[100<<10-4:100<<10+12], buf, "Contents after seek mismatch")
+	file.(io.Closer).Close()
+
+	// Deleting one file keeps the chunks shared with the other
+	assert.Nil(fs.DeleteFile(blob1.Path), "Failed to delete file")
+	file, err = fs.ReadFile(blob2.Path)
+	assert.Nil(err, "Failed to read file")
+	data, err = io.ReadAll(file)
+	assert.Nil(err, "Shared chunks should survive")
+	assert.Equal(modified, data, "File contents mismatch")
+	file.(io.Closer).Close()
+
+	// Reference counts are rebuilt on startup
+	fs = newTestChunkedFS(t, root)
+	assert.Nil(fs.DeleteFile(blob2.Path), "Failed to delete file")
+	assert.Zero(countChunks(t, root), "All chunks should be deleted with the last file")
+}
+
+func TestChunkedFSIdenticalFiles(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	fs := newTestChunkedFS(t, root)
+
+	data := randomBytes(3, 64<<10)
+	blob1, err := fs.WriteFile(bytes.NewReader(data))
+	assert.Nil(err, "Failed to write file")
+	blob2, err := fs.WriteFile(bytes.NewReader(data))
+	assert.Nil(err, "Failed to write file")
+	assert.Equal(blob1.Path, blob2.Path, "Identical files should share a path")
+
+	// Identical files share a manifest, which is deleted once
+	assert.Nil(fs.DeleteFile(blob1.Path), "Failed to delete file")
+	assert.Zero(countChunks(t, root), "Chunks should be deleted with the manifest")
+
+	// Orphaned chunks are cleaned up on startup
+	assert.Nil(os.MkdirAll(filepath.Join(root, "chunks", "ab"), 0755), "Failed to create directory")
+	assert.Nil(os.WriteFile(filepath.Join(root, "chunks", "ab", "abcd"), []byte("orphan"), 0644), "Failed to write chunk")
+	newTestChunkedFS(t, root)
+	assert.Zero(countChunks(t, root), "Orphaned chunks should be deleted on startup")
+}
@@ -0,0 +1,224 @@
+package hako
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// gzipPrefix marks the paths of files stored compressed by CompressedFS. The
+// full path is `gz:<uncompressed size>:<path in the underlying FS>`, so that
+// the size is known without decompressing the file.
+const gzipPrefix = "gz:"
+
+// CompressedFS is an FS that gzips files whose sniffed mime type matches one
+// of Patterns before storing them in the underlying FS, and decompresses them
+// on read. Files that were stored uncompressed are passed through, so that
+// compression can be enabled on an existing FS.
+type CompressedFS struct {
+	FS       FS
+	Patterns []string
+}
+
+func NewCompressedFS(fs FS, patterns []string) *CompressedFS {
+	return &CompressedFS{FS: fs, Patterns: patterns}
+}
+
+// parseGzipPath splits the path of a compressed file into the uncompressed
+// size and the path in the underlying FS. ok is false for uncompressed files.
+func parseGzipPath(filename string) (size int64, path string, ok bool, err error) {
+	rest, ok := strings.CutPrefix(filename, gzipPrefix)
+	if !ok {
+		return 0, filename, false, nil
+	}
+
+	sizeStr, path, found := strings.Cut(rest, ":")
+	if found {
+		size, err = strconv.ParseInt(sizeStr, 10, 64)
+	}
+	if !found || err != nil || size < 0 {
+		return 0, "", false, fmt.Errorf("invalid compressed file path %q", filename)
+	}
+	return size, path, true, nil
+}
+
+// compressible sniffs the mime type of data, and reports whether it matches
+// one of the patterns. The returned reader replays the sniffed bytes.
+func (c *CompressedFS) compressible(data io.Reader) (bool, io.Reader, error) {
+	detected, data, err := SniffReader(data)
+	if err != nil {
+		return false, nil, err
+	}
+	for _, pattern := range c.Patterns {
+		if MatchMime(pattern, detected) {
+			return true, data, nil
+		}
+	}
+	return false, data, nil
+}
+
+// ReadFile implements FS.
+func (c *CompressedFS) ReadFile(filename string) (io.ReadSeeker, error) {
+	size, path, compressed, err := parseGzipPath(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := c.FS.ReadFile(path)
+	if err != nil || !compressed {
+		return raw, err
+	}
+	return newGzipReader(raw, size)
+}
+
+// ReadEncoded implements EncodedFS.
+func (c *CompressedFS) ReadEncoded(filename string) (io.ReadSeeker, string, error) {
+	_, path, compressed, err := parseGzipPath(filename)
+	if err != nil {
+		return nil, "", err
+	}
+
+	raw, err := c.FS.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if compressed {
+		return raw, "gzip", nil
+	}
+	return raw, "", nil
+}
+
+// WriteFile implements FS.
+func (c *CompressedFS) WriteFile(data io.Reader) (*Blob, error) {
+	compress, data, err := c.compressible(data)
+	if err != nil {
+		return nil, err
+	}
+	if !compress {
+		return c.FS.WriteFile(data)
+	}
+
+	// Compress the file while it is being written, hashing the uncompressed
+	// contents so that identical files can still be found by hash
+	hash := sha256.New()
+	var size int64
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gz := gzip.NewWriter(pw)
+		n, err := io.Copy(gz, io.TeeReader(data, hash))
+		if err == nil {
+			err = gz.Close()
+		}
+		size = n
+		pw.CloseWithError(err)
+	}()
+
+	blob, err := c.FS.WriteFile(pr)
+	pr.Close()
+	<-done
+	if err != nil {
+		return nil, err
+	}
+
+	return &Blob{
+		Path:   gzipPrefix + strconv.FormatInt(size, 10) + ":" + blob.Path,
+		Sha256: hex.EncodeToString(hash.Sum(nil)),
+		Size:   size,
+	}, nil
+}
+
+// DeleteFile implements FS.
+func (c *CompressedFS) DeleteFile(filename string) error {
+	_, path, _, err := parseGzipPath(filename)
+	if err != nil {
+		return err
+	}
+	return c.FS.DeleteFile(path)
+}
+
+// gzipReader decompresses a gzip stream, and supports seeking by
+// decompressing from the start of the stream up to the new position.
+type gzipReader struct {
+	raw  io.ReadSeeker
+	zr   *gzip.Reader
+	size int64
+
+	// pos is the position of zr in the decompressed stream, and target the
+	// position requested by Seek, which is only caught up with on Read.
+	pos    int64
+	target int64
+}
+
+func newGzipReader(raw io.ReadSeeker, size int64) (*gzipReader, error) {
+	zr, err := gzip.NewReader(raw)
+	if err != nil {
+		if closer, ok := raw.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+	return &gzipReader{raw: raw, zr: zr, size: size}, nil
+}
+
+// Read implements io.Reader.
+func (r *gzipReader) Read(p []byte) (int, error) {
+	if r.target >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.target < r.pos {
+		if _, err := r.raw.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if err := r.zr.Reset(r.raw); err != nil {
+			return 0, err
+		}
+		r.pos = 0
+	}
+	if r.target > r.pos {
+		n, err := io.CopyN(io.Discard, r.zr, r.target-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.zr.Read(p)
+	r.pos += int64(n)
+	r.target = r.pos
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *gzipReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.target
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.target = offset
+	return offset, nil
+}
+
+// Close implements io.Closer.
+func (r *gzipReader) Close() error {
+	r.zr.Close()
+	if closer, ok := r.raw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
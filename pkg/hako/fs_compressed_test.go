@@ -0,0 +1,145 @@
+package hako_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedFS(t *testing.T) {
+	assert := assert.New(t)
+
+	local, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+	fs := hako.NewCompressedFS(local, []string{"text/*"})
+
+	// Text is compressed
+	text := []byte(strings.Repeat("2024-01-01 INFO request handled\n", 1000))
+	blob, err := fs.WriteFile(bytes.NewReader(text))
+	assert.Nil(err, "Failed to write file")
+	assert.True(strings.HasPrefix(blob.Path, "gz:"), "Text should be stored compressed")
+	assert.Equal(int64(len(text)), blob.Size, "Size should be of the uncompressed contents")
+	assert.Equal(sha256Hex(string(text)), blob.Sha256, "Hash should be of the uncompressed contents")
+
+	raw, encoding, err := fs.ReadEncoded(blob.Path)
+	assert.Nil(err, "Failed to read encoded file")
+	assert.Equal("gzip", encoding, "Encoding mismatch")
+	compressed, _ := io.ReadAll(raw)
+	raw.(io.Closer).Close()
+	assert.Less(len(compressed), len(text)/10, "Text should compress well")
+
+	// Reading decompresses, with support for seeking
+	file, err := fs.ReadFile(blob.Path)
+	assert.Nil(err, "Failed to read file")
+	size, err := file.Seek(0, io.SeekEnd)
+	assert.Nil(err, "Failed to seek to end")
+	assert.Equal(int64(len(text)), size, "Seek to end should return the uncompressed size")
+
+	_, err = file.Seek(5000, io.SeekStart)
+	assert.Nil(err, "Failed to seek")
+	buf := make([]byte, 100)
+	_, err = io.ReadFull(file, buf)
+	assert.Nil(err, "Failed to read after seek")
+	assert.Equal(text[5000:5100], buf, "Contents after seek mismatch")
+
+	_, err = file.Seek(10, io.SeekStart)
+	assert.Nil(err, "Failed to seek backwards")
+	_, err = io.ReadFull(file, buf)
+	assert.Nil(err, "Failed to read after seeking backwards")
+	assert.Equal(text[10:110], buf, "Contents after seeking backwards mismatch")
+	file.(io.Closer).Close()
+
+	// Other types are stored as is
+	png := append(append([]byte{}, pngHeader...), make([]byte, 100)...)
+	blob, err = fs.WriteFile(bytes.NewReader(png))
+	assert.Nil(err, "Failed to write file")
+	assert.False(strings.HasPrefix(blob.Path, "gz:"), "Images should not be compressed")
+	file, err = fs.ReadFile(blob.Path)
+	assert.Nil(err, "Failed to read file")
+	data, _ := io.ReadAll(file)
+	assert.Equal(png, data, "Uncompressed contents mismatch")
+	file.(io.Closer).Close()
+
+	// Deleting a compressed file deletes it from the underlying FS
+	blob, err = fs.WriteFile(bytes.NewReader(text))
+	assert.Nil(err, "Failed to write file")
+	assert.Nil(fs.DeleteFile(blob.Path), "Failed to delete file")
+	_, err = fs.ReadFile(blob.Path)
+	assert.NotNil(err, "Deleted file should not be readable")
+}
+
+func TestServerCompressedDownload(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+	local, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+	fs := hako.NewCompressedFS(local, []string{"text/*"})
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour}
+	server := hako.NewServer(db, fs, hako.NewLiveConfig(cfg), hako.NewScanQueue(db, fs, nil), hako.NewEvents())
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	text := strings.Repeat("hello compressed world\n", 500)
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/log.txt", "", text)
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	url := srv.URL + "/" + upload["id"].(string)
+
+	// Don't let the client decompress the response on its own
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	download := func(headers map[string]string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to download file: %v", err)
+		}
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		return res, data
+	}
+
+	// Clients that accept gzip get the stored contents
+	res, data := download(map[string]string{"Accept-Encoding": "br, gzip"})
+	assert.Equal("gzip", res.Header.Get("Content-Encoding"), "Response should be gzipped")
+	assert.Equal("Accept-Encoding", res.Header.Get("Vary"), "Response should vary by encoding")
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	assert.Nil(err, "Response should be valid gzip")
+	decompressed, _ := io.ReadAll(zr)
+	assert.Equal(text, string(decompressed), "Decompressed contents mismatch")
+
+	// Other clients get the contents decompressed
+	res, data = download(map[string]string{"Accept-Encoding": "gzip;q=0"})
+	assert.Empty(res.Header.Get("Content-Encoding"), "Response should not be encoded")
+	assert.Equal(text, string(data), "Contents mismatch")
+
+	// Ranges apply to the decompressed contents
+	res, data = download(map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=23-27"})
+	assert.Equal(http.StatusPartialContent, res.StatusCode, "Range should be served")
+	assert.Empty(res.Header.Get("Content-Encoding"), "Range should not be encoded")
+	assert.Equal("hello", string(data), "Range contents mismatch")
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(hako.AcceptsEncoding("gzip, deflate", "gzip"), "gzip should be accepted")
+	assert.True(hako.AcceptsEncoding("br;q=1.0, GZIP;q=0.5", "gzip"), "gzip with quality should be accepted")
+	assert.True(hako.AcceptsEncoding("*", "gzip"), "Wildcard should accept gzip")
+	assert.False(hako.AcceptsEncoding("*, gzip;q=0", "gzip"), "gzip with zero quality should be rejected")
+	assert.False(hako.AcceptsEncoding("br", "gzip"), "Other encodings should not accept gzip")
+	assert.False(hako.AcceptsEncoding("", "gzip"), "Empty header should not accept gzip")
+}
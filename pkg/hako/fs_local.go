@@ -18,6 +18,18 @@ func NewLocalFS(root string) (FS, error) {
 		return nil, err
 	}
 
+	// Remove partial files left over from uploads that were interrupted by a
+	// crash
+	temps, err := filepath.Glob(filepath.Join(root, tempPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, temp := range temps {
+		if err := os.Remove(temp); err != nil {
+			return nil, err
+		}
+	}
+
 	return &LocalFS{Root: root}, nil
 }
 
@@ -36,21 +48,21 @@ func (l *LocalFS) ReadFile(filename string) (io.ReadSeeker, error) {
 }
 
 // WriteFile implements FS.
-func (l *LocalFS) WriteFile(data io.Reader) (string, error) {
+func (l *LocalFS) WriteFile(data io.Reader) (*Blob, error) {
 	// Create a temporary file
-	file, err := os.CreateTemp(l.Root, "")
+	file, err := os.CreateTemp(l.Root, tempPrefix+"*")
 	if err != nil {
-		return "", fmt.Errorf("failed to create temporary file: %w", err)
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
 	}
 
 	// Hash and write the file concurrently
 	hash := sha256.New()
 	multiWriter := io.MultiWriter(file, hash)
-	_, err = io.Copy(multiWriter, data)
+	size, err := io.Copy(multiWriter, data)
 	file.Close()
 	if err != nil {
 		os.Remove(file.Name())
-		return "", err
+		return nil, err
 	}
 
 	// Get the hash value
@@ -61,17 +73,18 @@ func (l *LocalFS) WriteFile(data io.Reader) (string, error) {
 	// Create subdirectories
 	err = os.MkdirAll(dirPath, 0755)
 	if err != nil {
-		return "", err
+		os.Remove(file.Name())
+		return nil, err
 	}
 
 	// Rename the temporary file
 	err = os.Rename(file.Name(), filepath.Join(l.Root, relPath))
 	if err != nil {
-		return "", err
+		os.Remove(file.Name())
+		return nil, err
 	}
 
-	// Return the hash value
-	return relPath, nil
+	return &Blob{Path: relPath, Sha256: hashValue, Size: size}, nil
 }
 
 // DeleteFile implements FS.
@@ -28,12 +28,14 @@ func TestLocalFS(t *testing.T) {
 
 	// Test writing a file
 	data := []byte("Hello, World!")
-	fileID, err := fs.WriteFile(bytes.NewReader(data))
+	blob, err := fs.WriteFile(bytes.NewReader(data))
 	assert.NoError(err, "Failed to write file")
-	assert.NotEmpty(fileID, "File ID should not be empty")
+	assert.NotEmpty(blob.Path, "File ID should not be empty")
+	assert.Equal("dffd6021bb2bd5b0af676290809ec3a53191dd81c7f70a4b28688a362182986f", blob.Sha256, "Hash mismatch")
+	assert.Equal(int64(len(data)), blob.Size, "Size mismatch")
 
 	// Test reading the written file
-	file, err := fs.ReadFile(fileID)
+	file, err := fs.ReadFile(blob.Path)
 	assert.NoError(err, "Failed to read file")
 	buf := new(bytes.Buffer)
 	_, err = io.Copy(buf, file)
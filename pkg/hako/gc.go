@@ -2,59 +2,174 @@ package hako
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/fx"
 )
 
 type GC struct {
-	db   *DB
-	fs   FS
-	done chan struct{}
+	db     *DB
+	fs     FS
+	events *Events
+	done   chan struct{}
+
+	// Interval is the time between rounds of garbage collection, and lastRun
+	// the time the last round completed, in nanoseconds since the epoch.
+	Interval time.Duration
+	lastRun  atomic.Int64
+
+	// Config supplies the ScrubInterval, which is how often the contents of
+	// each file are re-hashed. Scrubbing is disabled when it is 0 or Config is
+	// nil. At most ScrubBatchSize contents are checked per round of garbage
+	// collection.
+	Config         *LiveConfig
+	ScrubBatchSize int
+
+	// RunRetention is how long the records of rounds are kept for.
+	RunRetention time.Duration
+
+	Logger *slog.Logger
 }
 
-func NewGC(db *DB, fs FS) *GC {
-	return &GC{db, fs, make(chan struct{})}
+func NewGC(db *DB, fs FS, events *Events) *GC {
+	return &GC{
+		db:             db,
+		fs:             fs,
+		events:         events,
+		done:           make(chan struct{}),
+		Interval:       1 * time.Minute,
+		ScrubBatchSize: 10,
+		RunRetention:   30 * 24 * time.Hour,
+		Logger:         slog.Default().With("component", "gc"),
+	}
 }
 
 // LoopForever runs the garbage collection loop.
 func (g *GC) LoopForever(ctx context.Context) {
-	log.Printf("[GC] Start")
+	g.Logger.Info("Start")
+	g.lastRun.Store(time.Now().UnixNano())
 	for {
 		// Check if the context is cancelled
 		select {
 		case <-ctx.Done():
-			log.Printf("[GC] Stop")
-			g.done <- struct{}{}
+			g.Logger.Info("Stop")
+			close(g.done)
 			return
 		default:
 		}
 
-		removed, err := g.RunGC(ctx)
-		if err != nil {
-			log.Printf("[GC] Failed to run garbage collection: %v", err)
-		} else {
-			if removed > 0 {
-				log.Printf("[GC] Removed %d files", removed)
-			}
-		}
+		g.runRound(ctx)
 
 		// Sleep for a while
-		SleepWithContext(ctx, 1*time.Minute)
+		g.lastRun.Store(time.Now().UnixNano())
+		SleepWithContext(ctx, g.Interval)
 	}
 }
 
+// runRound runs a round of garbage collection and scrubbing, and records it
+// with the storage usage at the end of the round.
+func (g *GC) runRound(ctx context.Context) {
+	run := GCRun{StartedAt: time.Now()}
+
+	removed, gcErr := g.RunGC(ctx)
+	if gcErr != nil {
+		g.Logger.Error("Failed to run garbage collection", "error", gcErr)
+	} else {
+		if removed > 0 {
+			g.Logger.Info("Removed files", "count", removed)
+		}
+	}
+
+	checked, corrupt, scrubErr := g.Scrub(ctx)
+	if scrubErr != nil {
+		g.Logger.Error("Failed to scrub files", "error", scrubErr)
+	} else if checked > 0 {
+		g.Logger.Info("Scrubbed files", "count", checked, "corrupt", corrupt)
+	}
+
+	// Rounds cut short by shutdown are not recorded
+	if ctx.Err() != nil {
+		return
+	}
+
+	run.Duration = time.Since(run.StartedAt)
+	run.Removed, run.Scrubbed, run.Corrupt = removed, checked, corrupt
+	if err := errors.Join(gcErr, scrubErr); err != nil {
+		run.Error = err.Error()
+	}
+	usage, err := g.db.GetStorageUsage(ctx)
+	if err != nil {
+		g.Logger.Error("Failed to get storage usage", "error", err)
+	}
+	run.Usage = usage
+
+	if err := g.db.InsertGCRun(ctx, &run); err != nil {
+		g.Logger.Error("Failed to record garbage collection", "error", err)
+	}
+	if err := g.db.DeleteGCRuns(ctx, time.Now().Add(-g.RunRetention)); err != nil {
+		g.Logger.Error("Failed to delete old garbage collection records", "error", err)
+	}
+}
+
+// CheckAlive returns an error if the garbage collection loop is not running,
+// or has not completed a round within maxMissed intervals, which means that
+// it is stuck.
+func (g *GC) CheckAlive(maxMissed int) error {
+	last := g.lastRun.Load()
+	if last == 0 {
+		return errors.New("garbage collection is not running")
+	}
+
+	since := time.Since(time.Unix(0, last))
+	if since > time.Duration(maxMissed)*g.Interval {
+		return fmt.Errorf("garbage collection has not completed a round in %s", since.Round(time.Second))
+	}
+	return nil
+}
+
 // RunGC runs the garbage collection process.
-func (g *GC) RunGC(ctx context.Context) (int, error) {
+func (g *GC) RunGC(ctx context.Context) (removed int, err error) {
+	ctx, span := tracer.Start(ctx, "GC.RunGC")
+	defer func() {
+		span.SetAttributes(attribute.Int("hako.removed", removed))
+		endSpan(span, err)
+	}()
+
+	// Retry deleting the contents of removed files that could not be deleted
+	// before
+	pending, err := g.db.ListPendingDeletes(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range pending {
+		select {
+		case <-ctx.Done():
+			return removed, nil
+		default:
+		}
+
+		if err := deleteContents(ctx, g.db, g.fs, file.ID, file.FilePath); err != nil {
+			g.Logger.Error("Failed to delete file", "file_id", file.ID, "path", file.FilePath, "error", err)
+			continue
+		}
+		g.Logger.Info("Deleted file", "file_id", file.ID, "path", file.FilePath)
+		removed++
+		g.publishRemoved(ctx, file.ID)
+	}
+
 	// Get a list of expired files
-	files, err := g.db.ListExpiredFiles()
+	files, err := g.db.ListExpiredFiles(ctx)
 	if err != nil {
 		return 0, err
 	}
 
 	// Delete expired files
-	removed := 0
 	for _, expired := range files {
 		// Check if the context is cancelled
 		select {
@@ -64,9 +179,9 @@ func (g *GC) RunGC(ctx context.Context) (int, error) {
 		}
 
 		// Check file reference count
-		refs, err := g.db.RefCount(expired.FilePath)
+		refs, err := g.db.RefCount(ctx, expired.FilePath)
 		if err != nil {
-			log.Printf("[GC] Failed to get reference count for file %d (%s): %v", expired.ID, expired.FilePath, err)
+			g.Logger.Error("Failed to get reference count", "file_id", expired.ID, "path", expired.FilePath, "error", err)
 			continue
 		}
 
@@ -75,19 +190,66 @@ func (g *GC) RunGC(ctx context.Context) (int, error) {
 			continue
 		}
 
-		// Delete the file
-		if err := g.fs.DeleteFile(expired.FilePath); err != nil {
-			log.Printf("[GC] Failed to delete file %d (%s): %v", expired.ID, expired.FilePath, err)
-		} else {
-			g.db.RemoveFile(expired.ID)
-			log.Printf("[GC] Deleted file %d (%s)", expired.ID, expired.FilePath)
-			removed++
+		// Mark the file as removed before touching the filesystem. This fails
+		// if the file was extended after it was listed, in which case it must
+		// be kept.
+		claimed, err := g.db.ClaimExpiredFile(ctx, expired.ID)
+		if err != nil {
+			g.Logger.Error("Failed to claim file", "file_id", expired.ID, "path", expired.FilePath, "error", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		// Delete the file. If that fails, the contents stay pending deletion
+		// and are retried on the next run.
+		if err := deleteContents(ctx, g.db, g.fs, expired.ID, expired.FilePath); err != nil {
+			g.Logger.Error("Failed to delete file", "file_id", expired.ID, "path", expired.FilePath, "error", err)
+			continue
 		}
+		g.Logger.Info("Deleted file", "file_id", expired.ID, "path", expired.FilePath)
+		removed++
+		g.publishRemoved(ctx, expired.ID)
 	}
 
 	return removed, nil
 }
 
+// deleteContents deletes the contents of a removed file, unless they are still
+// used by a live file, and marks them as no longer pending deletion. Another
+// removed file may have already deleted the same contents.
+func deleteContents(ctx context.Context, db *DB, fs FS, id int64, filePath string) error {
+	refs, err := db.RefCount(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		if err := deleteFileTraced(ctx, fs, filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return db.MarkContentsDeleted(ctx, id)
+}
+
+// publishRemoved publishes an event for a file removed by the GC. Infected
+// files, and files that were removed before they expired or used up their
+// downloads, are reported as deleted rather than expired.
+func (g *GC) publishRemoved(ctx context.Context, id int64) {
+	file, err := g.db.GetFile(ctx, id)
+	if err != nil {
+		g.Logger.Error("Failed to get removed file", "file_id", id, "error", err)
+		return
+	}
+
+	expired := !file.ExpiresAt.After(file.RemovedAt) || (file.MaxDownloads > 0 && file.Downloads >= file.MaxDownloads)
+	if file.ScanStatus == ScanInfected || !expired {
+		g.events.Publish(EventFileDeleted, file)
+	} else {
+		g.events.Publish(EventFileExpired, file)
+	}
+}
+
 // Done returns a channel that will be closed when the garbage collection loop
 // is done.
 func (g *GC) Done() <-chan struct{} {
@@ -95,8 +257,10 @@ func (g *GC) Done() <-chan struct{} {
 }
 
 // FxNewGC creates a new GC instance for Fx.
-func FxNewGC(db *DB, fs FS, lc fx.Lifecycle) *GC {
-	gc := NewGC(db, fs)
+func FxNewGC(cfg *LiveConfig, db *DB, fs FS, events *Events, logger *slog.Logger, lc fx.Lifecycle) *GC {
+	gc := NewGC(db, fs, events)
+	gc.Config = cfg
+	gc.Logger = logger.With("component", "gc")
 	ctx, cancel := context.WithCancel(context.Background())
 
 	lc.Append(fx.Hook{
@@ -3,6 +3,9 @@ package hako_test
 import (
 	"bytes"
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -12,6 +15,7 @@ import (
 
 func TestGC(t *testing.T) {
 	assert := assert.New(t)
+	ctx := context.Background()
 
 	db, err := hako.NewDB(":memory:")
 	assert.Nil(err, "Failed to create database")
@@ -23,8 +27,13 @@ func TestGC(t *testing.T) {
 	fs, err := hako.NewLocalFS(tempDir)
 	assert.Nil(err, "Failed to create LocalFS")
 
-	gc := hako.NewGC(db, fs)
-	ctx := context.Background()
+	events := hako.NewEvents()
+	var published []hako.EventType
+	events.Subscribe(func(ev hako.Event) {
+		published = append(published, ev.Type)
+	})
+
+	gc := hako.NewGC(db, fs, events)
 
 	// Test running GC with no expired files
 	removed, err := gc.RunGC(ctx)
@@ -32,10 +41,11 @@ func TestGC(t *testing.T) {
 	assert.Zero(removed, "No files should be removed")
 
 	// Create an expired file
-	filePath, err := fs.WriteFile(bytes.NewReader([]byte("Hello, World!")))
+	blob, err := fs.WriteFile(bytes.NewReader([]byte("Hello, World!")))
+	filePath := blob.Path
 	assert.Nil(err, "Failed to write file")
 	assert.NotEmpty(filePath, "File path should not be empty")
-	fileId, err := db.CreateFile(filePath, "file.txt", "text/plain", time.Now().Add(-1*time.Hour), "127.0.0.1", "TestAgent")
+	fileId, err := db.CreateFile(ctx, filePath, "file.txt", "text/plain", time.Now().Add(-1*time.Hour), "127.0.0.1", "TestAgent")
 	assert.Nil(err, "Failed to create expired file")
 	assert.NotZero(fileId, "File ID should not be zero")
 
@@ -47,6 +57,7 @@ func TestGC(t *testing.T) {
 	// File should be deleted from the filesystem
 	_, err = fs.ReadFile(filePath)
 	assert.Error(err, "File should not exist")
+	assert.Equal([]hako.EventType{hako.EventFileExpired}, published, "Expired event should be published")
 
 	// Test running GC with no expired files
 	removed, err = gc.RunGC(ctx)
@@ -54,17 +65,19 @@ func TestGC(t *testing.T) {
 	assert.Zero(removed, "No files should be removed")
 
 	// Create a non-expired file and an expired file with the same file path
-	filePath, err = fs.WriteFile(bytes.NewReader([]byte("Hello, World!")))
+	blob, err = fs.WriteFile(bytes.NewReader([]byte("Hello, World!")))
+	filePath = blob.Path
 	assert.Nil(err, "Failed to write file")
 	assert.NotEmpty(filePath, "File path should not be empty")
-	fileId, err = db.CreateFile(filePath, "file.txt", "text/plain", time.Now().Add(1*time.Hour), "127.0.0.1", "TestAgent")
+	fileId, err = db.CreateFile(ctx, filePath, "file.txt", "text/plain", time.Now().Add(1*time.Hour), "127.0.0.1", "TestAgent")
 	assert.Nil(err, "Failed to create non-expired file")
 	assert.NotZero(fileId, "File ID should not be zero")
 
-	filePath2, err := fs.WriteFile(bytes.NewReader([]byte("Hello, World!")))
+	blob2, err := fs.WriteFile(bytes.NewReader([]byte("Hello, World!")))
+	filePath2 := blob2.Path
 	assert.Nil(err, "Failed to write file")
 	assert.NotEmpty(filePath2, "File path should not be empty")
-	fileId2, err := db.CreateFile(filePath2, "file.txt", "text/plain", time.Now().Add(-1*time.Hour), "127.0.0.1", "TestAgent")
+	fileId2, err := db.CreateFile(ctx, filePath2, "file.txt", "text/plain", time.Now().Add(-1*time.Hour), "127.0.0.1", "TestAgent")
 	assert.Nil(err, "Failed to create expired file")
 	assert.NotZero(fileId2, "File ID should not be zero")
 
@@ -80,16 +93,207 @@ func TestGC(t *testing.T) {
 	_, err = fs.ReadFile(filePath)
 	assert.Nil(err, "File should exist")
 
-	// Expire the non-expired file
-	err = db.RemoveFile(fileId)
+	// Remove the non-expired file without deleting its contents
+	err = db.RemoveFile(ctx, fileId)
 	assert.Nil(err, "Failed to remove file from DB")
 
 	// Run the GC
 	removed, err = gc.RunGC(ctx)
 	assert.Nil(err, "Failed to run GC")
-	assert.Equal(1, removed, "One file should be removed")
+	assert.Equal(2, removed, "Removed and expired files should be removed")
 
 	// File should be deleted from the filesystem
 	_, err = fs.ReadFile(filePath)
 	assert.Error(err, "File should not exist")
 }
+
+func TestGCExtendedFile(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	fs, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+
+	blob, err := fs.WriteFile(bytes.NewReader([]byte("Hello, World!")))
+	filePath := blob.Path
+	assert.Nil(err, "Failed to write file")
+	fileId, err := db.CreateFile(ctx, filePath, "file.txt", "text/plain", time.Now().Add(-1*time.Hour), "127.0.0.1", "TestAgent")
+	assert.Nil(err, "Failed to create expired file")
+
+	// Expired files cannot be extended
+	expiresAt := time.Now().Add(1 * time.Hour)
+	updated, err := db.UpdateFile(ctx, fileId, hako.FileUpdate{ExpiresAt: &expiresAt})
+	assert.Nil(err, "Failed to update file")
+	assert.False(updated, "Expired file should not be updated")
+
+	// A file extended after being listed by the GC is not claimed
+	expired, err := db.ListExpiredFiles(ctx)
+	assert.Nil(err, "Failed to list expired files")
+	assert.Len(expired, 1, "One file should be expired")
+
+	liveId, err := db.CreateFile(ctx, filePath, "file.txt", "text/plain", time.Now().Add(1*time.Minute), "127.0.0.1", "TestAgent")
+	assert.Nil(err, "Failed to create live file")
+	updated, err = db.UpdateFile(ctx, liveId, hako.FileUpdate{ExpiresAt: &expiresAt})
+	assert.Nil(err, "Failed to update file")
+	assert.True(updated, "Live file should be updated")
+
+	claimed, err := db.ClaimExpiredFile(ctx, liveId)
+	assert.Nil(err, "Failed to claim file")
+	assert.False(claimed, "Live file should not be claimed")
+
+	claimed, err = db.ClaimExpiredFile(ctx, fileId)
+	assert.Nil(err, "Failed to claim file")
+	assert.True(claimed, "Expired file should be claimed")
+
+	claimed, err = db.ClaimExpiredFile(ctx, fileId)
+	assert.Nil(err, "Failed to claim file")
+	assert.False(claimed, "Removed file should not be claimed twice")
+
+	// Files that used up their downloads are collected
+	maxDownloads := int64(1)
+	updated, err = db.UpdateFile(ctx, liveId, hako.FileUpdate{MaxDownloads: &maxDownloads})
+	assert.Nil(err, "Failed to update file")
+	assert.True(updated, "Live file should be updated")
+
+	allowed, err := db.CountDownload(ctx, liveId, "127.0.0.1")
+	assert.Nil(err, "Failed to count download")
+	assert.True(allowed, "First download should be allowed")
+	allowed, err = db.CountDownload(ctx, liveId, "127.0.0.1")
+	assert.Nil(err, "Failed to count download")
+	assert.False(allowed, "Second download should not be allowed")
+
+	// The exhausted file is kept until the last download can finish
+	gc := hako.NewGC(db, fs, hako.NewEvents())
+	removed, err := gc.RunGC(ctx)
+	assert.Nil(err, "Failed to run GC")
+	assert.Equal(1, removed, "Only the claimed file should be removed")
+	_, err = fs.ReadFile(filePath)
+	assert.Nil(err, "File should exist during the grace period")
+
+	db.DownloadGracePeriod = 0
+	removed, err = gc.RunGC(ctx)
+	assert.Nil(err, "Failed to run GC")
+	assert.Equal(1, removed, "Exhausted file should be removed after the grace period")
+
+	_, err = fs.ReadFile(filePath)
+	assert.Error(err, "File should not exist")
+}
+
+// failingDeleteFS fails to delete files until it is told to stop.
+type failingDeleteFS struct {
+	hako.FS
+	fail bool
+}
+
+func (f *failingDeleteFS) DeleteFile(filename string) error {
+	if f.fail {
+		return errors.New("disk is read-only")
+	}
+	return f.FS.DeleteFile(filename)
+}
+
+func TestGCRetryDelete(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	localFS, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+	fs := &failingDeleteFS{FS: localFS, fail: true}
+
+	events := hako.NewEvents()
+	var published []hako.EventType
+	events.Subscribe(func(ev hako.Event) {
+		published = append(published, ev.Type)
+	})
+	gc := hako.NewGC(db, fs, events)
+
+	blob, err := fs.WriteFile(bytes.NewReader([]byte("Hello, World!")))
+	assert.Nil(err, "Failed to write file")
+	_, err = db.CreateFile(ctx, blob.Path, "file.txt", "text/plain", time.Now().Add(-1*time.Hour), "127.0.0.1", "TestAgent")
+	assert.Nil(err, "Failed to create expired file")
+
+	// A failed delete is not counted or reported
+	removed, err := gc.RunGC(ctx)
+	assert.Nil(err, "Failed to run GC")
+	assert.Zero(removed, "File that failed to delete should not be counted")
+	assert.Empty(published, "No event should be published for a failed delete")
+	_, err = fs.ReadFile(blob.Path)
+	assert.Nil(err, "File should still exist")
+
+	pending, err := db.ListPendingDeletes(ctx)
+	assert.Nil(err, "Failed to list pending deletes")
+	assert.Len(pending, 1, "Failed delete should be pending")
+
+	// The next run retries it
+	fs.fail = false
+	removed, err = gc.RunGC(ctx)
+	assert.Nil(err, "Failed to run GC")
+	assert.Equal(1, removed, "Pending delete should be retried")
+	assert.Equal([]hako.EventType{hako.EventFileExpired}, published, "Expired event should be published once deleted")
+	_, err = fs.ReadFile(blob.Path)
+	assert.Error(err, "File should not exist")
+
+	pending, err = db.ListPendingDeletes(ctx)
+	assert.Nil(err, "Failed to list pending deletes")
+	assert.Empty(pending, "No deletes should be pending")
+}
+
+func TestGCScrub(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	tempDir := t.TempDir()
+	fs, err := hako.NewLocalFS(tempDir)
+	assert.Nil(err, "Failed to create LocalFS")
+
+	gc := hako.NewGC(db, fs, hako.NewEvents())
+	gc.Config = hako.NewLiveConfig(&hako.Config{ScrubInterval: time.Hour})
+
+	// Store two files, and corrupt one of them
+	var ids []int64
+	var blobs []*hako.Blob
+	for _, contents := range []string{"intact", "corrupted"} {
+		blob, err := fs.WriteFile(bytes.NewReader([]byte(contents)))
+		assert.Nil(err, "Failed to write file")
+		id, err := db.InsertFile(ctx, &hako.DbFile{
+			FilePath:   blob.Path,
+			ExpiresAt:  time.Now().Add(time.Hour),
+			ScanStatus: hako.ScanClean,
+			Sha256:     blob.Sha256,
+			Size:       blob.Size,
+		})
+		assert.Nil(err, "Failed to insert file")
+		ids = append(ids, id)
+		blobs = append(blobs, blob)
+	}
+	assert.Nil(os.WriteFile(filepath.Join(tempDir, blobs[1].Path), []byte("c0rrupted"), 0644), "Failed to corrupt file")
+
+	checked, corrupt, err := gc.Scrub(ctx)
+	assert.Nil(err, "Failed to scrub")
+	assert.Equal(2, checked, "Both files should be checked")
+	assert.Equal(1, corrupt, "One file should be corrupt")
+
+	file, err := db.GetFile(ctx, ids[0])
+	assert.Nil(err, "Failed to get file")
+	assert.Equal(hako.ScanClean, file.ScanStatus, "Intact file should stay clean")
+	file, err = db.GetFile(ctx, ids[1])
+	assert.Nil(err, "Failed to get file")
+	assert.Equal(hako.ScanCorrupt, file.ScanStatus, "Corrupted file should be quarantined")
+
+	// Files are not checked again until the interval has passed
+	checked, _, err = gc.Scrub(ctx)
+	assert.Nil(err, "Failed to scrub")
+	assert.Zero(checked, "No files should be due")
+}
@@ -0,0 +1,87 @@
+package hako
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthz reports that the process is up.
+func (s *Server) healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// livez reports whether the background work is still making progress, so
+// that a stuck server can be restarted.
+func (s *Server) livez(c *gin.Context) {
+	if s.GC != nil {
+		if err := s.GC.CheckAlive(s.config.Load().HealthGCMaxMissed); err != nil {
+			s.Logger.Warn("Liveness check failed", "error", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "gc": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz reports whether the server can serve requests, which needs the
+// database to be reachable and migrated, and the FS to be writable. The
+// reasons for failing are only logged, since the check is public.
+func (s *Server) readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	res := gin.H{"status": "ok", "db": "ok", "fs": "ok"}
+	status := http.StatusOK
+	if err := s.db.CheckSchema(ctx); err != nil {
+		s.Logger.Warn("Database readiness check failed", "error", err)
+		res["db"] = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	if err := s.probeFS(); err != nil {
+		s.Logger.Warn("Storage readiness check failed", "error", err)
+		res["fs"] = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	if status != http.StatusOK {
+		res["status"] = "unavailable"
+	}
+
+	c.JSON(status, res)
+}
+
+// probeFS returns the result of checkFS, which is only run again once
+// FSProbeInterval has passed since the last run, so that frequent probes do
+// not keep writing to the storage.
+func (s *Server) probeFS() error {
+	s.fsProbeMu.Lock()
+	defer s.fsProbeMu.Unlock()
+
+	if time.Since(s.fsProbeAt) >= s.FSProbeInterval {
+		s.fsProbeErr = s.checkFS()
+		s.fsProbeAt = time.Now()
+	}
+	return s.fsProbeErr
+}
+
+// checkFS writes a probe file and deletes it again. The probe contents are
+// random, so that they are never shared with an uploaded file.
+func (s *Server) checkFS() error {
+	var nonce [16]byte
+	rand.Read(nonce[:])
+
+	blob, err := s.fs.WriteFile(strings.NewReader("hako readiness probe " + hex.EncodeToString(nonce[:])))
+	if err != nil {
+		return fmt.Errorf("failed to write probe: %v", err)
+	}
+	if err := s.fs.DeleteFile(blob.Path); err != nil {
+		return fmt.Errorf("failed to delete probe: %v", err)
+	}
+	return nil
+}
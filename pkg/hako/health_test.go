@@ -0,0 +1,134 @@
+package hako_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerHealth(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	root := t.TempDir()
+	fs, err := hako.NewLocalFS(root)
+	assert.Nil(err, "Failed to create LocalFS")
+
+	var logs syncBuffer
+	logger, err := hako.NewLogger(&logs, "json", slog.LevelInfo)
+	assert.Nil(err, "Failed to create logger")
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, HealthGCMaxMissed: 3}
+	server := hako.NewServer(db, fs, hako.NewLiveConfig(cfg), hako.NewScanQueue(db, fs, nil), hako.NewEvents())
+	server.Logger = logger
+	server.FSProbeInterval = 0
+	gc := hako.NewGC(db, fs, hako.NewEvents())
+	gc.Interval = 10 * time.Millisecond
+	server.GC = gc
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	// The process is up
+	status, res := doRequest(t, http.MethodGet, srv.URL+"/healthz", "", nil)
+	assert.Equal(http.StatusOK, status, "Health check should pass")
+	assert.Equal("ok", res["status"], "Health status mismatch")
+
+	// Not ready until migrated
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/readyz", "", nil)
+	assert.Equal(http.StatusServiceUnavailable, status, "Readiness should fail before migrating")
+	assert.Equal("unavailable", res["db"], "Readiness should report the database")
+	assert.Equal("ok", res["fs"], "FS should be ready")
+
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/readyz", "", nil)
+	assert.Equal(http.StatusOK, status, "Readiness should pass after migrating")
+	assert.Equal("ok", res["status"], "Readiness status mismatch")
+	entries, err := os.ReadDir(root)
+	assert.Nil(err, "Failed to list FS root")
+	for _, entry := range entries {
+		files, _ := os.ReadDir(root + "/" + entry.Name())
+		assert.Empty(files, "Readiness probe should be deleted")
+	}
+
+	// Not live until the GC is running
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/livez", "", nil)
+	assert.Equal(http.StatusServiceUnavailable, status, "Liveness should fail before the GC starts")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go gc.LoopForever(ctx)
+	assert.Eventually(func() bool {
+		status, _ := doRequest(t, http.MethodGet, srv.URL+"/livez", "", nil)
+		return status == http.StatusOK
+	}, time.Second, 5*time.Millisecond, "Liveness should pass while the GC is running")
+
+	// A GC that stopped making progress fails the check
+	cancel()
+	<-gc.Done()
+	time.Sleep(50 * time.Millisecond)
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/livez", "", nil)
+	assert.Equal(http.StatusServiceUnavailable, status, "Liveness should fail when the GC is stuck")
+	assert.Contains(res["gc"], "has not completed a round", "Liveness should report the GC")
+
+	// Storage that cannot be written fails readiness
+	assert.Nil(os.RemoveAll(root), "Failed to remove FS root")
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/readyz", "", nil)
+	assert.Equal(http.StatusServiceUnavailable, status, "Readiness should fail without storage")
+	assert.Equal("unavailable", res["fs"], "Readiness should report the FS")
+
+	// The reasons are only logged, and probes are not access logged
+	var reasons []string
+	for _, entry := range logs.entries(t) {
+		assert.NotEqual("Request", entry["msg"], "Probes should not be access logged")
+		if err, ok := entry["error"].(string); ok {
+			reasons = append(reasons, err)
+		}
+	}
+	assert.Contains(strings.Join(reasons, "\n"), "schema version 0", "Database failure should be logged")
+	assert.Contains(strings.Join(reasons, "\n"), "failed to write probe", "Storage failure should be logged")
+}
+
+// countingFS counts the files written to it.
+type countingFS struct {
+	hako.FS
+	writes atomic.Int32
+}
+
+func (f *countingFS) WriteFile(data io.Reader) (*hako.Blob, error) {
+	f.writes.Add(1)
+	return f.FS.WriteFile(data)
+}
+
+func TestServerReadyzProbe(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+	localFS, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+	fs := &countingFS{FS: localFS}
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour}
+	server := hako.NewServer(db, fs, hako.NewLiveConfig(cfg), hako.NewScanQueue(db, fs, nil), hako.NewEvents())
+	server.FSProbeInterval = time.Hour
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	// The storage probe is reused between checks
+	for i := 0; i < 3; i++ {
+		status, _ := doRequest(t, http.MethodGet, srv.URL+"/readyz", "", nil)
+		assert.Equal(http.StatusOK, status, "Readiness should pass")
+	}
+	assert.Equal(int32(1), fs.writes.Load(), "Storage should only be probed once")
+}
@@ -0,0 +1,123 @@
+package hako
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IPRules restricts the clients that can use a group of routes.
+type IPRules struct {
+	// Allow only lets in clients in these networks, unless it is empty.
+	Allow []netip.Prefix
+
+	// Deny keeps out clients in these networks, even if they are allowed.
+	Deny []netip.Prefix
+}
+
+// Allows reports whether the rules let a client with the given address in.
+// Clients whose address is unknown are only let in without an allowlist.
+func (r IPRules) Allows(addr netip.Addr) bool {
+	if containsAddr(r.Deny, addr) {
+		return false
+	}
+	return len(r.Allow) == 0 || containsAddr(r.Allow, addr)
+}
+
+// ParsePrefixes parses a list of networks in CIDR notation, such as
+// 192.0.2.0/24 or 2001:db8::/32. Single addresses stand for themselves.
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", v)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsAddr reports whether any of the networks contains the address.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr returns the address of the client that sent the request. When
+// the request comes from a trusted proxy, or over a unix socket, the client
+// is the first address set in the given headers, such as X-Forwarded-For,
+// that is not itself a trusted proxy, reading from the end of the list since
+// each proxy appends the address it received the request from. False is
+// returned if the address is unknown, such as for a request over a unix
+// socket without any of the headers.
+func ClientAddr(r *http.Request, trusted []netip.Prefix, headers []string) (netip.Addr, bool) {
+	var addr netip.Addr
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err == nil {
+		addr = remote.Addr().Unmap()
+		if !containsAddr(trusted, addr) {
+			return addr, true
+		}
+	}
+
+	for _, name := range headers {
+		items := strings.Split(strings.Join(r.Header.Values(name), ","), ",")
+		for i := len(items) - 1; i >= 0; i-- {
+			ip, err := netip.ParseAddr(strings.TrimSpace(items[i]))
+			if err != nil {
+				break
+			}
+			ip = ip.Unmap()
+			if i == 0 || !containsAddr(trusted, ip) {
+				return ip, true
+			}
+		}
+	}
+
+	return addr, addr.IsValid()
+}
+
+// resolveClientIP replaces the remote address of the request with the address
+// of the client, as returned by ClientAddr, so that c.ClientIP() returns it
+// everywhere. gin's own resolution is disabled, since it cannot follow
+// configuration reloads.
+func (s *Server) resolveClientIP(c *gin.Context) {
+	cfg := s.config.Load()
+	addr, ok := ClientAddr(c.Request, cfg.TrustedProxies, cfg.ClientIPHeaders)
+	if remote, err := netip.ParseAddrPort(c.Request.RemoteAddr); ok && (err != nil || remote.Addr().Unmap() != addr) {
+		c.Request.RemoteAddr = netip.AddrPortFrom(addr, 0).String()
+	}
+	c.Next()
+}
+
+// allowIPs returns a middleware that only lets in clients allowed by the
+// rules picked from the current configuration.
+func (s *Server) allowIPs(rules func(cfg *Config) IPRules) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addr, _ := netip.ParseAddr(c.ClientIP())
+		if !rules(s.config.Load()).Allows(addr.Unmap()) {
+			RequestLogger(c).Info("Rejecting request from denied address", "client_ip", c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
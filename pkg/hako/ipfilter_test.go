@@ -0,0 +1,128 @@
+package hako_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+// requestFrom sends a request through a trusted proxy on behalf of the client
+// with the given address.
+func requestFrom(t *testing.T, method, url, clientIP, body string) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("X-Forwarded-For", clientIP)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func mustPrefixes(t *testing.T, values ...string) []netip.Prefix {
+	prefixes, err := hako.ParsePrefixes(values)
+	if err != nil {
+		t.Fatalf("Failed to parse networks: %v", err)
+	}
+	return prefixes
+}
+
+func TestIPRules(t *testing.T) {
+	assert := assert.New(t)
+
+	prefixes := mustPrefixes(t, "192.0.2.7/24", "2001:db8::/32", "198.51.100.1")
+	assert.Equal("192.0.2.0/24,2001:db8::/32,198.51.100.1/32", joinPrefixes(prefixes), "Networks should be masked")
+	_, err := hako.ParsePrefixes([]string{"192.0.2.0/33"})
+	assert.NotNil(err, "Invalid networks should be rejected")
+	_, err = hako.ParsePrefixes([]string{"example.com"})
+	assert.NotNil(err, "Host names should be rejected")
+
+	rules := hako.IPRules{Allow: prefixes, Deny: mustPrefixes(t, "192.0.2.128/25")}
+	assert.True(rules.Allows(netip.MustParseAddr("192.0.2.1")), "Allowed address should be let in")
+	assert.True(rules.Allows(netip.MustParseAddr("2001:db8::1")), "Allowed IPv6 address should be let in")
+	assert.False(rules.Allows(netip.MustParseAddr("192.0.2.200")), "Denied address should win over allowed network")
+	assert.False(rules.Allows(netip.MustParseAddr("203.0.113.1")), "Address outside the allowlist should be kept out")
+	assert.False(rules.Allows(netip.Addr{}), "Unknown address should be kept out by an allowlist")
+	assert.True(hako.IPRules{}.Allows(netip.Addr{}), "Empty rules should let everyone in")
+}
+
+func joinPrefixes(prefixes []netip.Prefix) string {
+	entries := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		entries[i] = prefix.String()
+	}
+	return strings.Join(entries, ",")
+}
+
+func TestClientAddr(t *testing.T) {
+	assert := assert.New(t)
+
+	trusted := mustPrefixes(t, "10.0.0.0/8")
+	headers := []string{"X-Forwarded-For", "X-Real-IP"}
+	clientAddr := func(remoteAddr string, header http.Header) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		addr, ok := hako.ClientAddr(req, trusted, headers)
+		if !ok {
+			return ""
+		}
+		return addr.String()
+	}
+
+	spoofed := http.Header{"X-Forwarded-For": {"198.51.100.1"}}
+	assert.Equal("203.0.113.9", clientAddr("203.0.113.9:1234", spoofed), "Headers from untrusted clients should be ignored")
+	assert.Equal("198.51.100.1", clientAddr("10.0.0.1:1234", spoofed), "Headers from trusted proxies should be believed")
+	assert.Equal("192.0.2.5", clientAddr("10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1, 192.0.2.5, 10.0.0.2"}}),
+		"Client should be the last address that is not a trusted proxy")
+	assert.Equal("2001:db8::1", clientAddr("[::ffff:10.0.0.1]:1234", http.Header{"X-Real-Ip": {"2001:db8::1"}}),
+		"Later headers should be used when earlier ones are missing")
+	assert.Equal("10.0.0.1", clientAddr("10.0.0.1:1234", nil), "Proxy itself should be the client without headers")
+	assert.Equal("198.51.100.1", clientAddr("@", spoofed), "Unix socket clients should be trusted proxies")
+	assert.Equal("", clientAddr("@", nil), "Unix socket client without headers should be unknown")
+}
+
+func TestServerIPRules(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &hako.Config{
+		FsMaxFileSize:   1 << 20,
+		FsMaxTTL:        24 * time.Hour,
+		AdminToken:      "admin-token",
+		TrustedProxies:  mustPrefixes(t, "127.0.0.1", "::1"),
+		ClientIPHeaders: []string{"X-Forwarded-For"},
+		DenyIPs:         mustPrefixes(t, "203.0.113.0/24"),
+		UploadIPs:       hako.IPRules{Allow: mustPrefixes(t, "10.0.0.0/8", "2001:db8::/32")},
+		AdminIPs:        hako.IPRules{Allow: mustPrefixes(t, "10.0.0.1")},
+	}
+	srv, _, _ := newTestServer(t, cfg)
+
+	// Uploads are restricted, downloads are public
+	assert.Equal(http.StatusOK, requestFrom(t, http.MethodPut, srv.URL+"/file.txt", "10.1.2.3", "Hello"), "Upload from allowed network should succeed")
+	assert.Equal(http.StatusOK, requestFrom(t, http.MethodPut, srv.URL+"/file.txt", "2001:db8::5", "Hello"), "Upload from allowed IPv6 network should succeed")
+	assert.Equal(http.StatusForbidden, requestFrom(t, http.MethodPut, srv.URL+"/file.txt", "198.51.100.1", "Hello"), "Upload from other networks should be rejected")
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt", "", "Hello")
+	assert.Equal(http.StatusForbidden, status, "Upload from the proxy itself should be rejected")
+	assert.Nil(upload["id"], "Rejected upload should not be stored")
+	assert.Equal(http.StatusOK, requestFrom(t, http.MethodGet, srv.URL+"/", "198.51.100.1", ""), "Downloads should be public")
+
+	// Banned clients are kept out everywhere
+	assert.Equal(http.StatusForbidden, requestFrom(t, http.MethodGet, srv.URL+"/", "203.0.113.5", ""), "Banned client should be rejected")
+	assert.Equal(http.StatusOK, requestFrom(t, http.MethodGet, srv.URL+"/healthz", "203.0.113.5", ""), "Health checks should not be restricted")
+
+	// Admin access is rejected before the token is checked
+	assert.Equal(http.StatusForbidden, requestFrom(t, http.MethodGet, srv.URL+"/admin/api/usage", "10.0.0.2", ""), "Admin from other address should be rejected")
+	assert.Equal(http.StatusUnauthorized, requestFrom(t, http.MethodGet, srv.URL+"/admin/api/usage", "10.0.0.1", ""), "Admin from allowed address should need a token")
+}
@@ -0,0 +1,132 @@
+package hako
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"go.uber.org/fx"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFdsStart = 3
+
+// Listen listens on addr, which is either a TCP address such as `:8080`, a
+// unix socket such as `unix:/run/hako/hako.sock`, or `systemd` for the socket
+// passed by systemd socket activation, or `systemd:<name>` for the one with
+// the given FileDescriptorName. Unix sockets are created with the given
+// permissions.
+func Listen(addr string, socketMode os.FileMode) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return listenUnix(path, socketMode)
+	}
+	if addr == "systemd" {
+		return systemdListener("")
+	}
+	if name, ok := strings.CutPrefix(addr, "systemd:"); ok {
+		return systemdListener(name)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix listens on a unix socket, replacing the socket left behind by a
+// previous run.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListener returns a socket passed by systemd, the first one if name
+// is empty.
+func systemdListener(name string) (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < n; i++ {
+		if name != "" && (i >= len(names) || names[i] != name) {
+			continue
+		}
+
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "systemd:"+name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket passed by systemd: %w", err)
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+}
+
+// SdNotify sends a state change, such as `READY=1`, to systemd. It does
+// nothing when the service is not run with Type=notify.
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Sockets in the abstract namespace start with a NUL byte
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// FxNotifySystemd tells systemd that the service is ready once all
+// components have started, and that it is stopping as soon as shutdown
+// begins. It should be invoked last.
+func FxNotifySystemd(logger *slog.Logger, lc fx.Lifecycle) {
+	notify := func(state string) {
+		if err := SdNotify(state); err != nil {
+			logger.Warn("Failed to notify systemd", "state", state, "error", err)
+		}
+	}
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			notify("READY=1")
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			notify("STOPPING=1")
+			return nil
+		},
+	})
+}
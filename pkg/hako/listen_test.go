@@ -0,0 +1,81 @@
+package hako_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenUnix(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "hako.sock")
+
+	l, err := hako.Listen("unix:"+path, 0600)
+	assert.Nil(err, "Failed to listen on unix socket")
+	info, err := os.Stat(path)
+	assert.Nil(err, "Socket should exist")
+	assert.Equal(os.FileMode(0600), info.Mode().Perm(), "Socket permissions mismatch")
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})}
+	go srv.Serve(l)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	res, err := client.Get("http://hako/")
+	assert.Nil(err, "Failed to send request over unix socket")
+	res.Body.Close()
+	assert.Equal(http.StatusTeapot, res.StatusCode, "Request should be served")
+	srv.Close()
+
+	// A socket left behind is replaced, but other files are not
+	_, err = net.Listen("unix", path)
+	assert.Nil(err, "Failed to leave a socket behind")
+	l, err = hako.Listen("unix:"+path, 0660)
+	assert.Nil(err, "Stale socket should be replaced")
+	l.Close()
+
+	file := filepath.Join(t.TempDir(), "file")
+	assert.Nil(os.WriteFile(file, []byte("data"), 0644), "Failed to write file")
+	_, err = hako.Listen("unix:"+file, 0660)
+	assert.Error(err, "Regular files should not be replaced")
+}
+
+func TestListenSystemd(t *testing.T) {
+	assert := assert.New(t)
+
+	// Sockets passed to another process are not used
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	_, err := hako.Listen("systemd", 0)
+	assert.Error(err, "Sockets for another process should not be used")
+}
+
+func TestSdNotify(t *testing.T) {
+	assert := assert.New(t)
+
+	// Nothing is sent outside of systemd
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.Nil(hako.SdNotify("READY=1"), "Notify without systemd should succeed")
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.Nil(err, "Failed to listen on notify socket")
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	assert.Nil(hako.SdNotify("READY=1"), "Failed to notify")
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	assert.Nil(err, "Failed to read notification")
+	assert.Equal("READY=1", string(buf[:n]), "Notification mismatch")
+}
@@ -0,0 +1,153 @@
+package hako
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the ID of a request. It is taken from the request
+// when present, so that logs can be correlated with a proxy in front of the
+// server, and is always echoed in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// Keys of the values stored in the gin context for the access log.
+const (
+	loggerKey = "hako.logger"
+	fileIDKey = "hako.file_id"
+)
+
+// NewLogger creates a logger writing to w in the given format, either `text`
+// or `json`.
+func NewLogger(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// Level implements slog.Leveler, so that the log level follows the current
+// configuration.
+func (l *LiveConfig) Level() slog.Level {
+	return l.Load().LogLevel
+}
+
+// FxNewLogger creates the logger for Fx, writing to stderr, and makes it the
+// default logger.
+func FxNewLogger(cfg *LiveConfig) (*slog.Logger, error) {
+	logger, err := NewLogger(os.Stderr, cfg.Load().LogFormat, cfg)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	cfg.Logger = logger.With("component", "config")
+	return logger, nil
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether an ID given by the client is safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r <= 0x20 || r >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestLogger returns the logger for the request, which includes its ID.
+func RequestLogger(c *gin.Context) *slog.Logger {
+	if logger, ok := c.Get(loggerKey); ok {
+		return logger.(*slog.Logger)
+	}
+	return slog.Default()
+}
+
+// setLogFileID records the ID the file a request is about is linked by, to be
+// included in the access log.
+func setLogFileID(c *gin.Context, file *DbFile) {
+	c.Set(fileIDKey, file.PublicID())
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// accessLog assigns an ID to every request, and logs the request once it is
+// done, with the file it was about and the bytes transferred.
+func (s *Server) accessLog(c *gin.Context) {
+	start := time.Now()
+
+	id := c.GetHeader(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	c.Header(RequestIDHeader, id)
+	logger := s.Logger.With("request_id", id)
+	if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+		logger = logger.With("trace_id", span.TraceID().String())
+	}
+	c.Set(loggerKey, logger)
+
+	body := &countingReader{ReadCloser: c.Request.Body}
+	if c.Request.Body != nil {
+		c.Request.Body = body
+	}
+
+	c.Next()
+
+	attrs := []any{
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"client_ip", c.ClientIP(),
+		"bytes_in", body.n,
+		"bytes_out", max(c.Writer.Size(), 0),
+		"duration", time.Since(start),
+	}
+	if fileID, ok := c.Get(fileIDKey); ok {
+		attrs = append(attrs, "file_id", fileID)
+	}
+	if HasClientCert(c) {
+		attrs = append(attrs, "client_cert", c.Request.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	if len(c.Errors) > 0 {
+		attrs = append(attrs, "error", c.Errors.String())
+	}
+
+	level := slog.LevelInfo
+	if c.Writer.Status() >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	logger.Log(c.Request.Context(), level, "Request", attrs...)
+}
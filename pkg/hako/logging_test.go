@@ -0,0 +1,105 @@
+package hako_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a buffer that is safe to write from the server goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries decodes the JSON log lines written so far.
+func (b *syncBuffer) entries(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := make(map[string]any)
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Failed to decode log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestServerAccessLog(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+	fs, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+
+	var logs syncBuffer
+	logger, err := hako.NewLogger(&logs, "json", slog.LevelInfo)
+	assert.Nil(err, "Failed to create logger")
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour}
+	server := hako.NewServer(db, fs, hako.NewLiveConfig(cfg), hako.NewScanQueue(db, fs, nil), hako.NewEvents())
+	server.Logger = logger
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	// The request ID given by the client is echoed and logged
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/hello.txt", strings.NewReader("hello world"))
+	req.Header.Set(hako.RequestIDHeader, "req-1234")
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(err, "Failed to upload file")
+	var upload map[string]any
+	assert.Nil(json.NewDecoder(res.Body).Decode(&upload), "Failed to decode upload")
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode, "Upload should succeed")
+	assert.Equal("req-1234", res.Header.Get(hako.RequestIDHeader), "Request ID should be echoed")
+
+	entries := logs.entries(t)
+	assert.Len(entries, 1, "Upload should be logged once")
+	entry := entries[0]
+	assert.Equal("Request", entry["msg"], "Log message mismatch")
+	assert.Equal("req-1234", entry["request_id"], "Logged request ID mismatch")
+	assert.Equal("PUT", entry["method"], "Logged method mismatch")
+	assert.Equal(float64(http.StatusOK), entry["status"], "Logged status mismatch")
+	assert.Equal(float64(len("hello world")), entry["bytes_in"], "Logged bytes in mismatch")
+	assert.Greater(entry["bytes_out"], float64(0), "Logged bytes out should be set")
+	assert.Equal(upload["id"], entry["file_id"], "Logged file ID should be the public ID")
+	assert.Contains(entry, "duration", "Logged duration should be set")
+
+	// Missing or unsafe request IDs are replaced
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/doesnotexist", nil)
+	req.Header.Set(hako.RequestIDHeader, "bad id")
+	res, err = http.DefaultClient.Do(req)
+	assert.Nil(err, "Failed to send request")
+	res.Body.Close()
+	id := res.Header.Get(hako.RequestIDHeader)
+	assert.Len(id, 32, "Generated request ID should be returned")
+
+	entries = logs.entries(t)
+	assert.Len(entries, 2, "Request should be logged")
+	assert.Equal(id, entries[1]["request_id"], "Generated request ID should be logged")
+	assert.Equal(float64(http.StatusNotFound), entries[1]["status"], "Logged status mismatch")
+	assert.NotContains(entries[1], "file_id", "Unknown file should not be logged")
+}
@@ -0,0 +1,153 @@
+package hako
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PatchFileRequest is the body of a PATCH request. Omitted fields are left
+// unchanged.
+type PatchFileRequest struct {
+	// Expiry is the new time to live of the file, counted from now, in the
+	// same format as the expiry query parameter on upload.
+	Expiry *string `json:"expiry"`
+
+	// Filename is the new download filename.
+	Filename *string `json:"filename"`
+
+	// MaxDownloads is the new download limit, or 0 for unlimited.
+	MaxDownloads *int64 `json:"max_downloads"`
+}
+
+// validFilename reports whether the name is safe to use as a download
+// filename in the Content-Disposition header.
+func validFilename(name string) bool {
+	if name == "" || len(name) > 255 {
+		return false
+	}
+	return !strings.ContainsFunc(name, func(r rune) bool {
+		return r < 0x20 || r == 0x7f || r == '"' || r == '\\' || r == '/'
+	})
+}
+
+// patchFile changes the expiry, download filename or download limit of a
+// file.
+func (s *Server) patchFile(c *gin.Context) {
+	ctx := c.Request.Context()
+	cfg := s.config.Load()
+	file, ok := s.findFile(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !HasClientCert(c) && !cfg.CanManageFile(RequestToken(c), file) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to manage this file"})
+		return
+	}
+
+	var req PatchFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parsing request: %s", err)})
+		return
+	}
+
+	var update FileUpdate
+	if req.Expiry != nil {
+		ttl, err := ParseExpiry(*req.Expiry)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parsing expiry: %s", err)})
+			return
+		}
+
+		_, maxTTL := cfg.LimitsForMime(LookupMime(file.MimeType))
+		if ttl <= 0 || ttl > maxTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expiry out of range (max %s)", maxTTL)})
+			return
+		}
+
+		expiresAt := time.Now().Add(ttl)
+		update.ExpiresAt = &expiresAt
+	}
+	if req.Filename != nil {
+		if !validFilename(*req.Filename) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid filename"})
+			return
+		}
+		update.OriginalFilename = req.Filename
+	}
+	if req.MaxDownloads != nil {
+		if *req.MaxDownloads < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid max_downloads"})
+			return
+		}
+		update.MaxDownloads = req.MaxDownloads
+	}
+
+	// The update only applies if the file is still alive, so that it cannot
+	// race with the GC removing it
+	updated, err := s.db.UpdateFile(ctx, file.ID, update)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !updated {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	file, err = s.db.GetFile(ctx, file.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	info := file.Info()
+	c.JSON(http.StatusOK, gin.H{
+		"id":            info.ID,
+		"filename":      info.Filename,
+		"expires_at":    info.ExpiresAt,
+		"downloads":     file.Downloads,
+		"max_downloads": file.MaxDownloads,
+	})
+}
+
+// deleteFile removes a file before its expiry.
+func (s *Server) deleteFile(c *gin.Context) {
+	file, ok := s.findFile(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !HasClientCert(c) && !s.config.Load().CanManageFile(RequestToken(c), file) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to manage this file"})
+		return
+	}
+
+	if !s.removeFile(c, file) {
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// removeFile removes a file and deletes its contents unless they are shared
+// with another live file. If the file cannot be removed, an error response is
+// written and false is returned.
+func (s *Server) removeFile(c *gin.Context, file *DbFile) bool {
+	ctx := c.Request.Context()
+	if err := s.db.RemoveFile(ctx, file.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+
+	// The file is gone either way. If its contents cannot be deleted now,
+	// they stay pending deletion, and the GC retries and reports them.
+	if err := deleteContents(ctx, s.db, s.fs, file.ID, file.FilePath); err != nil {
+		RequestLogger(c).Error("Failed to delete file contents", "file_id", file.ID, "path", file.FilePath, "error", err)
+		return true
+	}
+
+	s.events.Publish(EventFileDeleted, file)
+	return true
+}
@@ -0,0 +1,196 @@
+package hako_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer creates a server backed by an in-memory database and a
+// temporary directory.
+func newTestServer(t *testing.T, cfg *hako.Config) (*httptest.Server, *hako.DB, hako.FS) {
+	db, err := hako.NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	fs, err := hako.NewLocalFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create LocalFS: %v", err)
+	}
+
+	server := hako.NewServer(db, fs, hako.NewLiveConfig(cfg), hako.NewScanQueue(db, fs, nil), hako.NewEvents())
+	srv := httptest.NewServer(server.Handler())
+	t.Cleanup(srv.Close)
+
+	return srv, db, fs
+}
+
+// doRequest sends a request with an optional token and JSON body, and decodes
+// the JSON response, if any.
+func doRequest(t *testing.T, method, url, token string, body any) (int, map[string]any) {
+	var reader io.Reader
+	if s, ok := body.(string); ok {
+		reader = strings.NewReader(s)
+	} else if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	var result map[string]any
+	json.NewDecoder(res.Body).Decode(&result)
+	return res.StatusCode, result
+}
+
+// mustFileID parses a base36 file ID returned by the server.
+func mustFileID(t *testing.T, id string) int64 {
+	fileId, err := strconv.ParseInt(id, 36, 64)
+	if err != nil {
+		t.Fatalf("Failed to parse file ID %q: %v", id, err)
+	}
+	return fileId
+}
+
+func TestServerManageFile(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, APIKeys: []string{"admin-key"}}
+	srv, _, _ := newTestServer(t, cfg)
+
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt?expiry=1h", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	id, token := upload["id"].(string), upload["delete_token"].(string)
+	assert.NotEmpty(token, "Upload should return a delete token")
+
+	// Unauthorized changes are rejected
+	status, _ = doRequest(t, http.MethodPatch, srv.URL+"/"+id, "", map[string]any{"expiry": "2h"})
+	assert.Equal(http.StatusForbidden, status, "Patch without a token should be forbidden")
+	status, _ = doRequest(t, http.MethodPatch, srv.URL+"/"+id, "wrong", map[string]any{"expiry": "2h"})
+	assert.Equal(http.StatusForbidden, status, "Patch with a wrong token should be forbidden")
+
+	// Extend the expiry with the delete token
+	status, patched := doRequest(t, http.MethodPatch, srv.URL+"/"+id, token, map[string]any{"expiry": "12h", "filename": "renamed.txt"})
+	assert.Equal(http.StatusOK, status, "Patch should succeed")
+	expiresAt, err := time.Parse(time.RFC3339, patched["expires_at"].(string))
+	assert.Nil(err, "Failed to parse expiry")
+	assert.WithinDuration(time.Now().Add(12*time.Hour), expiresAt, 1*time.Minute, "Expiry should be extended")
+	assert.Equal("renamed.txt", patched["filename"], "Filename should be changed")
+
+	// Expiry is bounded by the maximum TTL
+	status, _ = doRequest(t, http.MethodPatch, srv.URL+"/"+id, token, map[string]any{"expiry": "2d"})
+	assert.Equal(http.StatusBadRequest, status, "Expiry beyond the maximum should be rejected")
+	status, _ = doRequest(t, http.MethodPatch, srv.URL+"/"+id, token, map[string]any{"filename": "../evil\""})
+	assert.Equal(http.StatusBadRequest, status, "Invalid filename should be rejected")
+
+	// Limit downloads with an API key
+	status, patched = doRequest(t, http.MethodPatch, srv.URL+"/"+id, "admin-key", map[string]any{"max_downloads": 1})
+	assert.Equal(http.StatusOK, status, "Patch with an API key should succeed")
+	assert.Equal(float64(1), patched["max_downloads"], "Download limit should be changed")
+
+	res, err := http.Get(srv.URL + "/" + id)
+	assert.Nil(err, "Failed to download file")
+	assert.Equal(http.StatusOK, res.StatusCode, "First download should succeed")
+	assert.Contains(res.Header.Get("Content-Disposition"), "renamed.txt", "Download should use the new filename")
+	res.Body.Close()
+
+	res, err = http.Get(srv.URL + "/" + id)
+	assert.Nil(err, "Failed to download file")
+	assert.Equal(http.StatusNotFound, res.StatusCode, "Second download should be over the limit")
+	res.Body.Close()
+}
+
+func TestServerDeleteFile(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour}
+	srv, db, fs := newTestServer(t, cfg)
+
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	id, token := upload["id"].(string), upload["delete_token"].(string)
+
+	status, _ = doRequest(t, http.MethodDelete, srv.URL+"/"+id, "", nil)
+	assert.Equal(http.StatusForbidden, status, "Delete without a token should be forbidden")
+
+	status, _ = doRequest(t, http.MethodDelete, srv.URL+"/"+id, token, nil)
+	assert.Equal(http.StatusNoContent, status, "Delete should succeed")
+
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+id, "", nil)
+	assert.Equal(http.StatusNotFound, status, "Deleted file should not be found")
+
+	// Contents are deleted from the filesystem
+	rows, err := db.ListExpiredFiles(ctx)
+	assert.Nil(err, "Failed to list expired files")
+	assert.Empty(rows, "Deleted file should not be left for the GC")
+	hash := "dffd6021bb2bd5b0af676290809ec3a53191dd81c7f70a4b28688a362182986f"
+	_, err = fs.ReadFile(filepath.Join(hash[:2], hash))
+	assert.Error(err, "File should not exist")
+}
+
+func TestServerPrivateFile(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, PrivateLinks: true}
+	srv, _, _ := newTestServer(t, cfg)
+
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	id, key, token := upload["id"].(string), upload["key"].(string), upload["delete_token"].(string)
+	assert.Len(key, 22, "Key should have 128 bits")
+
+	// The file does not exist without its key
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+id, "", nil)
+	assert.Equal(http.StatusNotFound, status, "Download without the key should not be found")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+id+"?k=wrong", "", nil)
+	assert.Equal(http.StatusNotFound, status, "Download with a wrong key should not be found")
+
+	res, err := http.Get(srv.URL + "/" + id + "?k=" + key)
+	assert.Nil(err, "Failed to download file")
+	assert.Equal(http.StatusOK, res.StatusCode, "Download with the key should succeed")
+	assert.Equal("no-referrer", res.Header.Get("Referrer-Policy"), "Key should not leak to other sites")
+	assert.True(strings.HasPrefix(res.Header.Get("Cache-Control"), "private,"), "Shared caches should not keep the file")
+	res.Body.Close()
+
+	// The delete token can be used instead of the key
+	status, _ = doRequest(t, http.MethodPatch, srv.URL+"/"+id, token, map[string]any{"expiry": "2h"})
+	assert.Equal(http.StatusOK, status, "Patch with the delete token should succeed")
+
+	// Uploaders can opt out
+	status, upload = doRequest(t, http.MethodPut, srv.URL+"/file.txt?private=false", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Public upload should succeed")
+	assert.Nil(upload["key"], "Public upload should not have a key")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+upload["id"].(string), "", nil)
+	assert.Equal(http.StatusOK, status, "Public file should be served without a key")
+
+	status, _ = doRequest(t, http.MethodPut, srv.URL+"/file.txt?private=maybe", "", "Hello, World!")
+	assert.Equal(http.StatusBadRequest, status, "Invalid private flag should be rejected")
+}
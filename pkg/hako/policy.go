@@ -0,0 +1,183 @@
+package hako
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// MimeLimit overrides the maximum file size and TTL for uploads whose mime type
+// matches Pattern. A zero MaxFileSize or MaxTTL falls back to the global limit.
+type MimeLimit struct {
+	Pattern     string
+	MaxFileSize int64
+	MaxTTL      time.Duration
+}
+
+// String formats the limit in the form accepted by ParseMimeLimits.
+func (l MimeLimit) String() string {
+	s := l.Pattern + "="
+	if l.MaxTTL != 0 {
+		s += FormatExpiry(l.MaxTTL)
+	}
+	if l.MaxFileSize != 0 {
+		s += ":" + strconv.FormatInt(l.MaxFileSize, 10)
+	}
+	return s
+}
+
+// ParseMimeLimits parses a comma-separated list of per-mime limits in the form
+// `pattern=ttl[:size]`, e.g. `image/*=7d:50000000,*=24h`.
+func ParseMimeLimits(s string) ([]MimeLimit, error) {
+	var limits []MimeLimit
+	for _, entry := range splitList(s) {
+		pattern, spec, ok := strings.Cut(entry, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid mime limit %q", entry)
+		}
+
+		limit := MimeLimit{Pattern: strings.TrimSpace(pattern)}
+		ttl, size, _ := strings.Cut(spec, ":")
+		if ttl != "" {
+			dur, err := ParseExpiry(ttl)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ttl in mime limit %q: %v", entry, err)
+			}
+			limit.MaxTTL = dur
+		}
+		if size != "" {
+			n, err := strconv.ParseInt(size, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size in mime limit %q: %v", entry, err)
+			}
+			limit.MaxFileSize = n
+		}
+
+		limits = append(limits, limit)
+	}
+
+	return limits, nil
+}
+
+// MatchMime reports whether the detected mime type matches the pattern. The
+// pattern can be an exact type (`application/zip`), a family (`image/*`) or a
+// wildcard (`*`). Parents of the detected type are also considered, so that
+// denying `application/zip` also denies formats built on top of it such as
+// jar files, but the root `application/octet-stream` type is only matched when
+// it is the detected type itself.
+func MatchMime(pattern string, detected *mimetype.MIME) bool {
+	for m := detected; m != nil; m = m.Parent() {
+		if m != detected && m.Parent() == nil {
+			break
+		}
+		if matchMimeString(pattern, m.String()) || m.Is(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMimeString matches a single mime type string against the pattern.
+func matchMimeString(pattern, mimeType string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if parsed, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = parsed
+	}
+
+	if pattern == "*" || pattern == "*/*" {
+		return true
+	}
+	if family, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mimeType, family+"/")
+	}
+	return pattern == mimeType
+}
+
+// CheckMime checks the detected mime type, and the mime type declared by the
+// client if it is more specific than application/octet-stream, against the
+// configured allow and deny lists.
+func (c *Config) CheckMime(detected *mimetype.MIME, declared string) error {
+	candidates := []*mimetype.MIME{detected}
+	if declared, _, _ = mime.ParseMediaType(declared); declared != "" && declared != "application/octet-stream" {
+		if m := mimetype.Lookup(declared); m != nil {
+			candidates = append(candidates, m)
+		} else if !c.mimeAllowed(func(p string) bool { return matchMimeString(p, declared) }) {
+			return fmt.Errorf("file type %s is not allowed", declared)
+		}
+	}
+
+	for _, m := range candidates {
+		if !c.mimeAllowed(func(p string) bool { return MatchMime(p, m) }) {
+			return fmt.Errorf("file type %s is not allowed", m.String())
+		}
+	}
+
+	return nil
+}
+
+// mimeAllowed evaluates the allow and deny lists with the given matcher. The
+// deny list takes precedence, and an empty allow list allows everything.
+func (c *Config) mimeAllowed(match func(pattern string) bool) bool {
+	for _, pattern := range c.UploadDenyMime {
+		if match(pattern) {
+			return false
+		}
+	}
+
+	if len(c.UploadAllowMime) == 0 {
+		return true
+	}
+	for _, pattern := range c.UploadAllowMime {
+		if match(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// LimitsForMime returns the maximum file size and TTL for an upload of the
+// given mime type. The first matching entry in UploadMimeLimits wins.
+func (c *Config) LimitsForMime(detected *mimetype.MIME) (int64, time.Duration) {
+	maxSize, maxTTL := c.FsMaxFileSize, c.FsMaxTTL
+	for _, limit := range c.UploadMimeLimits {
+		if !MatchMime(limit.Pattern, detected) {
+			continue
+		}
+		if limit.MaxFileSize > 0 {
+			maxSize = limit.MaxFileSize
+		}
+		if limit.MaxTTL > 0 {
+			maxTTL = limit.MaxTTL
+		}
+		break
+	}
+	return maxSize, maxTTL
+}
+
+// LookupMime returns the known mime type for the given string, falling back to
+// application/octet-stream.
+func LookupMime(mimeType string) *mimetype.MIME {
+	if parsed, _, err := mime.ParseMediaType(mimeType); err == nil {
+		if m := mimetype.Lookup(parsed); m != nil {
+			return m
+		}
+	}
+	return mimetype.Lookup("application/octet-stream")
+}
+
+// SniffReader detects the mime type of the data in r and returns a reader that
+// yields the full data, including the bytes consumed for detection.
+func SniffReader(r io.Reader) (*mimetype.MIME, io.Reader, error) {
+	var head bytes.Buffer
+	detected, err := mimetype.DetectReader(io.TeeReader(r, &head))
+	if err != nil {
+		return nil, nil, err
+	}
+	return detected, io.MultiReader(&head, r), nil
+}
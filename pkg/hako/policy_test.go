@@ -0,0 +1,111 @@
+package hako_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00")
+	elfHeader = []byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00")
+	jarHeader = []byte("PK\x03\x04\x14\x00\x08\x08\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00META-INF/MANIFEST.MF")
+)
+
+func TestParseMimeLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	limits, err := hako.ParseMimeLimits("image/*=7d:50000000, video/*=:100, *=24h")
+	assert.Nil(err, "Failed to parse mime limits")
+	assert.Equal([]hako.MimeLimit{
+		{Pattern: "image/*", MaxFileSize: 50000000, MaxTTL: 7 * 24 * time.Hour},
+		{Pattern: "video/*", MaxFileSize: 100},
+		{Pattern: "*", MaxTTL: 24 * time.Hour},
+	}, limits, "Mime limits mismatch")
+
+	limits, err = hako.ParseMimeLimits("")
+	assert.Nil(err, "Failed to parse empty mime limits")
+	assert.Empty(limits, "Mime limits should be empty")
+
+	for _, invalid := range []string{"image/*", "=7d", "image/*=7x", "image/*=7d:big"} {
+		_, err = hako.ParseMimeLimits(invalid)
+		assert.Error(err, "Expected error parsing %q", invalid)
+	}
+}
+
+func TestMatchMime(t *testing.T) {
+	assert := assert.New(t)
+
+	png := mimetype.Detect(pngHeader)
+	jar := mimetype.Detect(jarHeader)
+	text := mimetype.Detect([]byte("hello world"))
+	unknown := mimetype.Detect([]byte{0x00, 0x01, 0x02})
+
+	assert.True(hako.MatchMime("image/png", png), "Exact type should match")
+	assert.True(hako.MatchMime("image/*", png), "Family should match")
+	assert.True(hako.MatchMime("*", png), "Wildcard should match")
+	assert.False(hako.MatchMime("image/jpeg", png), "Different type should not match")
+	assert.True(hako.MatchMime("application/zip", jar), "Parent type should match")
+	assert.False(hako.MatchMime("application/octet-stream", png), "Root type should not match children")
+	assert.True(hako.MatchMime("application/octet-stream", unknown), "Root type should match itself")
+	assert.True(hako.MatchMime("text/*", text), "Text family should match")
+}
+
+func TestConfigCheckMime(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &hako.Config{
+		UploadDenyMime: []string{"application/x-elf", "application/zip"},
+	}
+	assert.Nil(cfg.CheckMime(mimetype.Detect(pngHeader), ""), "PNG should be allowed")
+	assert.Error(cfg.CheckMime(mimetype.Detect(elfHeader), ""), "ELF should be denied")
+	assert.Error(cfg.CheckMime(mimetype.Detect(jarHeader), ""), "Jar should be denied as a zip")
+	assert.Error(cfg.CheckMime(mimetype.Detect(pngHeader), "application/zip"), "Declared zip should be denied")
+	assert.Nil(cfg.CheckMime(mimetype.Detect(pngHeader), "application/octet-stream"), "Generic declared type should be ignored")
+
+	cfg = &hako.Config{
+		UploadAllowMime: []string{"image/*"},
+	}
+	assert.Nil(cfg.CheckMime(mimetype.Detect(pngHeader), "image/png"), "PNG should be allowed")
+	assert.Error(cfg.CheckMime(mimetype.Detect(elfHeader), "image/png"), "ELF disguised as PNG should be denied")
+	assert.Error(cfg.CheckMime(mimetype.Detect([]byte("hello")), ""), "Text should not be allowed")
+}
+
+func TestConfigLimitsForMime(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &hako.Config{
+		FsMaxFileSize: 1000,
+		FsMaxTTL:      7 * 24 * time.Hour,
+		UploadMimeLimits: []hako.MimeLimit{
+			{Pattern: "image/*", MaxFileSize: 5000},
+			{Pattern: "*", MaxTTL: 24 * time.Hour},
+		},
+	}
+
+	size, ttl := cfg.LimitsForMime(mimetype.Detect(pngHeader))
+	assert.Equal(int64(5000), size, "Image size limit mismatch")
+	assert.Equal(7*24*time.Hour, ttl, "Image TTL should fall back to the global limit")
+
+	size, ttl = cfg.LimitsForMime(mimetype.Detect(elfHeader))
+	assert.Equal(int64(1000), size, "Size should fall back to the global limit")
+	assert.Equal(24*time.Hour, ttl, "Catch-all TTL mismatch")
+}
+
+func TestSniffReader(t *testing.T) {
+	assert := assert.New(t)
+
+	data := append(append([]byte{}, pngHeader...), bytes.Repeat([]byte{0xff}, 10000)...)
+	detected, r, err := hako.SniffReader(bytes.NewReader(data))
+	assert.Nil(err, "Failed to sniff reader")
+	assert.Equal("image/png", detected.String(), "Detected mime type mismatch")
+
+	got, err := io.ReadAll(r)
+	assert.Nil(err, "Failed to read sniffed reader")
+	assert.Equal(data, got, "Sniffed reader should yield the full data")
+}
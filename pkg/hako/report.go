@@ -0,0 +1,353 @@
+package hako
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// ReportReasons are the reasons a file can be reported for.
+var ReportReasons = []string{"illegal", "copyright", "malware", "phishing", "spam", "other"}
+
+// ReportRequest is the body of a report, sent as JSON or as a form.
+type ReportRequest struct {
+	Reason  string `json:"reason" form:"reason"`
+	Message string `json:"message" form:"message"`
+
+	// Contact is how the reporter can be reached, such as an email address.
+	Contact string `json:"contact" form:"contact"`
+}
+
+const (
+	maxReportBody    = 64 << 10
+	maxReportMessage = 4000
+	maxReportContact = 320
+)
+
+// reportForm serves the form to report a file.
+func (s *Server) reportForm(c *gin.Context) {
+	if _, ok := s.findFile(c, c.Param("id")); !ok {
+		return
+	}
+	c.FileFromFS("web/report/", http.FS(webContent))
+}
+
+// reportFile records a report on a live file, for admins to review. Each IP
+// address can only have one open report on a file.
+func (s *Server) reportFile(c *gin.Context) {
+	ctx := c.Request.Context()
+	file, ok := s.findFile(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	// Accept reports from plain HTML forms as well as JSON
+	var req ReportRequest
+	var err error
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxReportBody)
+	if c.ContentType() == binding.MIMEPOSTForm {
+		err = c.ShouldBindWith(&req, binding.Form)
+	} else {
+		err = c.ShouldBindJSON(&req)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parsing request: %s", err)})
+		return
+	}
+	if !slices.Contains(ReportReasons, req.Reason) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid reason, must be one of %v", ReportReasons)})
+		return
+	}
+	if len(req.Message) > maxReportMessage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("message too long (max %d bytes)", maxReportMessage)})
+		return
+	}
+	if len(req.Contact) > maxReportContact {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("contact too long (max %d bytes)", maxReportContact)})
+		return
+	}
+
+	id, err := s.db.InsertReport(ctx, &DbReport{
+		FileID:    file.ID,
+		Reason:    req.Reason,
+		Message:   req.Message,
+		Contact:   req.Contact,
+		IPAddress: c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if id == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "You have already reported this file"})
+		return
+	}
+
+	RequestLogger(c).Info("File reported", "report_id", id, "reason", req.Reason)
+	s.events.Publish(EventFileReported, file)
+	c.JSON(http.StatusCreated, gin.H{"id": id})
+}
+
+// checkBlocked writes an error response and returns false if the contents
+// with the given hash have been taken down.
+func (s *Server) checkBlocked(c *gin.Context, sha256 string) bool {
+	blocked, err := s.db.IsHashBlocked(c.Request.Context(), sha256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if blocked {
+		RequestLogger(c).Info("Rejecting blocked contents", "sha256", sha256)
+		c.JSON(http.StatusUnavailableForLegalReasons, gin.H{"error": "These contents have been taken down"})
+		return false
+	}
+	return true
+}
+
+// AdminTakedownRequest is the body of a takedown in the admin API.
+type AdminTakedownRequest struct {
+	// Sha256 is the hash of the contents to take down, when blocking them
+	// directly rather than through a file.
+	Sha256 string `json:"sha256"`
+
+	// DHash is the perceptual hash of an image to block instead, along with
+	// images that look like it. Stored images are not taken down.
+	DHash string `json:"dhash"`
+
+	// Reason is recorded in the blocklist.
+	Reason string `json:"reason"`
+}
+
+// takeDown blocks the contents with the given hash from being uploaded
+// again, removes every file that shares them along with the given file, and
+// resolves the open reports on those files. Files uploaded before hashes were
+// recorded cannot be blocked, so only the given file is removed. The result is
+// written as the response.
+func (s *Server) takeDown(c *gin.Context, sha256, reason string, file *DbFile) {
+	ctx := c.Request.Context()
+	var files []*DbFile
+	if sha256 != "" {
+		if _, err := s.db.BlockHash(ctx, sha256, reason); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var err error
+		if files, err = s.db.ListFilesBySha256(ctx, sha256); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	} else if !file.Removed {
+		files = []*DbFile{file}
+	}
+
+	var ids []int64
+	if file != nil {
+		ids = append(ids, file.ID)
+	}
+	for _, f := range files {
+		if !s.removeFile(c, f) {
+			return
+		}
+		ids = append(ids, f.ID)
+	}
+
+	resolved, err := s.db.ResolveReports(ctx, ids, ReportTakenDown)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	RequestLogger(c).Info("Took down contents", "sha256", sha256, "reason", reason, "removed", len(files), "reports", resolved)
+	c.JSON(http.StatusOK, gin.H{"sha256": sha256, "removed": len(files), "reports": resolved})
+}
+
+// adminTakeDownFile takes down a file, including a removed one, along with
+// every other file that shares its contents.
+func (s *Server) adminTakeDownFile(c *gin.Context) {
+	file, ok := s.adminFindFile(c)
+	if !ok {
+		return
+	}
+
+	var req AdminTakedownRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parsing request: %s", err)})
+			return
+		}
+	}
+
+	s.takeDown(c, file.Sha256, req.Reason, file)
+}
+
+// adminBlockHash takes down contents by hash, whether or not they are stored,
+// or blocks images by perceptual hash.
+func (s *Server) adminBlockHash(c *gin.Context) {
+	var req AdminTakedownRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parsing request: %s", err)})
+		return
+	}
+
+	if req.DHash != "" {
+		dhash, ok := ParseDHash(strings.ToLower(req.DHash))
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dhash"})
+			return
+		}
+		if _, err := s.db.BlockImageHash(c.Request.Context(), dhash, req.Reason); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		RequestLogger(c).Info("Blocked image hash", "dhash", FormatDHash(dhash), "reason", req.Reason)
+		c.JSON(http.StatusOK, gin.H{"dhash": FormatDHash(dhash)})
+		return
+	}
+
+	hash, ok := parseSha256(req.Sha256)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid sha256"})
+		return
+	}
+
+	s.takeDown(c, hash, req.Reason, nil)
+}
+
+// adminListBlockedHashes returns the blocklist.
+func (s *Server) adminListBlockedHashes(c *gin.Context) {
+	ctx := c.Request.Context()
+	hashes, err := s.db.ListBlockedHashes(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	imageHashes, err := s.db.ListBlockedImageHashes(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := make([]gin.H, len(hashes))
+	for i, hash := range hashes {
+		result[i] = gin.H{"sha256": hash.Sha256, "reason": hash.Reason, "created_at": hash.CreatedAt}
+	}
+	imageResult := make([]gin.H, len(imageHashes))
+	for i, hash := range imageHashes {
+		imageResult[i] = gin.H{"dhash": FormatDHash(hash.DHash), "reason": hash.Reason, "created_at": hash.CreatedAt}
+	}
+	c.JSON(http.StatusOK, gin.H{"hashes": result, "image_hashes": imageResult})
+}
+
+// adminUnblockHash lets contents, given by SHA-256 or perceptual hash, be
+// uploaded again. Files that were taken down stay removed.
+func (s *Server) adminUnblockHash(c *gin.Context) {
+	ctx := c.Request.Context()
+	var unblocked bool
+	var err error
+	param := strings.ToLower(c.Param("hash"))
+	if hash, ok := parseSha256(param); ok {
+		unblocked, err = s.db.UnblockHash(ctx, hash)
+	} else if dhash, ok := ParseDHash(param); ok {
+		unblocked, err = s.db.UnblockImageHash(ctx, dhash)
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid hash"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !unblocked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Hash is not blocked"})
+		return
+	}
+
+	RequestLogger(c).Info("Unblocked contents", "hash", param)
+	c.Status(http.StatusNoContent)
+}
+
+// reportInfo returns the representation of a report in the admin API, along
+// with the reported file. The file is identified by its ID in the admin API,
+// and by the ID it is linked by, if it can still be found.
+func (s *Server) reportInfo(c *gin.Context, report *DbReport) gin.H {
+	info := gin.H{
+		"id":         report.ID,
+		"file_id":    strconv.FormatInt(report.FileID, 36),
+		"reason":     report.Reason,
+		"message":    report.Message,
+		"contact":    report.Contact,
+		"ip_address": report.IPAddress,
+		"user_agent": report.UserAgent,
+		"created_at": report.CreatedAt,
+		"status":     report.Status,
+	}
+	if !report.ResolvedAt.IsZero() {
+		info["resolved_at"] = report.ResolvedAt
+	}
+	if file, err := s.db.GetFile(c.Request.Context(), report.FileID); err == nil {
+		info["public_id"] = file.PublicID()
+		info["file"] = file.AdminInfo()
+	}
+	return info
+}
+
+// adminListReports lists the reports with the given ?status=, open by
+// default.
+func (s *Server) adminListReports(c *gin.Context) {
+	limit, ok := queryInt(c, "limit", 50, 500)
+	if !ok {
+		return
+	}
+	offset, ok := queryInt(c, "offset", 0, 1<<30)
+	if !ok {
+		return
+	}
+	status := ReportStatus(c.DefaultQuery("status", string(ReportOpen)))
+
+	reports, total, err := s.db.ListReports(c.Request.Context(), status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	infos := make([]gin.H, len(reports))
+	for i, report := range reports {
+		infos[i] = s.reportInfo(c, report)
+	}
+	c.JSON(http.StatusOK, gin.H{"reports": infos, "total": total})
+}
+
+// adminDismissReport resolves an open report without taking down the file.
+func (s *Server) adminDismissReport(c *gin.Context) {
+	ctx := c.Request.Context()
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid report ID"})
+		return
+	}
+
+	dismissed, err := s.db.ResolveReport(ctx, id, ReportDismissed)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	report, err := s.db.GetReport(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return
+	}
+	if !dismissed {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Report is %s", report.Status)})
+		return
+	}
+
+	RequestLogger(c).Info("Dismissed report", "report_id", id, "file_id", report.FileID)
+	c.JSON(http.StatusOK, s.reportInfo(c, report))
+}
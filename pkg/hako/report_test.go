@@ -0,0 +1,165 @@
+package hako_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerReportFile(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, AdminToken: "admin-token"}
+	srv, _, _ := newTestServer(t, cfg)
+
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt?slug=reported-file", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	id := upload["id"].(string)
+
+	// The form is served for live files only
+	res, err := http.Get(srv.URL + "/" + id + "/report")
+	assert.Nil(err, "Failed to get report form")
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode, "Report form should be served")
+	assert.Contains(res.Header.Get("Content-Type"), "text/html", "Report form should be HTML")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/zzzzzz/report", "", nil)
+	assert.Equal(http.StatusNotFound, status, "Report form should not be served for missing files")
+
+	status, _ = doRequest(t, http.MethodPost, srv.URL+"/"+id+"/report", "", map[string]any{"reason": "boring"})
+	assert.Equal(http.StatusBadRequest, status, "Unknown reasons should be rejected")
+
+	status, report := doRequest(t, http.MethodPost, srv.URL+"/"+id+"/report", "", map[string]any{
+		"reason":  "copyright",
+		"message": "This is my file",
+		"contact": "owner@example.com",
+	})
+	assert.Equal(http.StatusCreated, status, "Report should be accepted")
+	assert.NotNil(report["id"], "Report ID should be returned")
+
+	// Reports can be sent from a plain form, but only once per file
+	res, err = http.PostForm(srv.URL+"/"+id+"/report", url.Values{"reason": {"spam"}})
+	assert.Nil(err, "Failed to send report")
+	res.Body.Close()
+	assert.Equal(http.StatusConflict, res.StatusCode, "Duplicate report should be rejected")
+
+	// Admins review open reports, oldest first
+	status, res2 := doRequest(t, http.MethodGet, srv.URL+"/admin/api/reports", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Listing reports should succeed")
+	assert.Equal(float64(1), res2["total"], "Open report should be counted")
+	listed := res2["reports"].([]any)[0].(map[string]any)
+	assert.Equal(id, listed["public_id"], "Report should link to the file")
+	assert.Equal("copyright", listed["reason"], "Reason mismatch")
+	assert.Equal("owner@example.com", listed["contact"], "Contact mismatch")
+	assert.Equal("127.0.0.1", listed["ip_address"], "Reporter IP address should be recorded")
+	assert.Equal("file.txt", listed["file"].(map[string]any)["filename"], "Reported file should be included")
+
+	reportURL := fmt.Sprintf("%s/admin/api/reports/%d", srv.URL, int64(report["id"].(float64)))
+	status, dismissed := doRequest(t, http.MethodPost, reportURL+"/dismiss", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Dismissing a report should succeed")
+	assert.Equal("dismissed", dismissed["status"], "Report should be dismissed")
+	assert.NotEmpty(dismissed["resolved_at"], "Resolution time should be recorded")
+	status, _ = doRequest(t, http.MethodPost, reportURL+"/dismiss", "admin-token", nil)
+	assert.Equal(http.StatusConflict, status, "Dismissing a report twice should fail")
+
+	status, res2 = doRequest(t, http.MethodGet, srv.URL+"/admin/api/reports?status=dismissed", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Listing reports should succeed")
+	assert.Equal(float64(1), res2["total"], "Dismissed report should be listed")
+
+	// The file is still served, and can be reported again
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+id, "", nil)
+	assert.Equal(http.StatusOK, status, "File should still be served")
+	status, _ = doRequest(t, http.MethodPost, srv.URL+"/"+id+"/report", "", map[string]any{"reason": "spam"})
+	assert.Equal(http.StatusCreated, status, "File should be reported again")
+
+	// The listed file ID can be used to take the file down, as the dashboard
+	// does
+	status, res2 = doRequest(t, http.MethodGet, srv.URL+"/admin/api/reports", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Listing reports should succeed")
+	listed = res2["reports"].([]any)[0].(map[string]any)
+	status, _ = doRequest(t, http.MethodPost, srv.URL+"/admin/api/files/"+listed["file_id"].(string)+"/takedown", "admin-token",
+		map[string]any{"reason": "spam"})
+	assert.Equal(http.StatusOK, status, "Takedown by the listed file ID should succeed")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+id, "", nil)
+	assert.Equal(http.StatusUnavailableForLegalReasons, status, "Taken down file should be unavailable")
+}
+
+func TestServerTakedown(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, AdminToken: "admin-token"}
+	srv, _, _ := newTestServer(t, cfg)
+
+	var ids []string
+	for _, name := range []string{"first.txt", "copy.txt", "other.txt"} {
+		contents := "Hello, World!"
+		if name == "other.txt" {
+			contents = "Something else"
+		}
+		status, upload := doRequest(t, http.MethodPut, srv.URL+"/"+name, "", contents)
+		assert.Equal(http.StatusOK, status, "Upload should succeed")
+		ids = append(ids, upload["id"].(string))
+	}
+
+	status, _ := doRequest(t, http.MethodPost, srv.URL+"/"+ids[1]+"/report", "", map[string]any{"reason": "illegal"})
+	assert.Equal(http.StatusCreated, status, "Report should be accepted")
+
+	// Taking down a file removes every copy of it and resolves their reports
+	status, res := doRequest(t, http.MethodPost, srv.URL+"/admin/api/files/"+ids[0]+"/takedown", "admin-token",
+		map[string]any{"reason": "court order"})
+	assert.Equal(http.StatusOK, status, "Takedown should succeed")
+	assert.Equal(float64(2), res["removed"], "Both copies should be removed")
+	assert.Equal(float64(1), res["reports"], "Report on the copy should be resolved")
+	assert.Equal(sha256Hex("Hello, World!"), res["sha256"], "Contents hash mismatch")
+
+	for _, id := range ids[:2] {
+		status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+id, "", nil)
+		assert.Equal(http.StatusUnavailableForLegalReasons, status, "Taken down file should be unavailable")
+	}
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+ids[2], "", nil)
+	assert.Equal(http.StatusOK, status, "Other files should be served")
+
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/admin/api/reports?status=taken_down", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Listing reports should succeed")
+	assert.Equal(float64(1), res["total"], "Report should be resolved as taken down")
+
+	// The contents cannot be uploaded again, with or without the hash
+	status, _ = doRequest(t, http.MethodPut, srv.URL+"/again.txt", "", "Hello, World!")
+	assert.Equal(http.StatusUnavailableForLegalReasons, status, "Blocked contents should be rejected")
+	status, _, sent := putWithHash(t, srv.URL+"/again.txt", sha256Hex("Hello, World!"), "", "Hello, World!")
+	assert.Equal(http.StatusUnavailableForLegalReasons, status, "Blocked hash should be rejected")
+	assert.False(sent, "Blocked contents should not be sent")
+	res2, err := http.Head(srv.URL + "/blob/sha256:" + sha256Hex("Hello, World!"))
+	assert.Nil(err, "Failed to check blob")
+	res2.Body.Close()
+	assert.Equal(http.StatusUnavailableForLegalReasons, res2.StatusCode, "Blocked blob should be unavailable")
+
+	status, res = doRequest(t, http.MethodGet, srv.URL+"/admin/api/blocklist", "admin-token", nil)
+	assert.Equal(http.StatusOK, status, "Listing the blocklist should succeed")
+	blocked := res["hashes"].([]any)[0].(map[string]any)
+	assert.Equal(sha256Hex("Hello, World!"), blocked["sha256"], "Hash should be blocked")
+	assert.Equal("court order", blocked["reason"], "Reason should be recorded")
+
+	// Contents can also be blocked by hash
+	status, res = doRequest(t, http.MethodPost, srv.URL+"/admin/api/blocklist", "admin-token",
+		map[string]any{"sha256": strings.ToUpper(sha256Hex("Something else"))})
+	assert.Equal(http.StatusOK, status, "Blocking a hash should succeed")
+	assert.Equal(float64(1), res["removed"], "Files with the hash should be removed")
+	status, _ = doRequest(t, http.MethodPost, srv.URL+"/admin/api/blocklist", "admin-token", map[string]any{"sha256": "nope"})
+	assert.Equal(http.StatusBadRequest, status, "Invalid hashes should be rejected")
+
+	// Unblocked contents can be uploaded again, but taken down files stay gone
+	status, _ = doRequest(t, http.MethodDelete, srv.URL+"/admin/api/blocklist/"+sha256Hex("Hello, World!"), "admin-token", nil)
+	assert.Equal(http.StatusNoContent, status, "Unblocking should succeed")
+	status, _ = doRequest(t, http.MethodDelete, srv.URL+"/admin/api/blocklist/"+sha256Hex("Hello, World!"), "admin-token", nil)
+	assert.Equal(http.StatusNotFound, status, "Unblocking twice should fail")
+	status, _ = doRequest(t, http.MethodPut, srv.URL+"/again.txt", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Unblocked contents should be accepted")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+ids[0], "", nil)
+	assert.Equal(http.StatusNotFound, status, "Taken down file should stay removed")
+}
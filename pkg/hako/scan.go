@@ -0,0 +1,279 @@
+package hako
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"go.uber.org/fx"
+)
+
+// ScanResult is the outcome of scanning a file.
+type ScanResult struct {
+	Infected bool
+
+	// Signature is the name of the detected threat, if any.
+	Signature string
+}
+
+type Scanner interface {
+	// Scan reads data until EOF and reports whether it is infected.
+	Scan(ctx context.Context, data io.Reader) (ScanResult, error)
+}
+
+// ClamdScanner is a Scanner that streams files to a clamd daemon using the
+// INSTREAM command.
+type ClamdScanner struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+// clamdChunkSize is the size of the chunks sent to clamd. It must be smaller
+// than the StreamMaxLength setting of the daemon.
+const clamdChunkSize = 64 * 1024
+
+// NewClamdScanner creates a ClamdScanner for the given address, which can be
+// either `unix:/path/to/clamd.sock` or `host:port`.
+func NewClamdScanner(addr string) *ClamdScanner {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+	}
+
+	return &ClamdScanner{Network: network, Address: addr, Timeout: 5 * time.Minute}
+}
+
+// Scan implements Scanner.
+func (s *ClamdScanner) Scan(ctx context.Context, data io.Reader) (ScanResult, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, fmt.Errorf("failed to send command: %w", err)
+	}
+
+	// Stream the data as length-prefixed chunks, terminated by an empty chunk
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(data, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return ScanResult{}, fmt.Errorf("failed to send chunk: %w", werr)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return ScanResult{}, fmt.Errorf("failed to read data: %w", err)
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanResult{}, fmt.Errorf("failed to end stream: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return ScanResult{}, fmt.Errorf("failed to read reply: %w", err)
+	}
+
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply parses a reply such as `stream: OK` or
+// `stream: Eicar-Signature FOUND`.
+func parseClamdReply(reply string) (ScanResult, error) {
+	_, status, ok := strings.Cut(reply, ": ")
+	if !ok {
+		return ScanResult{}, fmt.Errorf("unexpected reply from clamd: %q", reply)
+	}
+
+	switch {
+	case status == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd error: %s", status)
+	}
+}
+
+// ScanQueue scans uploaded files in the background and records the result in
+// the database.
+type ScanQueue struct {
+	db      *DB
+	fs      FS
+	scanner Scanner
+	queue   chan int64
+	done    chan struct{}
+
+	Logger *slog.Logger
+}
+
+// NewScanQueue creates a new ScanQueue. The scanner can be nil, in which case
+// scanning is disabled.
+func NewScanQueue(db *DB, fs FS, scanner Scanner) *ScanQueue {
+	return &ScanQueue{
+		db:      db,
+		fs:      fs,
+		scanner: scanner,
+		queue:   make(chan int64, 1024),
+		done:    make(chan struct{}),
+		Logger:  slog.Default().With("component", "scan"),
+	}
+}
+
+// Enabled returns whether files need to be scanned before they are served.
+func (q *ScanQueue) Enabled() bool {
+	return q.scanner != nil
+}
+
+// Enqueue schedules the file with the given ID for scanning. If the queue is
+// full, the file will be picked up by the next periodic sweep instead.
+func (q *ScanQueue) Enqueue(id int64) {
+	select {
+	case q.queue <- id:
+	default:
+	}
+}
+
+// LoopForever processes the scan queue, and periodically re-queues files that
+// are still pending, such as those left over from a restart or a failed scan.
+func (q *ScanQueue) LoopForever(ctx context.Context) {
+	q.Logger.Info("Start")
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	q.enqueuePending(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			q.Logger.Info("Stop")
+			close(q.done)
+			return
+		case id := <-q.queue:
+			if err := q.ScanFile(ctx, id); err != nil {
+				q.Logger.Error("Failed to scan file", "file_id", id, "error", err)
+			}
+		case <-ticker.C:
+			q.enqueuePending(ctx)
+		}
+	}
+}
+
+func (q *ScanQueue) enqueuePending(ctx context.Context) {
+	ids, err := q.db.ListPendingScans(ctx)
+	if err != nil {
+		q.Logger.Error("Failed to list pending scans", "error", err)
+		return
+	}
+	for _, id := range ids {
+		q.Enqueue(id)
+	}
+}
+
+// ReleasePending marks the files left waiting for a scan as clean, when
+// scanning has been turned off since they were uploaded. Otherwise, they could
+// never be downloaded.
+func (q *ScanQueue) ReleasePending(ctx context.Context) error {
+	n, err := q.db.ReleasePendingScans(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		q.Logger.Warn("Scanning is disabled, serving files that were waiting to be scanned without a scan", "files", n)
+	}
+	return nil
+}
+
+// ScanFile scans a single pending file and updates its scan status.
+func (q *ScanQueue) ScanFile(ctx context.Context, id int64) error {
+	file, err := q.db.GetFile(ctx, id)
+	if err != nil {
+		return err
+	}
+	if file.ScanStatus != ScanPending {
+		return nil
+	}
+
+	data, err := readFileTraced(ctx, q.fs, file.FilePath)
+	if err != nil {
+		return err
+	}
+	if closer, ok := data.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	result, err := q.scanner.Scan(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	status := ScanClean
+	if result.Infected {
+		status = ScanInfected
+		q.Logger.Warn("File is infected", "file_id", file.ID, "path", file.FilePath, "signature", result.Signature)
+	}
+
+	return q.db.SetScanStatus(ctx, file.FilePath, status)
+}
+
+// Done returns a channel that will be closed when the scan loop is done.
+func (q *ScanQueue) Done() <-chan struct{} {
+	return q.done
+}
+
+// FxNewScanQueue creates a new ScanQueue instance for Fx. Scanning is enabled
+// when a clamd address is configured. Otherwise, files that are still waiting
+// to be scanned are released on startup.
+func FxNewScanQueue(cfg *Config, db *DB, fs FS, logger *slog.Logger, lc fx.Lifecycle) *ScanQueue {
+	var scanner Scanner
+	if cfg.ScannerClamdAddr != "" {
+		scanner = NewClamdScanner(cfg.ScannerClamdAddr)
+	}
+
+	q := NewScanQueue(db, fs, scanner)
+	q.Logger = logger.With("component", "scan")
+	if !q.Enabled() {
+		lc.Append(fx.Hook{
+			OnStart: func(ctx context.Context) error {
+				if err := q.ReleasePending(ctx); err != nil {
+					q.Logger.Error("Failed to release pending scans", "error", err)
+				}
+				return nil
+			},
+		})
+		return q
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go q.LoopForever(ctx)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			<-q.Done()
+			return nil
+		},
+	})
+
+	return q
+}
@@ -0,0 +1,181 @@
+package hako_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd serves the clamd INSTREAM protocol on the listener, flagging any
+// stream that contains the EICAR test string.
+func fakeClamd(t *testing.T, l net.Listener) {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+						return
+					}
+				}
+
+				if bytes.Contains(data.Bytes(), []byte(eicar)) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+}
+
+func TestClamdScanner(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err, "Failed to listen on TCP")
+	fakeClamd(t, tcp)
+
+	sock := filepath.Join(t.TempDir(), "clamd.sock")
+	unix, err := net.Listen("unix", sock)
+	assert.Nil(err, "Failed to listen on unix socket")
+	fakeClamd(t, unix)
+
+	for _, addr := range []string{tcp.Addr().String(), "unix:" + sock} {
+		scanner := hako.NewClamdScanner(addr)
+
+		// Large clean file spanning multiple chunks
+		result, err := scanner.Scan(ctx, bytes.NewReader(bytes.Repeat([]byte("a"), 200*1024)))
+		assert.Nil(err, "Failed to scan clean file via %s", addr)
+		assert.False(result.Infected, "Clean file should not be infected")
+
+		result, err = scanner.Scan(ctx, bytes.NewReader([]byte(eicar)))
+		assert.Nil(err, "Failed to scan infected file via %s", addr)
+		assert.True(result.Infected, "EICAR file should be infected")
+		assert.Equal("Eicar-Test-Signature", result.Signature, "Signature mismatch")
+	}
+
+	// Unreachable daemon
+	_, err = hako.NewClamdScanner("unix:"+filepath.Join(t.TempDir(), "missing.sock")).Scan(ctx, bytes.NewReader(nil))
+	assert.Error(err, "Expected error scanning with an unreachable daemon")
+}
+
+func TestScanQueue(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	fs, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err, "Failed to listen on TCP")
+	fakeClamd(t, l)
+
+	queue := hako.NewScanQueue(db, fs, hako.NewClamdScanner(l.Addr().String()))
+	assert.True(queue.Enabled(), "Queue should be enabled with a scanner")
+	assert.False(hako.NewScanQueue(db, fs, nil).Enabled(), "Queue should be disabled without a scanner")
+
+	upload := func(data string) int64 {
+		blob, err := fs.WriteFile(bytes.NewReader([]byte(data)))
+		assert.Nil(err, "Failed to write file")
+		id, err := db.InsertFile(ctx, &hako.DbFile{
+			FilePath:   blob.Path,
+			ExpiresAt:  time.Now().Add(1 * time.Hour),
+			ScanStatus: hako.ScanPending,
+		})
+		assert.Nil(err, "Failed to create file")
+		return id
+	}
+
+	cleanId := upload("Hello, World!")
+	infectedId := upload(eicar)
+
+	pending, err := db.ListPendingScans(ctx)
+	assert.Nil(err, "Failed to list pending scans")
+	assert.ElementsMatch([]int64{cleanId, infectedId}, pending, "Pending scans mismatch")
+
+	assert.Nil(queue.ScanFile(ctx, cleanId), "Failed to scan clean file")
+	assert.Nil(queue.ScanFile(ctx, infectedId), "Failed to scan infected file")
+
+	file, err := db.GetFile(ctx, cleanId)
+	assert.Nil(err, "Failed to get file")
+	assert.Equal(hako.ScanClean, file.ScanStatus, "File should be clean")
+
+	file, err = db.GetFile(ctx, infectedId)
+	assert.Nil(err, "Failed to get file")
+	assert.Equal(hako.ScanInfected, file.ScanStatus, "File should be infected")
+
+	pending, err = db.ListPendingScans(ctx)
+	assert.Nil(err, "Failed to list pending scans")
+	assert.Empty(pending, "No scans should be pending")
+
+	// Infected files are garbage collected even before they expire
+	removed, err := hako.NewGC(db, fs, hako.NewEvents()).RunGC(ctx)
+	assert.Nil(err, "Failed to run GC")
+	assert.Equal(1, removed, "Infected file should be removed")
+}
+
+func TestScanQueueReleasePending(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	fs, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+
+	id, err := db.InsertFile(ctx, &hako.DbFile{
+		FilePath:   "/path/to/file",
+		ExpiresAt:  time.Now().Add(1 * time.Hour),
+		ScanStatus: hako.ScanPending,
+	})
+	assert.Nil(err, "Failed to create file")
+
+	// Files left pending when scanning is turned off are released
+	assert.Nil(hako.NewScanQueue(db, fs, nil).ReleasePending(ctx), "Failed to release pending scans")
+	file, err := db.GetFile(ctx, id)
+	assert.Nil(err, "Failed to get file")
+	assert.Equal(hako.ScanClean, file.ScanStatus, "Pending file should be released")
+
+	pending, err := db.ListPendingScans(ctx)
+	assert.Nil(err, "Failed to list pending scans")
+	assert.Empty(pending, "No scans should be pending")
+}
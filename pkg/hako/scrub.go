@@ -0,0 +1,98 @@
+package hako
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DefaultScrubInterval is how often the contents of each file are re-hashed
+// to detect corruption, unless configured otherwise.
+const DefaultScrubInterval = 7 * 24 * time.Hour
+
+// Scrub re-hashes up to ScrubBatchSize stored contents that have not been
+// checked within the configured ScrubInterval, and flags the files whose
+// contents no longer match their hash as corrupt, so that they are no longer
+// served. It returns the number of contents checked and found corrupt.
+func (g *GC) Scrub(ctx context.Context) (checked, corrupt int, err error) {
+	ctx, span := tracer.Start(ctx, "GC.Scrub")
+	defer func() {
+		span.SetAttributes(attribute.Int("hako.checked", checked), attribute.Int("hako.corrupt", corrupt))
+		endSpan(span, err)
+	}()
+
+	if g.Config == nil {
+		return 0, 0, nil
+	}
+	interval := g.Config.Load().ScrubInterval
+	if interval <= 0 {
+		return 0, 0, nil
+	}
+
+	targets, err := g.db.ListScrubDue(ctx, time.Now().Add(-interval), g.ScrubBatchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, target := range targets {
+		// Check if the context is cancelled
+		select {
+		case <-ctx.Done():
+			return checked, corrupt, nil
+		default:
+		}
+
+		ok, err := g.verify(ctx, target)
+		if err != nil {
+			g.Logger.Error("Failed to verify file contents", "path", target.FilePath, "error", err)
+			continue
+		}
+		checked++
+
+		if !ok {
+			corrupt++
+			g.Logger.Warn("File contents do not match their hash, quarantining", "path", target.FilePath, "sha256", target.Sha256)
+			if err := g.db.SetScanStatus(ctx, target.FilePath, ScanCorrupt); err != nil {
+				g.Logger.Error("Failed to quarantine file contents", "path", target.FilePath, "error", err)
+				continue
+			}
+		}
+
+		if err := g.db.MarkScrubbed(ctx, target.FilePath, time.Now()); err != nil {
+			g.Logger.Error("Failed to mark file contents scrubbed", "path", target.FilePath, "error", err)
+		}
+	}
+
+	return checked, corrupt, nil
+}
+
+// verify reports whether the stored contents still match their hash. Missing
+// contents count as not matching.
+func (g *GC) verify(ctx context.Context, target ScrubTarget) (bool, error) {
+	data, err := readFileTraced(ctx, g.fs, target.FilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if closer, ok := data.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, data); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)) == target.Sha256, nil
+}
@@ -2,15 +2,20 @@ package hako
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
-	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gabriel-vasile/mimetype"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/fx"
 )
@@ -20,168 +25,519 @@ var webContent embed.FS
 
 type Server struct {
 	router *gin.Engine
-	config *Config
+	db     *DB
+	fs     FS
+	config *LiveConfig
+	scans  *ScanQueue
+	events *Events
 	done   chan struct{}
+
+	// Logger is used for the access log and server errors. Request handlers
+	// should log with RequestLogger instead, which includes the request ID.
+	Logger *slog.Logger
+
+	// GC is checked by /livez, if set.
+	GC *GC
+
+	// FSProbeInterval is how long the result of writing a probe file for
+	// /readyz is reused for, and fsProbeAt and fsProbeErr the last result.
+	FSProbeInterval time.Duration
+	fsProbeMu       sync.Mutex
+	fsProbeAt       time.Time
+	fsProbeErr      error
+
+	// listener and redirectListener are bound by Listen, and tlsConfig is
+	// set when serving HTTPS with the certificate from certs.
+	listener         net.Listener
+	redirectListener net.Listener
+	tlsConfig        *tls.Config
+	certs            *CertReloader
+
+	// draining is set once the server starts shutting down, and inflight
+	// tracks the requests that are still being handled.
+	draining atomic.Bool
+	inflight sync.WaitGroup
+
+	// streams is cancelled when the server shuts down, to end long-lived
+	// event streams that would otherwise hold up the shutdown.
+	streams     context.Context
+	stopStreams context.CancelFunc
 }
 
-func NewServer(db *DB, fs FS, cfg *Config) *Server {
-	r := gin.Default()
+func NewServer(db *DB, fs FS, cfg *LiveConfig, scans *ScanQueue, events *Events) *Server {
+	r := gin.New()
+	// Client addresses are resolved by resolveClientIP instead, which follows
+	// configuration reloads
+	if err := r.SetTrustedProxies(nil); err != nil {
+		panic(err)
+	}
+	s := &Server{router: r, db: db, fs: fs, config: cfg, scans: scans, events: events, done: make(chan struct{})}
+	s.Logger = slog.Default().With("component", "http")
+	s.FSProbeInterval = 5 * time.Second
+	s.streams, s.stopStreams = context.WithCancel(context.Background())
+
+	// Health checks are registered before the middleware, so that probes are
+	// not traced or logged
+	r.GET("/healthz", s.healthz)
+	r.GET("/livez", s.livez)
+	r.GET("/readyz", s.readyz)
+
+	// Trace and log every request, and recover from panics in handlers
+	r.Use(s.resolveClientIP)
+	r.Use(s.trackInflight)
+	r.Use(s.traceRequests)
+	r.Use(s.accessLog)
+	r.Use(gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		RequestLogger(c).Error("Panic while handling request", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
+	r.Use(s.strictTransportSecurity)
+
+	// Keep out banned clients, and restrict each group of routes to the
+	// clients allowed to use it
+	r.Use(s.allowIPs(func(cfg *Config) IPRules { return IPRules{Deny: cfg.DenyIPs} }))
+	uploaders := s.allowIPs(func(cfg *Config) IPRules { return cfg.UploadIPs })
+	downloaders := s.allowIPs(func(cfg *Config) IPRules { return cfg.DownloadIPs })
+	admins := s.allowIPs(func(cfg *Config) IPRules { return cfg.AdminIPs })
+
+	// Stream file events and upload progress
+	r.GET("/events", downloaders, s.streamEvents)
 
 	// Handle file uploads via PUT
-	r.PUT("/:name", func(c *gin.Context) {
-		// Get expiry from the query string, if it exists
-		expiry := c.Query("expiry")
-		if expiry == "" {
-			expiry = "24h"
-		}
+	r.PUT("/:name", uploaders, s.uploadFile)
 
-		// Parse the expiry
-		ttl, err := ParseExpiry(expiry)
-		if err != nil {
-			log.Printf("parsing expiry: %s", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parsing expiry: %s", err)})
-			return
-		}
+	// Check whether contents can be uploaded by hash
+	r.HEAD("/blob/:digest", uploaders, s.headBlob)
 
-		// Check if the expiry is within the allowed range
-		if ttl > cfg.FsMaxTTL {
-			log.Printf("expiry too long (max %s)", cfg.FsMaxTTL)
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expiry too long (max %s)", cfg.FsMaxTTL)})
-			return
-		}
+	// Handle root path
+	r.GET("/", downloaders, func(c *gin.Context) {
+		c.FileFromFS("web/", http.FS(webContent))
+	})
 
-		// Check if the file size is within the allowed range
-		if c.Request.ContentLength > cfg.FsMaxFileSize {
-			log.Printf("file too large (%d > %d)", c.Request.ContentLength, cfg.FsMaxFileSize)
-			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file too large (max %d bytes)", cfg.FsMaxFileSize)})
-			return
-		}
+	// Handle file downloads via GET, and their headers via HEAD
+	r.GET("/:id", downloaders, s.downloadFile)
+	r.HEAD("/:id", downloaders, s.downloadFile)
 
-		// Write the file to the filesystem
-		filePath, err := fs.WriteFile(c.Request.Body)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("writing file: %s", err)})
-			return
-		}
+	// Manage files, and sign download URLs for them, with the delete token or
+	// an API key
+	r.PATCH("/:id", uploaders, s.patchFile)
+	r.DELETE("/:id", uploaders, s.deleteFile)
+	r.POST("/:id/sign", uploaders, s.signFile)
 
-		fileName := c.Param("name")
-		contentType := c.GetHeader("Content-Type")
-		expiresAt := time.Now().Add(ttl)
-		clientIP := c.ClientIP()
-		userAgent := c.GetHeader("User-Agent")
+	// Report files for admins to review
+	r.GET("/:id/report", downloaders, s.reportForm)
+	r.POST("/:id/report", downloaders, s.reportFile)
+
+	// Manage all files from the admin dashboard
+	admin := r.Group("/admin", admins, s.requireAdmin)
+	admin.GET("", func(c *gin.Context) {
+		c.FileFromFS("web/admin/", http.FS(webContent))
+	})
+	admin.GET("/api/files", s.adminListFiles)
+	admin.GET("/api/files/:id", s.adminGetFile)
+	admin.PATCH("/api/files/:id", s.adminPatchFile)
+	admin.DELETE("/api/files/:id", s.adminDeleteFile)
+	admin.GET("/api/usage", s.adminUsage)
+	admin.GET("/api/gc", s.adminListGCRuns)
+	admin.GET("/api/reports", s.adminListReports)
+	admin.POST("/api/reports/:id/dismiss", s.adminDismissReport)
+	admin.POST("/api/files/:id/takedown", s.adminTakeDownFile)
+	admin.GET("/api/blocklist", s.adminListBlockedHashes)
+	admin.POST("/api/blocklist", s.adminBlockHash)
+	admin.DELETE("/api/blocklist/:hash", s.adminUnblockHash)
+
+	return s
+}
 
-		// If content type is empty, sniff the content type from the file
-		if contentType == "" {
-			file, err := fs.ReadFile(filePath)
+// downloadFile serves the contents of a file, or the web content with the
+// given name. HEAD requests get the same headers, and do not count as a
+// download.
+func (s *Server) downloadFile(c *gin.Context) {
+	ctx := c.Request.Context()
+	// Check if we can serve the web contents. Directories, such as the admin
+	// dashboard, are served on their own routes.
+	fname := c.Param("id")
+	info, err := fs.Stat(webContent, "web/"+fname)
+	if err == nil && !info.IsDir() {
+		c.FileFromFS("web/"+fname, http.FS(webContent))
+		RequestLogger(c).Debug("Serving web content", "name", fname)
+		return
+	}
+
+	// Get the file from the database
+	file, ok := s.findFile(c, fname)
+	if !ok || !s.checkSignedURL(c, file) {
+		return
+	}
+
+	// Check if the file has passed the malware scan
+	switch file.ScanStatus {
+	case ScanPending:
+		c.JSON(http.StatusLocked, gin.H{"error": "File is being scanned"})
+		return
+	case ScanInfected:
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	case ScanCorrupt:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "File is corrupt"})
+		return
+	case ScanQuarantined:
+		c.JSON(http.StatusForbidden, gin.H{"error": "File is quarantined"})
+		return
+	}
+
+	// Open the file before counting the download, so that the response
+	// headers are known if the client already has the file
+	readSeeker, encoding, err := s.openFile(c, file)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if closer, ok := readSeeker.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if notModified(c, file, encoding) {
+		s.setFileHeaders(c, file, encoding)
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	// Count the download if it includes the start of the file, unless it is a
+	// request for the headers. Files that have used up their downloads are
+	// gone. Later parts of files with a download limit can only be fetched by
+	// clients that have downloaded them, so that the limit cannot be dodged by
+	// downloading the file in parts.
+	counted := false
+	if c.Request.Method == http.MethodGet {
+		if includesFirstByte(c, file, encoding, readSeeker) {
+			allowed, err := s.db.CountDownload(ctx, file.ID, c.ClientIP())
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("opening file for mime type: %s", err)})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
-
-			mime, err := mimetype.DetectReader(file)
+			if !allowed {
+				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+				return
+			}
+			counted = true
+		} else if file.MaxDownloads > 0 {
+			downloaded, err := s.db.HasDownloaded(ctx, file.ID, c.ClientIP())
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("detecting mime type: %s", err)})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !downloaded {
+				c.JSON(http.StatusRequestedRangeNotSatisfiable, gin.H{"error": "Download the file from the start first"})
 				return
 			}
-
-			contentType = mime.String()
 		}
+	}
 
-		// Save the file to the database
-		id, err := db.CreateFile(filePath, fileName, contentType, expiresAt, clientIP, userAgent)
-		if err != nil {
-			// Delete the file from the filesystem if saving to the database fails
-			fs.DeleteFile(filePath)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("creating file record: %s", err)})
-		}
+	s.setFileHeaders(c, file, encoding)
+	if encoding != "" {
+		c.Header("Content-Encoding", encoding)
+	}
 
-		idStr := strconv.FormatInt(id, 36)
-		c.JSON(http.StatusOK, gin.H{"id": idStr, "expires_at": expiresAt})
-	})
+	// Serve the file, and report counted downloads that were sent in full
+	http.ServeContent(c.Writer, c.Request, file.OriginalFilename, file.CreatedAt(), readSeeker)
+	if counted && c.Writer.Status() < 300 && ctx.Err() == nil {
+		s.events.Publish(EventFileDownloaded, file)
+	}
+}
 
-	// Handle root path
-	r.GET("/", func(c *gin.Context) {
-		c.FileFromFS("web/", http.FS(webContent))
-	})
+// includesFirstByte reports whether the response to a download includes the
+// first byte of the contents, as http.ServeContent serves the Range header.
+// That is the case without a range, when the range is ignored because of
+// If-Range or because it adds up to more than the contents, and for ranges
+// from the start, including suffix ranges as long as the contents. Ranges
+// that cannot be parsed are assumed to include it.
+func includesFirstByte(c *gin.Context, file *DbFile, encoding string, content io.Seeker) bool {
+	rng := c.GetHeader("Range")
+	if rng == "" || !ifRangeMatches(c.GetHeader("If-Range"), file, encoding) {
+		return true
+	}
+	specs, ok := strings.CutPrefix(rng, "bytes=")
+	if !ok {
+		return true
+	}
 
-	// Handle file downloads via GET
-	r.GET("/:id", func(c *gin.Context) {
-		// Check if we can serve the web contents
-		fname := c.Param("id")
-		_, err := webContent.Open("web/" + fname)
-		if err == nil {
-			c.FileFromFS("web/"+fname, http.FS(webContent))
-			log.Printf("Serving web content: %s", fname)
-			return
-		}
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return true
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return true
+	}
 
-		// Strip the file extension
-		extIdx := strings.Index(fname, ".")
-		if extIdx != -1 {
-			fname = fname[:extIdx]
+	var total int64
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
 		}
-
-		// Parse file ID
-		fileId, err := strconv.ParseInt(fname, 36, 64)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
-			return
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return true
 		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
 
-		// Get the file from the database
-		file, err := db.GetFile(fileId)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-			return
+		// A suffix range is the last bytes of the contents
+		if first == "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 || n >= size {
+				return true
+			}
+			total += n
+			continue
 		}
 
-		// Check if the file has expired
-		if file.ExpiresAt.Before(time.Now()) || file.Removed {
-			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-			return
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start <= 0 {
+			return true
 		}
-
-		// Read the file from the filesystem
-		readSeeker, err := fs.ReadFile(file.FilePath)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		if start >= size {
+			continue
+		}
+		end := size - 1
+		if last != "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < start {
+				return true
+			}
+			end = min(end, n)
 		}
+		total += end - start + 1
+	}
+	return total > size
+}
+
+// ifRangeMatches reports whether the If-Range header of a download matches the
+// file, so that its Range header applies. Like http.ServeContent, only strong
+// ETags and exact modification times match.
+func ifRangeMatches(ifRange string, file *DbFile, encoding string) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		etag := file.ETag(encoding)
+		return etag != "" && ifRange == etag
+	}
+	if strings.HasPrefix(ifRange, "W/") {
+		return false
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && t.Unix() == file.CreatedAt().Unix()
+}
 
-		// Set the response headers
-		c.Header("Content-Type", file.MimeType)
-		c.Header("Content-Disposition", "inline; filename=\""+file.OriginalFilename+"\"")
-		c.Header("X-Hako-Expires-At", file.ExpiresAt.Format(time.RFC3339))
+// setFileHeaders sets the headers describing a file on a download response.
+func (s *Server) setFileHeaders(c *gin.Context, file *DbFile, encoding string) {
+	c.Header("Content-Type", file.MimeType)
+	c.Header("Content-Disposition", "inline; filename=\""+file.OriginalFilename+"\"")
+	c.Header("X-Hako-Expires-At", file.ExpiresAt.Format(time.RFC3339))
+	setDigestHeaders(c, file, encoding)
+	setCacheHeaders(c, file)
+}
 
-		// Serve the file
-		http.ServeContent(c.Writer, c.Request, file.OriginalFilename, time.Now(), readSeeker)
-	})
+// findFile looks up the live file with the given base36 ID or slug, ignoring
+// any file extension. If the file does not exist, an error response is
+// written and false is returned.
+func (s *Server) findFile(c *gin.Context, id string) (*DbFile, bool) {
+	ctx := c.Request.Context()
+	// Strip the file extension
+	if extIdx := strings.Index(id, "."); extIdx != -1 {
+		id = id[:extIdx]
+	}
+
+	// Get the file from the database by its ID, so that existing links keep
+	// working, or else by its slug
+	var file *DbFile
+	var err error
+	if fileId, parseErr := strconv.ParseInt(id, 36, 64); parseErr == nil {
+		file, err = s.db.GetFile(ctx, fileId)
+	}
+	if file == nil {
+		file, err = s.db.GetFileBySlug(ctx, strings.ToLower(id))
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+
+	setLogFileID(c, file)
+
+	// Private files do not exist for clients without their key
+	if !canAccessFile(c, s.config.Load(), file) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+
+	// Tell clients when a file is gone because its contents were taken down
+	if file.Removed && file.Sha256 != "" && !s.checkBlocked(c, file.Sha256) {
+		return nil, false
+	}
+
+	// Check if the file has expired or used up its downloads
+	if file.ExpiresAt.Before(time.Now()) || file.Removed ||
+		(file.MaxDownloads > 0 && file.Downloads >= file.MaxDownloads) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+
+	return file, true
+}
+
+// openFile opens the contents of a file for download, and returns the
+// Content-Encoding of the contents. Contents that are stored compressed are
+// sent as is if the client accepts their encoding, and the request is not for
+// a range, since ranges apply to the decoded contents. Otherwise they are
+// decoded on the fly.
+func (s *Server) openFile(c *gin.Context, file *DbFile) (io.ReadSeeker, string, error) {
+	ctx := c.Request.Context()
+	encoded, ok := s.fs.(EncodedFS)
+	if !ok {
+		r, err := readFileTraced(ctx, s.fs, file.FilePath)
+		return r, "", err
+	}
+
+	r, encoding, err := readEncodedTraced(ctx, encoded, file.FilePath)
+	if err != nil || encoding == "" {
+		return r, "", err
+	}
+
+	c.Header("Vary", "Accept-Encoding")
+	if c.GetHeader("Range") == "" && AcceptsEncoding(c.GetHeader("Accept-Encoding"), encoding) {
+		return r, encoding, nil
+	}
+
+	if closer, ok := r.(io.Closer); ok {
+		closer.Close()
+	}
+	r, err = readFileTraced(ctx, s.fs, file.FilePath)
+	return r, "", err
+}
 
-	return &Server{router: r, config: cfg, done: make(chan struct{})}
+// Handler returns the HTTP handler of the server.
+func (s *Server) Handler() http.Handler {
+	return s.router.Handler()
 }
 
+// trackInflight counts the requests that are being handled, so that shutdown
+// can wait for them.
+func (s *Server) trackInflight(c *gin.Context) {
+	s.inflight.Add(1)
+	defer s.inflight.Done()
+	c.Next()
+}
+
+// Listen binds the listeners of the server and loads its certificate, so that
+// errors can be reported before serving. Run calls it if it was not called
+// before.
+func (s *Server) Listen() error {
+	cfg := s.config.Load()
+
+	// Serve HTTPS when a certificate is configured
+	if cfg.TLSCertFile != "" {
+		certs, err := NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		certs.Logger = s.Logger
+		if s.tlsConfig, err = NewTLSConfig(cfg, certs); err != nil {
+			return err
+		}
+		s.certs = certs
+	}
+
+	listener, err := Listen(cfg.HttpListenAddr, cfg.HttpSocketMode)
+	if err != nil {
+		return err
+	}
+	if cfg.TLSRedirectAddr != "" {
+		if s.redirectListener, err = Listen(cfg.TLSRedirectAddr, cfg.HttpSocketMode); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	s.listener = listener
+	return nil
+}
+
+// Run serves requests until the context is cancelled. Shutting down stops
+// accepting connections and new uploads, and lets the requests in flight
+// finish for up to the configured ShutdownTimeout before aborting them.
 func (s *Server) Run(ctx context.Context) {
+	defer close(s.done)
+
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
+			s.Logger.Error("Failed to listen", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	cfg := s.config.Load()
 	srv := &http.Server{
-		Addr:    s.config.HttpListenAddr,
-		Handler: s.router.Handler(),
+		Handler:   s.Handler(),
+		TLSConfig: s.tlsConfig,
+		ErrorLog:  slog.NewLogLogger(s.Logger.Handler(), slog.LevelDebug),
 	}
 
+	srv.RegisterOnShutdown(s.stopStreams)
+
+	// Pick up renewed certificates as they are written
+	if s.certs != nil {
+		go s.certs.LoopForever(ctx)
+	}
+
+	errc := make(chan error, 2)
 	go func() {
-		log.Printf("[HTTP] Listening on %s", srv.Addr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %v", err)
+		s.Logger.Info("Listening", "addr", s.listener.Addr().String(), "tls", srv.TLSConfig != nil)
+		if srv.TLSConfig != nil {
+			errc <- srv.ServeTLS(s.listener, "", "")
+		} else {
+			errc <- srv.Serve(s.listener)
 		}
-		s.done <- struct{}{}
 	}()
 
-	<-ctx.Done()
-	log.Println("[HTTP] Shutting down server...")
+	var redirect *http.Server
+	if s.redirectListener != nil {
+		redirect = &http.Server{
+			Handler:  redirectToHTTPS(cfg.HttpListenAddr),
+			ErrorLog: srv.ErrorLog,
+		}
+		go func() {
+			s.Logger.Info("Redirecting to HTTPS", "addr", s.redirectListener.Addr().String())
+			errc <- redirect.Serve(s.redirectListener)
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		s.Logger.Error("Failed to serve", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	if redirect != nil {
+		redirect.Close()
+	}
 
-	ctxShutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	timeout := cfg.ShutdownTimeout
+	s.Logger.Info("Shutting down server, draining requests", "timeout", timeout)
+	s.draining.Store(true)
+
+	ctxShutdown, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	if err := srv.Shutdown(ctxShutdown); err != nil {
-		log.Fatalf("[HTTP] Server shutdown failed: %+v", err)
+		s.Logger.Warn("Timed out draining requests, aborting them", "error", err)
+		srv.Close()
 	}
+
+	// Aborted uploads clean up after themselves once their handler sees the
+	// connection closed
+	s.inflight.Wait()
+	s.Logger.Info("Server stopped")
 }
 
 // Done returns a channel that will be closed when the server has stopped.
@@ -191,11 +547,16 @@ func (s *Server) Done() <-chan struct{} {
 
 // FxNewServer is a constructor for the Server type that is compatible with
 // the fx framework.
-func FxNewServer(db *DB, fs FS, cfg *Config, lc fx.Lifecycle) *Server {
-	server := NewServer(db, fs, cfg)
+func FxNewServer(db *DB, fs FS, cfg *LiveConfig, scans *ScanQueue, events *Events, gc *GC, logger *slog.Logger, lc fx.Lifecycle) *Server {
+	server := NewServer(db, fs, cfg, scans, events)
+	server.GC = gc
+	server.Logger = logger.With("component", "http")
 	ctx, cancel := context.WithCancel(context.Background())
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
+			if err := server.Listen(); err != nil {
+				return err
+			}
 			go server.Run(ctx)
 			return nil
 		},
@@ -0,0 +1,161 @@
+package hako_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+// freeAddr returns a local address with a free port.
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// runServer runs a server on a free port until the returned function is
+// called, and returns its URL.
+func runServer(t *testing.T, cfg *hako.Config, root string) (*hako.Server, string, context.CancelFunc) {
+	cfg.HttpListenAddr = freeAddr(t)
+
+	db, err := hako.NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	fs, err := hako.NewLocalFS(root)
+	if err != nil {
+		t.Fatalf("Failed to create LocalFS: %v", err)
+	}
+
+	server := hako.NewServer(db, fs, hako.NewLiveConfig(cfg), hako.NewScanQueue(db, fs, nil), hako.NewEvents())
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.Run(ctx)
+
+	for i := 0; ; i++ {
+		if conn, err := net.Dial("tcp", cfg.HttpListenAddr); err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	url := "http://" + cfg.HttpListenAddr
+	if cfg.TLSCertFile != "" {
+		url = "https://" + cfg.HttpListenAddr
+	}
+	return server, url, cancel
+}
+
+// startUpload starts an upload whose body is written through the returned
+// pipe, and returns the status code once it is done. The first part of the
+// body is sent right away, so that the server starts writing the file.
+func startUpload(url string) (*io.PipeWriter, <-chan int) {
+	pr, pw := io.Pipe()
+	go pw.Write(bytes.Repeat([]byte("a"), 16<<10))
+
+	status := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPut, url+"/slow.txt", pr)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+	return pw, status
+}
+
+// tempFiles returns the names of partial files in the FS root.
+func tempFiles(t *testing.T, root string) []string {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatalf("Failed to list FS root: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestServerShutdownDrainsUploads(t *testing.T) {
+	assert := assert.New(t)
+
+	root := t.TempDir()
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, ShutdownTimeout: 5 * time.Second}
+	server, url, stop := runServer(t, cfg, root)
+
+	pw, status := startUpload(url)
+	assert.Eventually(func() bool { return len(tempFiles(t, root)) == 1 }, time.Second, 5*time.Millisecond, "Upload should be in progress")
+
+	// Shutting down stops accepting connections, but waits for the upload
+	stop()
+	assert.Eventually(func() bool {
+		_, err := http.Get(url + "/healthz")
+		return err != nil
+	}, time.Second, 5*time.Millisecond, "New connections should be refused")
+	select {
+	case <-server.Done():
+		t.Fatalf("Server should wait for the upload")
+	default:
+	}
+
+	pw.Close()
+	assert.Equal(http.StatusOK, <-status, "Upload in flight should succeed")
+
+	// Done can be waited on more than once
+	for i := 0; i < 2; i++ {
+		select {
+		case <-server.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("Server did not stop")
+		}
+	}
+}
+
+func TestServerShutdownAbortsUploads(t *testing.T) {
+	assert := assert.New(t)
+
+	// Partial files left over from a crash are removed on startup
+	root := t.TempDir()
+	assert.Nil(os.WriteFile(root+"/.tmp-123", []byte("partial"), 0644), "Failed to write temp file")
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, ShutdownTimeout: 100 * time.Millisecond}
+	server, url, stop := runServer(t, cfg, root)
+	assert.Empty(tempFiles(t, root), "Leftover temp files should be removed")
+
+	pw, status := startUpload(url)
+	assert.Eventually(func() bool { return len(tempFiles(t, root)) == 1 }, time.Second, 5*time.Millisecond, "Upload should be in progress")
+
+	// Uploads that don't finish in time are aborted and cleaned up
+	stop()
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server did not stop")
+	}
+	pw.Close()
+	assert.NotEqual(http.StatusOK, <-status, "Aborted upload should fail")
+	assert.Empty(tempFiles(t, root), "Partial upload should be removed")
+}
@@ -0,0 +1,176 @@
+package hako
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Query parameters of signed download URLs.
+const (
+	signExpiresParam = "exp"
+	signIPParam      = "ip"
+	signatureParam   = "sig"
+)
+
+// DefaultSignedURLExpiry is how long signed URLs are valid for, unless another
+// expiry is requested.
+const DefaultSignedURLExpiry = time.Hour
+
+// SignFileURL returns the query of a download URL for the file that is valid
+// until exp, and only for the client with the given address, unless it is
+// empty.
+func SignFileURL(secret string, fileID int64, exp time.Time, ip string) url.Values {
+	query := url.Values{}
+	query.Set(signExpiresParam, strconv.FormatInt(exp.Unix(), 10))
+	if ip != "" {
+		query.Set(signIPParam, ip)
+	}
+	query.Set(signatureParam, base64.RawURLEncoding.EncodeToString(fileSignature(secret, fileID, exp.Unix(), ip)))
+	return query
+}
+
+// VerifyFileURL checks the query of a signed download URL for the file, and
+// returns an error if the signature is invalid, the URL has expired, or it is
+// bound to another client than the one at clientIP.
+func VerifyFileURL(secret string, fileID int64, query url.Values, clientIP string, now time.Time) error {
+	if secret == "" {
+		return errors.New("signed URLs are disabled")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get(signatureParam))
+	if err != nil {
+		return errors.New("invalid signature")
+	}
+	exp, err := strconv.ParseInt(query.Get(signExpiresParam), 10, 64)
+	if err != nil {
+		return errors.New("invalid expiry")
+	}
+	ip := query.Get(signIPParam)
+	if !hmac.Equal(sig, fileSignature(secret, fileID, exp, ip)) {
+		return errors.New("invalid signature")
+	}
+
+	if now.Unix() >= exp {
+		return errors.New("URL has expired")
+	}
+	if addr, err := netip.ParseAddr(clientIP); ip != "" && (err != nil || addr.Unmap().String() != ip) {
+		return errors.New("URL is for another client")
+	}
+	return nil
+}
+
+// fileSignature returns the HMAC-SHA256 of the signed parameters of a download
+// URL.
+func fileSignature(secret string, fileID, exp int64, ip string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n%d\n%s", fileID, exp, ip)
+	return mac.Sum(nil)
+}
+
+// isSigned reports whether the request is for a signed URL.
+func isSigned(c *gin.Context) bool {
+	return c.Query(signatureParam) != ""
+}
+
+// hasValidSignature reports whether the request is for a valid signed URL for
+// the file.
+func hasValidSignature(c *gin.Context, cfg *Config, file *DbFile) bool {
+	return isSigned(c) && VerifyFileURL(cfg.SigningSecret, file.ID, c.Request.URL.Query(), c.ClientIP(), time.Now()) == nil
+}
+
+// checkSignedURL writes an error response and returns false if the request is
+// for a signed URL that is not valid, or if downloads require a signed URL and
+// the client cannot manage the file.
+func (s *Server) checkSignedURL(c *gin.Context, file *DbFile) bool {
+	cfg := s.config.Load()
+	if !isSigned(c) {
+		if cfg.RequireSignedURLs && !HasClientCert(c) && !cfg.CanManageFile(RequestToken(c), file) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Signed URL required"})
+			return false
+		}
+		return true
+	}
+
+	if err := VerifyFileURL(cfg.SigningSecret, file.ID, c.Request.URL.Query(), c.ClientIP(), time.Now()); err != nil {
+		RequestLogger(c).Info("Rejecting invalid signed URL", "error", err)
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Invalid signed URL: %s", err)})
+		return false
+	}
+	return true
+}
+
+// SignRequest is the body of a request for a signed download URL.
+type SignRequest struct {
+	// Expiry is how long the URL is valid for, in the same format as the
+	// expiry query parameter on upload. It defaults to
+	// DefaultSignedURLExpiry, and is cut short at the expiry of the file.
+	Expiry string `json:"expiry"`
+
+	// IP binds the URL to the client with this address.
+	IP string `json:"ip"`
+}
+
+// signFile returns a signed download URL for a file, for clients that can
+// manage it.
+func (s *Server) signFile(c *gin.Context) {
+	cfg := s.config.Load()
+	if cfg.SigningSecret == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Signed URLs are disabled"})
+		return
+	}
+	file, ok := s.findFile(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !HasClientCert(c) && !cfg.CanManageFile(RequestToken(c), file) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to manage this file"})
+		return
+	}
+
+	// The body is optional
+	var req SignRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parsing request: %s", err)})
+		return
+	}
+
+	ttl := DefaultSignedURLExpiry
+	if req.Expiry != "" {
+		var err error
+		ttl, err = ParseExpiry(req.Expiry)
+		if err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expiry"})
+			return
+		}
+	}
+	exp := time.Now().Add(ttl)
+	if exp.After(file.ExpiresAt) {
+		exp = file.ExpiresAt
+	}
+
+	var ip string
+	if req.IP != "" {
+		addr, err := netip.ParseAddr(req.IP)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ip"})
+			return
+		}
+		ip = addr.Unmap().String()
+	}
+
+	query := SignFileURL(cfg.SigningSecret, file.ID, exp, ip)
+	c.JSON(http.StatusOK, gin.H{
+		"url":        "/" + file.PublicID() + "?" + query.Encode(),
+		"expires_at": time.Unix(exp.Unix(), 0),
+	})
+}
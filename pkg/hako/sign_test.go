@@ -0,0 +1,86 @@
+package hako_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignFileURL(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	query := hako.SignFileURL("secret", 42, now.Add(time.Hour), "")
+	assert.Nil(hako.VerifyFileURL("secret", 42, query, "192.0.2.1", now), "Signed URL should be valid")
+	assert.NotNil(hako.VerifyFileURL("secret", 42, query, "192.0.2.1", now.Add(2*time.Hour)), "Expired URL should be rejected")
+	assert.NotNil(hako.VerifyFileURL("secret", 43, query, "192.0.2.1", now), "URL for another file should be rejected")
+	assert.NotNil(hako.VerifyFileURL("other", 42, query, "192.0.2.1", now), "URL signed with another secret should be rejected")
+	assert.NotNil(hako.VerifyFileURL("", 42, query, "192.0.2.1", now), "URLs should be rejected without a secret")
+
+	tampered := url.Values{}
+	for k, v := range query {
+		tampered[k] = v
+	}
+	tampered.Set("exp", "9999999999")
+	assert.NotNil(hako.VerifyFileURL("secret", 42, tampered, "192.0.2.1", now), "Tampered URL should be rejected")
+
+	bound := hako.SignFileURL("secret", 42, now.Add(time.Hour), "2001:db8::1")
+	assert.Nil(hako.VerifyFileURL("secret", 42, bound, "2001:db8::1", now), "Bound URL should be valid for its client")
+	assert.NotNil(hako.VerifyFileURL("secret", 42, bound, "2001:db8::2", now), "Bound URL should be rejected for other clients")
+}
+
+func TestServerSignedURL(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, SigningSecret: "secret", RequireSignedURLs: true}
+	srv, _, _ := newTestServer(t, cfg)
+
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt?expiry=2h", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	id, token := upload["id"].(string), upload["delete_token"].(string)
+
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+id, "", nil)
+	assert.Equal(http.StatusForbidden, status, "Download without a signed URL should be forbidden")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+id, token, nil)
+	assert.Equal(http.StatusOK, status, "Download with the delete token should succeed")
+
+	status, _ = doRequest(t, http.MethodPost, srv.URL+"/"+id+"/sign", "", nil)
+	assert.Equal(http.StatusForbidden, status, "Signing without a token should be forbidden")
+	status, signed := doRequest(t, http.MethodPost, srv.URL+"/"+id+"/sign", token, map[string]any{"expiry": "1d"})
+	assert.Equal(http.StatusOK, status, "Signing should succeed")
+	expiresAt, err := time.Parse(time.RFC3339, signed["expires_at"].(string))
+	assert.Nil(err, "Failed to parse expiry")
+	assert.WithinDuration(time.Now().Add(2*time.Hour), expiresAt, time.Minute, "Expiry should be cut short at the file expiry")
+
+	res, err := http.Get(srv.URL + signed["url"].(string))
+	assert.Nil(err, "Failed to download file")
+	assert.Equal(http.StatusOK, res.StatusCode, "Download with the signed URL should succeed")
+	assert.Equal("no-store", res.Header.Get("Cache-Control"), "Signed downloads should not be cached")
+	res.Body.Close()
+
+	tampered := strings.Replace(signed["url"].(string), "exp=", "exp=1", 1)
+	status, _ = doRequest(t, http.MethodGet, srv.URL+tampered, "", nil)
+	assert.Equal(http.StatusForbidden, status, "Tampered URL should be rejected")
+
+	// URLs can be bound to a client
+	status, signed = doRequest(t, http.MethodPost, srv.URL+"/"+id+"/sign", token, map[string]any{"ip": "192.0.2.1"})
+	assert.Equal(http.StatusOK, status, "Signing for a client should succeed")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+signed["url"].(string), "", nil)
+	assert.Equal(http.StatusForbidden, status, "URL for another client should be rejected")
+	status, _ = doRequest(t, http.MethodPost, srv.URL+"/"+id+"/sign", token, map[string]any{"ip": "nope"})
+	assert.Equal(http.StatusBadRequest, status, "Invalid address should be rejected")
+
+	// Signed URLs give access to private files without their key
+	status, upload = doRequest(t, http.MethodPut, srv.URL+"/file.txt?private=true", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Private upload should succeed")
+	status, signed = doRequest(t, http.MethodPost, srv.URL+"/"+upload["id"].(string)+"/sign", upload["delete_token"].(string), nil)
+	assert.Equal(http.StatusOK, status, "Signing a private file should succeed")
+	assert.NotContains(signed["url"], "k=", "Signed URL should not reveal the key")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+signed["url"].(string), "", nil)
+	assert.Equal(http.StatusOK, status, "Private file should be served with a signed URL")
+}
@@ -0,0 +1,128 @@
+package hako
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// IDFormat selects how the IDs that new files are linked by are generated.
+type IDFormat string
+
+const (
+	// IDBase36 links files by their snowflake ID in base36, such as
+	// 1a2b3c4d5e6f.
+	IDBase36 IDFormat = "base36"
+	// IDWords links files by four random words, such as brave-otter-mild-lake.
+	IDWords IDFormat = "words"
+	// IDCrockford links files by eight random Crockford base32 characters,
+	// such as 7mzq4k2r, which leave out the easily confused i, l, o and u.
+	IDCrockford IDFormat = "crockford"
+)
+
+// ParseIDFormat parses an ID format, defaulting to IDBase36 when empty.
+func ParseIDFormat(s string) (IDFormat, error) {
+	switch format := IDFormat(strings.ToLower(strings.TrimSpace(s))); format {
+	case "":
+		return IDBase36, nil
+	case IDBase36, IDWords, IDCrockford:
+		return format, nil
+	default:
+		return IDBase36, fmt.Errorf("unknown ID format %q", s)
+	}
+}
+
+// ReservedSlugs cannot be used as slugs, since they are, or may become, routes
+// of the server.
+var ReservedSlugs = []string{"admin", "api", "blob", "events", "healthz", "index", "livez", "readyz", "report", "static"}
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}[a-z0-9]$`)
+
+// ParseSlug normalizes a custom slug to lower case and checks that it is 3 to
+// 64 letters, digits and dashes, starting and ending with a letter or digit.
+// Reserved slugs, and slugs that could be mistaken for a snowflake ID, are
+// rejected.
+func ParseSlug(s string) (string, error) {
+	slug := strings.ToLower(s)
+	if !slugPattern.MatchString(slug) {
+		return "", errors.New("slug must be 3 to 64 letters, digits and dashes")
+	}
+	if slices.Contains(ReservedSlugs, slug) {
+		return "", fmt.Errorf("slug %q is reserved", slug)
+	}
+	if _, err := strconv.ParseInt(slug, 36, 64); err == nil && len(slug) > 10 {
+		return "", fmt.Errorf("slug %q looks like a file ID", slug)
+	}
+	return slug, nil
+}
+
+// crockfordAlphabet is the Crockford base32 alphabet in lower case.
+const crockfordAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// NewSlug generates a random slug in the given format, or returns an empty
+// string for IDBase36, whose IDs are the snowflake IDs themselves.
+func NewSlug(format IDFormat) string {
+	switch format {
+	case IDWords:
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		words := make([]string, len(b))
+		for i, n := range b {
+			words[i] = slugWords[n]
+		}
+		return strings.Join(words, "-")
+	case IDCrockford:
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		for i, n := range b {
+			b[i] = crockfordAlphabet[n%32]
+		}
+		return string(b[:])
+	default:
+		return ""
+	}
+}
+
+// slugWords are the 256 words that IDWords slugs are made of, one byte each.
+var slugWords = [256]string{
+	"able", "acid", "aged", "airy", "alto", "amber", "apex", "apple", "april",
+	"arch", "arctic", "aria", "atlas", "autumn", "avid", "baker", "bamboo",
+	"banjo", "basil", "bay", "beach", "bean", "bear", "berry", "birch", "bison",
+	"blue", "bold", "bolt", "brave", "breeze", "brick", "brisk", "brook", "bud",
+	"cabin", "cactus", "calm", "camel", "candle", "canoe", "canyon", "cargo",
+	"carrot", "cedar", "cello", "chalk", "charm", "cherry", "chess", "cider",
+	"cinder", "citrus", "clay", "clever", "cliff", "cloud", "clover", "coast",
+	"cobalt", "cocoa", "comet", "coral", "cosmic", "cotton", "crane", "creek",
+	"crisp", "crow", "curly", "cyan", "daisy", "dawn", "deep", "delta",
+	"desert", "dew", "dingo", "dolphin", "dove", "dune", "eager", "eagle",
+	"early", "east", "echo", "elder", "elm", "ember", "emerald", "epic",
+	"fable", "fair", "falcon", "fancy", "fern", "fig", "finch", "fjord",
+	"flint", "floral", "fluffy", "focus", "forest", "fox", "fresh", "frost",
+	"gala", "gentle", "giant", "ginger", "glade", "glow", "gold", "grape",
+	"gravel", "green", "grove", "gull", "happy", "harbor", "hazel", "heron",
+	"hill", "honey", "humble", "husky", "icy", "indigo", "iris", "island",
+	"ivory", "jade", "jazz", "jolly", "juniper", "kayak", "kelp", "kind",
+	"kite", "koala", "lagoon", "lake", "lark", "lava", "lemon", "lilac", "lime",
+	"linen", "lively", "lotus", "lucky", "lunar", "lynx", "magic", "mango",
+	"maple", "marble", "meadow", "mellow", "melon", "merry", "mild", "mint",
+	"misty", "moss", "noble", "north", "nutmeg", "oak", "oasis", "ocean",
+	"olive", "onyx", "opal", "orange", "orbit", "orchid", "otter", "owl",
+	"panda", "papaya", "pearl", "pebble", "pepper", "piano", "pilot", "pine",
+	"plum", "polar", "pond", "poppy", "prairie", "prism", "proud", "quail",
+	"quick", "quiet", "quill", "rain", "raven", "reef", "ridge", "river",
+	"robin", "rocky", "rose", "ruby", "rustic", "sage", "salmon", "sandy",
+	"satin", "scout", "sea", "shady", "shell", "silver", "sky", "slate",
+	"snowy", "solar", "spark", "spruce", "steady", "stone", "storm", "sugar",
+	"summit", "sunny", "swan", "swift", "tango", "teal", "thyme", "tidy",
+	"tiger", "topaz", "tulip", "tundra", "twig", "valley", "velvet", "violet",
+	"vivid", "walnut", "warm", "wave", "willow", "windy", "wise", "wolf",
+	"yarn", "zesty", "zinc", "zebra",
+}
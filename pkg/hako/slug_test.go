@@ -0,0 +1,93 @@
+package hako_test
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSlug(t *testing.T) {
+	assert := assert.New(t)
+
+	slug, err := hako.ParseSlug("Meeting-Notes-2024")
+	assert.Nil(err, "Valid slug should be accepted")
+	assert.Equal("meeting-notes-2024", slug, "Slug should be lower case")
+
+	for _, invalid := range []string{"ab", "-notes", "notes-", "meeting_notes", "notes.txt", "admin", "healthz", "1a2b3c4d5e6f", strings.Repeat("a", 65)} {
+		_, err := hako.ParseSlug(invalid)
+		assert.NotNil(err, "Slug %q should be rejected", invalid)
+	}
+}
+
+func TestNewSlug(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Empty(hako.NewSlug(hako.IDBase36), "Base36 IDs should not have a slug")
+	assert.Regexp(regexp.MustCompile(`^[a-z]+(-[a-z]+){3}$`), hako.NewSlug(hako.IDWords), "Word slug mismatch")
+	assert.Regexp(regexp.MustCompile(`^[0-9abcdefghjkmnpqrstvwxyz]{8}$`), hako.NewSlug(hako.IDCrockford), "Crockford slug mismatch")
+	assert.NotEqual(hako.NewSlug(hako.IDWords), hako.NewSlug(hako.IDWords), "Slugs should be random")
+
+	for _, format := range []hako.IDFormat{hako.IDWords, hako.IDCrockford} {
+		_, err := hako.ParseSlug(hako.NewSlug(format))
+		assert.Nil(err, "Generated %s slug should be a valid slug", format)
+	}
+
+	_, err := hako.ParseIDFormat("uuid")
+	assert.NotNil(err, "Unknown ID formats should be rejected")
+}
+
+func TestServerSlug(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, _ := newTestServer(t, &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour})
+
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/notes.txt?slug=Meeting-Notes", "", "Agenda")
+	assert.Equal(http.StatusOK, status, "Upload with a slug should succeed")
+	assert.Equal("meeting-notes", upload["id"], "Slug should be returned as the ID")
+
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/meeting-notes", "", nil)
+	assert.Equal(http.StatusOK, status, "File should be served by its slug")
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/Meeting-Notes.txt", "", nil)
+	assert.Equal(http.StatusOK, status, "Slugs should not be case sensitive")
+
+	status, _ = doRequest(t, http.MethodPut, srv.URL+"/other.txt?slug=meeting-notes", "", "Other")
+	assert.Equal(http.StatusConflict, status, "Taken slug should be rejected")
+	status, _ = doRequest(t, http.MethodPut, srv.URL+"/other.txt?slug=admin", "", "Other")
+	assert.Equal(http.StatusBadRequest, status, "Reserved slug should be rejected")
+
+	// Files without a slug keep their base36 links
+	status, plain := doRequest(t, http.MethodPut, srv.URL+"/plain.txt", "", "Plain")
+	assert.Equal(http.StatusOK, status, "Upload without a slug should succeed")
+	mustFileID(t, plain["id"].(string))
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+plain["id"].(string), "", nil)
+	assert.Equal(http.StatusOK, status, "File should be served by its base36 ID")
+
+	// The slug is free again once the file is removed
+	status, _ = doRequest(t, http.MethodDelete, srv.URL+"/meeting-notes", upload["delete_token"].(string), nil)
+	assert.Equal(http.StatusNoContent, status, "Deleting by slug should succeed")
+	status, _ = doRequest(t, http.MethodPut, srv.URL+"/notes.txt?slug=meeting-notes", "", "New agenda")
+	assert.Equal(http.StatusOK, status, "Slug of a removed file should be reusable")
+}
+
+func TestServerGeneratedIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, _ := newTestServer(t, &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour, IDFormat: hako.IDWords})
+
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt", "", "Hello")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	id := upload["id"].(string)
+	assert.Len(strings.Split(id, "-"), 4, "ID should be made of words")
+
+	status, _ = doRequest(t, http.MethodGet, srv.URL+"/"+id, "", nil)
+	assert.Equal(http.StatusOK, status, "File should be served by its generated ID")
+
+	status, upload = doRequest(t, http.MethodPut, srv.URL+"/file.txt?slug=hello", "", "Hello")
+	assert.Equal(http.StatusOK, status, "Upload with a slug should succeed")
+	assert.Equal("hello", upload["id"], "Custom slug should win over a generated ID")
+}
@@ -0,0 +1,87 @@
+package hako
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxUploadIDLength is the maximum length of a client-chosen upload ID.
+const maxUploadIDLength = 128
+
+// UploadID returns the upload ID chosen by the client for progress reporting,
+// from either the X-Hako-Upload-Id header or the upload_id query parameter.
+func UploadID(c *gin.Context) string {
+	uploadId := c.GetHeader("X-Hako-Upload-Id")
+	if uploadId == "" {
+		uploadId = c.Query("upload_id")
+	}
+	if len(uploadId) > maxUploadIDLength {
+		return ""
+	}
+	return uploadId
+}
+
+// streamEvents streams events to the client as Server-Sent Events. With an
+// upload_id query parameter, only progress events for that upload are sent.
+// Otherwise, file lifecycle events are sent, optionally filtered by a
+// comma-separated list of event types in the types query parameter. The
+// lifecycle stream exposes every upload other than private ones, so it must be
+// enabled explicitly.
+func (s *Server) streamEvents(c *gin.Context) {
+	uploadId := UploadID(c)
+	types := splitList(c.Query("types"))
+
+	var filter func(ev Event) bool
+	if uploadId != "" {
+		filter = func(ev Event) bool {
+			return ev.Upload != nil && ev.Upload.ID == uploadId
+		}
+	} else if s.config.Load().EventsStreamEnabled {
+		filter = func(ev Event) bool {
+			return ev.File != nil && !ev.File.Private && (len(types) == 0 || slices.Contains(types, string(ev.Type)))
+		}
+	} else {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event stream is disabled"})
+		return
+	}
+
+	// Drop events rather than block the publisher if the client is too slow
+	ch := make(chan Event, 64)
+	unsubscribe := s.events.Subscribe(func(ev Event) {
+		if !filter(ev) {
+			return
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("ready", gin.H{})
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-s.streams.Done():
+			return false
+		case ev := <-ch:
+			c.SSEvent(string(ev.Type), ev.Public())
+			return true
+		case <-keepalive.C:
+			_, err := io.WriteString(w, ": keepalive\n\n")
+			return err == nil
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package hako_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+// readEvents reads Server-Sent Events from the response body until the stop
+// function returns true.
+func readEvents(t *testing.T, res *http.Response, stop func(name string, ev hako.Event) bool) {
+	scanner := bufio.NewScanner(res.Body)
+	var name string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if n, ok := strings.CutPrefix(line, "event:"); ok {
+			name = n
+		} else if data, ok := strings.CutPrefix(line, "data:"); ok {
+			var ev hako.Event
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				t.Fatalf("Failed to unmarshal event %q: %v", data, err)
+			}
+			if stop(name, ev) {
+				return
+			}
+		}
+	}
+	t.Fatalf("Event stream ended: %v", scanner.Err())
+}
+
+func TestServerEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	fs, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 1 * time.Hour}
+	events := hako.NewEvents()
+	server := hako.NewServer(db, fs, hako.NewLiveConfig(cfg), hako.NewScanQueue(db, fs, nil), events)
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	// Lifecycle stream is disabled by default
+	res, err := http.Get(srv.URL + "/events")
+	assert.Nil(err, "Failed to request event stream")
+	assert.Equal(http.StatusNotFound, res.StatusCode, "Lifecycle stream should be disabled")
+	res.Body.Close()
+
+	// Subscribe to the progress of an upload
+	res, err = http.Get(srv.URL + "/events?upload_id=test-upload")
+	assert.Nil(err, "Failed to request event stream")
+	defer res.Body.Close()
+	assert.Equal("text/event-stream", res.Header.Get("Content-Type"), "Content type mismatch")
+	readEvents(t, res, func(name string, ev hako.Event) bool { return name == "ready" })
+
+	// Upload a file with the same upload ID
+	data := bytes.Repeat([]byte("a"), 100000)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/file.txt", bytes.NewReader(data))
+		req.Header.Set("X-Hako-Upload-Id", "test-upload")
+		if res, err := http.DefaultClient.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	var last *hako.UploadProgress
+	readEvents(t, res, func(name string, ev hako.Event) bool {
+		assert.Equal(string(hako.EventUploadProgress), name, "Event name mismatch")
+		assert.Equal("test-upload", ev.Upload.ID, "Upload ID mismatch")
+		last = ev.Upload
+		return ev.Upload.Done
+	})
+	assert.Equal(int64(len(data)), last.Received, "Received bytes mismatch")
+	assert.Equal(int64(len(data)), last.Total, "Total bytes mismatch")
+	assert.NotEmpty(last.FileID, "Final event should contain the file ID")
+	assert.Empty(last.Error, "Final event should not contain an error")
+}
+
+func TestServerEventsLifecycle(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	fs, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 1 * time.Hour, EventsStreamEnabled: true}
+	events := hako.NewEvents()
+	server := hako.NewServer(db, fs, hako.NewLiveConfig(cfg), hako.NewScanQueue(db, fs, nil), events)
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/events?types=file.uploaded")
+	assert.Nil(err, "Failed to request event stream")
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode, "Lifecycle stream should be enabled")
+	readEvents(t, res, func(name string, ev hako.Event) bool { return name == "ready" })
+
+	events.Publish(hako.EventFileDownloaded, &hako.DbFile{ID: 1})
+	events.Publish(hako.EventFileUploaded, &hako.DbFile{ID: 3, OriginalFilename: "secret.txt", AccessKeyHash: "hash"})
+	events.Publish(hako.EventFileUploaded, &hako.DbFile{ID: 2, OriginalFilename: "file.txt", IPAddress: "192.0.2.1", UserAgent: "TestAgent"})
+	readEvents(t, res, func(name string, ev hako.Event) bool {
+		assert.Equal(hako.EventFileUploaded, ev.Type, "Only uploaded events should be streamed")
+		assert.Equal("file.txt", ev.File.Filename, "Private files should not be streamed")
+		assert.Empty(ev.File.IPAddress, "Uploader address should not be streamed")
+		assert.Empty(ev.File.UserAgent, "Uploader user agent should not be streamed")
+		return true
+	})
+}
+
+func TestServerDownloadedEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	fs, err := hako.NewLocalFS(t.TempDir())
+	assert.Nil(err, "Failed to create LocalFS")
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 1 * time.Hour}
+	events := hako.NewEvents()
+	server := hako.NewServer(db, fs, hako.NewLiveConfig(cfg), hako.NewScanQueue(db, fs, nil), events)
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	var downloads atomic.Int32
+	events.Subscribe(func(ev hako.Event) {
+		if ev.Type == hako.EventFileDownloaded {
+			downloads.Add(1)
+		}
+	})
+
+	status, upload := doRequest(t, http.MethodPut, srv.URL+"/file.txt", "", "Hello, World!")
+	assert.Equal(http.StatusOK, status, "Upload should succeed")
+	url := srv.URL + "/" + upload["id"].(string)
+
+	download := func(headers map[string]string) int {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(err, "Failed to download file")
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Headers, revalidations and later parts are not downloads
+	res, err := http.Head(url)
+	assert.Nil(err, "Failed to send HEAD request")
+	res.Body.Close()
+	assert.Equal(http.StatusNotModified, download(map[string]string{"If-None-Match": res.Header.Get("ETag")}), "File should not be modified")
+	assert.Equal(http.StatusPartialContent, download(map[string]string{"Range": "bytes=7-"}), "Later part should be served")
+
+	// Downloads from the start are reported once each
+	assert.Equal(http.StatusOK, download(nil), "File should be served")
+	assert.Equal(http.StatusPartialContent, download(map[string]string{"Range": "bytes=0-4"}), "Range from the start should be served")
+	assert.Eventually(func() bool { return downloads.Load() >= 2 }, time.Second, 10*time.Millisecond, "Downloads should be reported")
+	assert.Equal(int32(2), downloads.Load(), "Only counted downloads should be reported")
+}
@@ -0,0 +1,161 @@
+package hako
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CertReloader serves a certificate loaded from files on disk, and loads it
+// again when the files change, so that renewed certificates are picked up
+// without a restart.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	// Interval is how often the files are checked for changes.
+	Interval time.Duration
+
+	Logger *slog.Logger
+
+	cert    atomic.Pointer[tls.Certificate]
+	version string
+}
+
+// NewCertReloader loads the certificate and key from the given files.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		Interval: 10 * time.Second,
+		Logger:   slog.Default().With("component", "tls"),
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// fileVersion identifies the current contents of the files by their
+// modification times and sizes.
+func (r *CertReloader) fileVersion() (string, error) {
+	var version string
+	for _, name := range []string{r.CertFile, r.KeyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		version += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return version, nil
+}
+
+// Reload loads the certificate again if the files have changed since it was
+// last loaded, and reports whether it did. The current certificate is kept if
+// the new one cannot be loaded, for example when only one of the files has
+// been replaced yet.
+func (r *CertReloader) Reload() (bool, error) {
+	version, err := r.fileVersion()
+	if err != nil {
+		return false, err
+	}
+	if version == r.version {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	r.cert.Store(&cert)
+	r.version = version
+	return true, nil
+}
+
+// GetCertificate returns the current certificate. It is meant to be used as
+// tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// LoopForever checks the files for changes until the context is cancelled.
+func (r *CertReloader) LoopForever(ctx context.Context) {
+	for {
+		SleepWithContext(ctx, r.Interval)
+		if ctx.Err() != nil {
+			return
+		}
+
+		reloaded, err := r.Reload()
+		if err != nil {
+			r.Logger.Error("Failed to reload certificate, keeping the current one", "error", err)
+		} else if reloaded {
+			r.Logger.Info("Reloaded certificate", "cert_file", r.CertFile)
+		}
+	}
+}
+
+// NewTLSConfig creates the TLS configuration of the server, serving the
+// certificate from the given reloader. When a client CA is configured,
+// clients may authenticate with a certificate signed by it.
+func NewTLSConfig(cfg *Config, certs *CertReloader) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+
+	if cfg.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in client CA file")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// redirectToHTTPS redirects every request to the same URL on the HTTPS
+// listener at httpsAddr, or on the default port if it is not a TCP address.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// strictTransportSecurity tells browsers to only use HTTPS for the site, on
+// requests that were made over TLS.
+func (s *Server) strictTransportSecurity(c *gin.Context) {
+	if maxAge := s.config.Load().TLSHSTSMaxAge; maxAge > 0 && c.Request.TLS != nil {
+		c.Header("Strict-Transport-Security", "max-age="+strconv.FormatInt(int64(maxAge/time.Second), 10))
+	}
+	c.Next()
+}
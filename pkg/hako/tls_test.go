@@ -0,0 +1,201 @@
+package hako_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCert is a certificate and its key, signed by its parent or itself.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate for 127.0.0.1 with the given common name,
+// signed by parent, or self-signed when parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0644); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// tlsCert returns the certificate for use by a client.
+func (c *testCert) tlsCert() *tls.Certificate {
+	return &tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestCertReloader(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	certFile, keyFile := newTestCert(t, "hako", nil, false).write(t, dir, "server")
+	certs, err := hako.NewCertReloader(certFile, keyFile)
+	assert.Nil(err, "Failed to load certificate")
+	cert, _ := certs.GetCertificate(nil)
+	assert.Equal("hako", cert.Leaf.Subject.CommonName, "Certificate should be loaded")
+
+	// Nothing is reloaded while the files stay the same
+	reloaded, err := certs.Reload()
+	assert.Nil(err, "Failed to check certificate")
+	assert.False(reloaded, "Unchanged certificate should not be reloaded")
+
+	// A half-written renewal keeps the current certificate
+	renewed := newTestCert(t, "hako-renewed", nil, false)
+	assert.Nil(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: renewed.der}), 0644), "Failed to write certificate")
+	_, err = certs.Reload()
+	assert.Error(err, "Mismatched key should fail to load")
+	cert, _ = certs.GetCertificate(nil)
+	assert.Equal("hako", cert.Leaf.Subject.CommonName, "Current certificate should be kept")
+
+	// The renewal is picked up once both files are written
+	renewed.write(t, dir, "server")
+	reloaded, err = certs.Reload()
+	assert.Nil(err, "Failed to reload certificate")
+	assert.True(reloaded, "Renewed certificate should be reloaded")
+	cert, _ = certs.GetCertificate(nil)
+	assert.Equal("hako-renewed", cert.Leaf.Subject.CommonName, "Renewed certificate should be served")
+}
+
+func TestServerTLS(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "hako-ca", nil, true)
+	certFile, keyFile := newTestCert(t, "hako", ca, false).write(t, dir, "server")
+	caFile, _ := ca.write(t, dir, "ca")
+
+	cfg := &hako.Config{
+		FsMaxFileSize:   1 << 20,
+		FsMaxTTL:        24 * time.Hour,
+		ShutdownTimeout: time.Second,
+		TLSCertFile:     certFile,
+		TLSKeyFile:      keyFile,
+		TLSClientCAFile: caFile,
+		TLSRedirectAddr: freeAddr(t),
+		TLSHSTSMaxAge:   24 * time.Hour,
+	}
+	server, url, stop := runServer(t, cfg, t.TempDir())
+	defer func() {
+		stop()
+		<-server.Done()
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(cert *tls.Certificate) *http.Client {
+		// Always present the certificate, even if the server does not
+		// accept its CA
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return cert, nil
+			}
+		}
+		return &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	do := func(client *http.Client, method, url string) (*http.Response, map[string]any) {
+		req, _ := http.NewRequest(method, url, strings.NewReader("Hello, World!"))
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer res.Body.Close()
+		var result map[string]any
+		json.NewDecoder(res.Body).Decode(&result)
+		return res, result
+	}
+
+	// Files are served over HTTPS, with HSTS
+	client := newClient(nil)
+	res, _ := do(client, http.MethodGet, url+"/")
+	assert.Equal(http.StatusOK, res.StatusCode, "Index should be served over HTTPS")
+	assert.Equal("max-age=86400", res.Header.Get("Strict-Transport-Security"), "HSTS header mismatch")
+
+	// Plain HTTP is redirected
+	res, _ = do(client, http.MethodGet, "http://"+cfg.TLSRedirectAddr+"/abc.txt?x=1")
+	assert.Equal(http.StatusPermanentRedirect, res.StatusCode, "HTTP should be redirected")
+	assert.Equal(url+"/abc.txt?x=1", res.Header.Get("Location"), "Redirect location mismatch")
+
+	// A client certificate from the CA can manage any file, like an API key
+	res, body := do(client, http.MethodPut, url+"/hello.txt")
+	assert.Equal(http.StatusOK, res.StatusCode, "Upload should succeed")
+	id, _ := body["id"].(string)
+
+	stranger := newTestCert(t, "stranger", nil, false)
+	_, err := newClient(stranger.tlsCert()).Get(url + "/")
+	assert.Error(err, "Client certificates from other CAs should be rejected")
+
+	internal := newClient(newTestCert(t, "uploader", ca, false).tlsCert())
+	res, _ = do(client, http.MethodDelete, url+"/"+id)
+	assert.Equal(http.StatusForbidden, res.StatusCode, "Delete without credentials should be forbidden")
+	res, _ = do(internal, http.MethodDelete, url+"/"+id)
+	assert.Equal(http.StatusNoContent, res.StatusCode, "Delete with a client certificate should succeed")
+}
@@ -0,0 +1,137 @@
+package hako
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+)
+
+// tracer creates the spans of the server. It uses the global tracer provider,
+// which does nothing unless tracing is enabled.
+var tracer = otel.Tracer("github.com/hizkifw/hako/pkg/hako")
+
+// NewTracerProvider creates a tracer provider that sends spans to the given
+// exporter in batches.
+func NewTracerProvider(exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "hako"))),
+	)
+}
+
+// FxNewTracerProvider sets up tracing for Fx. When an OTLP endpoint is
+// configured, spans are exported to it, and trace context is taken from
+// incoming requests. Otherwise, tracing is disabled.
+func FxNewTracerProvider(cfg *Config, lc fx.Lifecycle) (trace.TracerProvider, error) {
+	if cfg.TracingEndpoint == "" {
+		return otel.GetTracerProvider(), nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.TracingEndpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := NewTracerProvider(exporter)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	lc.Append(fx.Hook{
+		OnStop: provider.Shutdown,
+	})
+
+	return provider, nil
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// readFileTraced reads a file from the FS in a span.
+func readFileTraced(ctx context.Context, fs FS, filename string) (io.ReadSeeker, error) {
+	_, span := tracer.Start(ctx, "FS.ReadFile")
+	r, err := fs.ReadFile(filename)
+	endSpan(span, err)
+	return r, err
+}
+
+// readEncodedTraced reads the stored contents of a file from the FS in a span.
+func readEncodedTraced(ctx context.Context, fs EncodedFS, filename string) (io.ReadSeeker, string, error) {
+	_, span := tracer.Start(ctx, "FS.ReadEncoded")
+	r, encoding, err := fs.ReadEncoded(filename)
+	endSpan(span, err)
+	return r, encoding, err
+}
+
+// writeFileTraced writes a file to the FS in a span, which includes reading
+// the data.
+func writeFileTraced(ctx context.Context, fs FS, data io.Reader) (*Blob, error) {
+	_, span := tracer.Start(ctx, "FS.WriteFile")
+	blob, err := fs.WriteFile(data)
+	if err == nil {
+		span.SetAttributes(attribute.Int64("hako.size", blob.Size))
+	}
+	endSpan(span, err)
+	return blob, err
+}
+
+// deleteFileTraced deletes a file from the FS in a span.
+func deleteFileTraced(ctx context.Context, fs FS, filename string) error {
+	_, span := tracer.Start(ctx, "FS.DeleteFile")
+	err := fs.DeleteFile(filename)
+	endSpan(span, err)
+	return err
+}
+
+// startSpan starts a span for a database query.
+func (d *DB) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "DB."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "sqlite")))
+}
+
+// traceRequests starts a span for every request, continuing the trace of the
+// client, if any. Handlers find the span in the request context.
+func (s *Server) traceRequests(c *gin.Context) {
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", c.Request.Method),
+			attribute.String("http.route", route),
+		))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if fileID, ok := c.Get(fileIDKey); ok {
+		span.SetAttributes(attribute.String("hako.file_id", fileID.(string)))
+	}
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
@@ -0,0 +1,93 @@
+package hako_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider that records spans in memory for the
+// duration of the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	return exporter
+}
+
+// spansByName indexes the recorded spans by name.
+func spansByName(exporter *tracetest.InMemoryExporter) map[string]tracetest.SpanStub {
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func TestServerTracing(t *testing.T) {
+	assert := assert.New(t)
+	exporter := recordSpans(t)
+
+	cfg := &hako.Config{FsMaxFileSize: 1 << 20, FsMaxTTL: 24 * time.Hour}
+	srv, _, _ := newTestServer(t, cfg)
+
+	// Uploads continue the trace of the client
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/hello.txt", strings.NewReader("hello world"))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(err, "Failed to upload file")
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode, "Upload should succeed")
+
+	spans := spansByName(exporter)
+	server, ok := spans["PUT /:name"]
+	assert.True(ok, "Upload should have a server span")
+	assert.Equal(traceID, server.SpanContext.TraceID().String(), "Upload should continue the client trace")
+	assert.Equal(trace.SpanKindServer, server.SpanKind, "Span kind mismatch")
+
+	for _, name := range []string{"SniffReader", "FS.WriteFile", "DB.InsertFile"} {
+		span, ok := spans[name]
+		if assert.True(ok, "Upload should have a %s span", name) {
+			assert.Equal(server.SpanContext.SpanID(), span.Parent.SpanID(), "%s should be a child of the request", name)
+		}
+	}
+
+	// Downloads are traced without a client trace too
+	exporter.Reset()
+	_, upload := doRequest(t, http.MethodPut, srv.URL+"/hello.txt", "", "hello again")
+	exporter.Reset()
+	res, err = http.Get(srv.URL + "/" + upload["id"].(string))
+	assert.Nil(err, "Failed to download file")
+	res.Body.Close()
+
+	spans = spansByName(exporter)
+	server, ok = spans["GET /:id"]
+	assert.True(ok, "Download should have a server span")
+	assert.False(server.Parent.IsValid(), "Download should start a new trace")
+	for _, name := range []string{"DB.GetFile", "DB.CountDownload", "FS.ReadFile"} {
+		span, ok := spans[name]
+		if assert.True(ok, "Download should have a %s span", name) {
+			assert.Equal(server.SpanContext.TraceID(), span.SpanContext.TraceID(), "%s should be in the request trace", name)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package hako
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+)
+
+// uploadFile stores the request body as a new file. If the client announces
+// the hash of the contents in the X-Hako-Sha256 header and they are already
+// stored, the new file shares them and the body is never read, so a client
+// that sent `Expect: 100-continue` does not have to send it at all.
+func (s *Server) uploadFile(c *gin.Context) {
+	ctx := c.Request.Context()
+	cfg := s.config.Load()
+
+	// Refuse new uploads while shutting down, so that they don't hold it up
+	if s.draining.Load() {
+		c.Header("Connection", "close")
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return
+	}
+
+	// Report the progress of the upload if the client asked for it
+	var uploadedId string
+	if uploadId := UploadID(c); uploadId != "" {
+		progress := NewProgressReader(c.Request.Body, s.events, uploadId, c.Request.ContentLength)
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{progress, c.Request.Body}
+		defer func() {
+			var err error
+			if uploadedId == "" {
+				err = fmt.Errorf("upload failed with status %d", c.Writer.Status())
+			}
+			progress.Finish(uploadedId, err)
+		}()
+	}
+
+	// Check that the custom slug is valid and free before reading the
+	// contents. It is checked again when the file is saved.
+	slug := c.Query("slug")
+	if slug != "" {
+		var err error
+		if slug, err = ParseSlug(slug); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		taken, err := s.db.IsSlugTaken(ctx, slug)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "Slug is already taken"})
+			return
+		}
+	}
+
+	// Check for existing contents with the announced hash
+	var announcedHash string
+	if v := c.GetHeader(HashHeader); v != "" {
+		var ok bool
+		if announcedHash, ok = parseSha256(v); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid %s header", HashHeader)})
+			return
+		}
+	}
+	var existing *DbFile
+	if announcedHash != "" {
+		if !s.checkUploadBlocked(c, announcedHash, nil, nil) {
+			return
+		}
+
+		var err error
+		existing, err = s.findBlob(c, announcedHash)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Sniff the content type from the beginning of the upload, or of the
+	// existing contents
+	var detected *mimetype.MIME
+	var body io.Reader
+	var err error
+	if existing != nil {
+		detected, err = s.sniffBlob(ctx, existing.FilePath)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("reading existing file: %s", err)})
+			return
+		}
+	} else {
+		_, span := tracer.Start(ctx, "SniffReader")
+		detected, body, err = SniffReader(c.Request.Body)
+		endSpan(span, err)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("detecting mime type: %s", err)})
+			return
+		}
+	}
+
+	// Check the content type against the upload policy
+	contentType := c.GetHeader("Content-Type")
+	if err := cfg.CheckMime(detected, contentType); err != nil {
+		RequestLogger(c).Info("Rejecting upload", "mime", detected.String(), "error", err)
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	}
+	maxFileSize, maxTTL := cfg.LimitsForMime(detected)
+
+	// Get expiry from the query string, if it exists
+	expiry := c.Query("expiry")
+	if expiry == "" {
+		expiry = "24h"
+	}
+
+	// Parse the expiry
+	ttl, err := ParseExpiry(expiry)
+	if err != nil {
+		RequestLogger(c).Info("Rejecting upload with invalid expiry", "expiry", expiry, "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parsing expiry: %s", err)})
+		return
+	}
+
+	// Check if the expiry is within the allowed range. The default expiry
+	// is clamped instead of rejected.
+	if ttl > maxTTL {
+		if c.Query("expiry") == "" {
+			ttl = maxTTL
+		} else {
+			RequestLogger(c).Info("Rejecting upload with expiry too long", "ttl", ttl, "max_ttl", maxTTL)
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expiry too long (max %s)", maxTTL)})
+			return
+		}
+	}
+
+	// Parse the download limit
+	var maxDownloads int64
+	if v := c.Query("max_downloads"); v != "" {
+		maxDownloads, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxDownloads < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid max_downloads"})
+			return
+		}
+	}
+
+	// Private files can only be accessed with the key in their link
+	private := cfg.PrivateLinks
+	if v := c.Query("private"); v != "" {
+		private, err = strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid private"})
+			return
+		}
+	}
+
+	// Check if the file size is within the allowed range
+	size := c.Request.ContentLength
+	if existing != nil {
+		size = existing.Size
+	}
+	if size > maxFileSize {
+		RequestLogger(c).Info("Rejecting upload that is too large", "size", size, "max_size", maxFileSize)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file too large (max %d bytes)", maxFileSize)})
+		return
+	}
+
+	var blob *Blob
+	if existing != nil {
+		blob = &Blob{Path: existing.FilePath, Sha256: existing.Sha256, Size: existing.Size}
+	} else {
+		// Write the file to the filesystem, enforcing the size limit for
+		// uploads without a Content-Length
+		blob, err = writeFileTraced(ctx, s.fs, http.MaxBytesReader(c.Writer, io.NopCloser(body), maxFileSize))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file too large (max %d bytes)", maxFileSize)})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("writing file: %s", err)})
+			return
+		}
+
+		if announcedHash != "" && announcedHash != blob.Sha256 {
+			s.discardBlob(c, blob.Path)
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("contents do not match %s header", HashHeader)})
+			return
+		}
+	}
+
+	// Refuse contents that have been taken down, and images that look like
+	// them. Reused contents may have been stored before they were blocked.
+	if !s.checkUploadBlocked(c, blob.Sha256, blob, detected) {
+		if existing == nil {
+			s.discardBlob(c, blob.Path)
+		}
+		return
+	}
+
+	fileName := c.Param("name")
+	expiresAt := time.Now().Add(ttl)
+	clientIP := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	// If content type is empty, use the sniffed content type
+	if contentType == "" {
+		contentType = detected.String()
+	}
+
+	// Hold the file back until it has been scanned. Reused contents keep the
+	// result of their scan, or wait for the scan that is already queued.
+	scanStatus := ScanClean
+	if existing != nil {
+		scanStatus = existing.ScanStatus
+	} else if s.scans.Enabled() {
+		scanStatus = ScanPending
+	}
+
+	// Save the file to the database, along with a token that lets the
+	// uploader manage it
+	deleteToken := NewToken()
+	file := &DbFile{
+		FilePath:         blob.Path,
+		OriginalFilename: fileName,
+		MimeType:         contentType,
+		ExpiresAt:        expiresAt,
+		IPAddress:        clientIP,
+		UserAgent:        userAgent,
+		ScanStatus:       scanStatus,
+		DeleteTokenHash:  HashToken(deleteToken),
+		MaxDownloads:     maxDownloads,
+		Sha256:           blob.Sha256,
+		Size:             blob.Size,
+		Slug:             slug,
+	}
+	var accessKey string
+	if private {
+		accessKey = NewToken()
+		file.AccessKeyHash = HashToken(accessKey)
+	}
+	id, err := s.insertFile(ctx, file, cfg.IDFormat, existing != nil)
+	if err != nil {
+		// Delete the contents if saving to the database fails, unless they
+		// are shared with another file
+		if existing == nil {
+			s.discardBlob(c, blob.Path)
+		}
+		if errors.Is(err, ErrSlugTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Slug is already taken"})
+			return
+		}
+		// The existing file may have been collected since it was looked up
+		if errors.Is(err, ErrContentsGone) {
+			c.JSON(http.StatusConflict, gin.H{"error": "existing contents are no longer available, upload them again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("creating file record: %s", err)})
+		return
+	}
+	file.ID = id
+	setLogFileID(c, file)
+
+	// The shared contents are still referenced, but may have been lost from
+	// the storage
+	if existing != nil {
+		if _, err := s.sniffBlob(ctx, blob.Path); err != nil {
+			if err := s.db.RemoveFile(ctx, id); err != nil {
+				RequestLogger(c).Error("Failed to remove file with missing contents", "file_id", id, "path", blob.Path, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusConflict, gin.H{"error": "existing contents are no longer available, upload them again"})
+			return
+		}
+	}
+
+	if scanStatus == ScanPending && existing == nil {
+		s.scans.Enqueue(id)
+	}
+	s.events.Publish(EventFileUploaded, file)
+
+	uploadedId = file.PublicID()
+	res := gin.H{
+		"id":           file.PublicID(),
+		"expires_at":   expiresAt,
+		"scan_status":  scanStatus,
+		"delete_token": deleteToken,
+		"deduplicated": existing != nil,
+	}
+	if private {
+		res["key"] = accessKey
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// insertFile saves a new file record, which shares the contents of a live
+// file if shared is set. Files without a custom slug are given a random one
+// in the given format, which is generated again in the unlikely case that it
+// is taken.
+func (s *Server) insertFile(ctx context.Context, file *DbFile, format IDFormat, shared bool) (int64, error) {
+	insert := s.db.InsertFile
+	if shared {
+		insert = s.db.InsertSharedFile
+	}
+	if file.Slug != "" || format == IDBase36 {
+		return insert(ctx, file)
+	}
+
+	const attempts = 5
+	for i := 0; ; i++ {
+		file.Slug = NewSlug(format)
+		id, err := insert(ctx, file)
+		if !errors.Is(err, ErrSlugTaken) || i == attempts-1 {
+			return id, err
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -38,6 +39,21 @@ func ParseExpiry(expiry string) (time.Duration, error) {
 	}
 }
 
+// FormatExpiry formats a duration in the format accepted by ParseExpiry, using
+// the largest unit that represents it exactly.
+func FormatExpiry(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0 && d != 0:
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	case d%time.Hour == 0 && d != 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0 && d != 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	default:
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	}
+}
+
 // SleepWithContext sleeps for the specified duration, but can be interrupted by
 // the context.
 func SleepWithContext(ctx context.Context, d time.Duration) {
@@ -46,3 +62,39 @@ func SleepWithContext(ctx context.Context, d time.Duration) {
 	case <-time.After(d):
 	}
 }
+
+// splitList splits a comma-separated list, trimming whitespace and dropping
+// empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// AcceptsEncoding reports whether an Accept-Encoding header allows the given
+// content coding.
+func AcceptsEncoding(header, encoding string) bool {
+	wildcard := false
+	for _, entry := range splitList(header) {
+		name, params, _ := strings.Cut(entry, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		allowed := true
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			v, err := strconv.ParseFloat(q, 64)
+			allowed = err == nil && v > 0
+		}
+
+		switch name {
+		case encoding:
+			return allowed
+		case "*":
+			wildcard = allowed
+		}
+	}
+	return wildcard
+}
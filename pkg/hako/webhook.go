@@ -0,0 +1,272 @@
+package hako
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/fx"
+)
+
+// Webhooks delivers file lifecycle events to the configured endpoints. Events
+// are queued in the database first, so that deliveries survive restarts and
+// can be retried with exponential backoff.
+type Webhooks struct {
+	db     *DB
+	urls   []string
+	secret string
+	client *http.Client
+	wake   chan struct{}
+	done   chan struct{}
+
+	// submitted holds the events handed over by Submit until the delivery
+	// loop queues them.
+	submitted chan Event
+
+	// MaxAttempts is the number of delivery attempts before giving up.
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry, doubling on every
+	// subsequent attempt up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	Logger *slog.Logger
+}
+
+func NewWebhooks(db *DB, urls []string, secret string) *Webhooks {
+	return &Webhooks{
+		db:          db,
+		urls:        urls,
+		secret:      secret,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		submitted:   make(chan Event, 1024),
+		MaxAttempts: 10,
+		MinBackoff:  10 * time.Second,
+		MaxBackoff:  1 * time.Hour,
+		Logger:      slog.Default().With("component", "webhook"),
+	}
+}
+
+// Enqueue queues the event for delivery to every endpoint.
+func (w *Webhooks) Enqueue(ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	if err := w.db.EnqueueWebhook(context.Background(), w.urls, ev.Type, payload); err != nil {
+		return err
+	}
+
+	// Wake up the delivery loop without blocking
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Submit hands the event over to the delivery loop, which queues it with
+// Enqueue. Unlike Enqueue, it does not wait for the database, so it can be
+// called by event subscribers. If the loop falls too far behind, the event is
+// dropped.
+func (w *Webhooks) Submit(ev Event) {
+	select {
+	case w.submitted <- ev:
+	default:
+		w.Logger.Error("Dropping event, too many events are waiting to be queued", "type", ev.Type)
+		return
+	}
+
+	// Wake up the delivery loop without blocking
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueueSubmitted queues the events handed over by Submit.
+func (w *Webhooks) enqueueSubmitted() {
+	for {
+		select {
+		case ev := <-w.submitted:
+			if err := w.Enqueue(ev); err != nil {
+				w.Logger.Error("Failed to enqueue event", "type", ev.Type, "error", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Sign returns the value of the X-Hako-Signature header for the payload.
+func (w *Webhooks) Sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns the delay before the next attempt after the given number of
+// failed attempts.
+func (w *Webhooks) Backoff(attempts int) time.Duration {
+	backoff := w.MinBackoff
+	for i := 1; i < attempts && backoff < w.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, w.MaxBackoff)
+}
+
+// DeliverDue attempts to deliver every webhook that is due, and returns the
+// number of successful deliveries. Retries scheduled while delivering are left
+// for the next call.
+func (w *Webhooks) DeliverDue(ctx context.Context) (int, error) {
+	delivered := 0
+	now := time.Now()
+	for {
+		deliveries, err := w.db.ListDueWebhooks(ctx, now, w.MaxAttempts, 100)
+		if err != nil {
+			return delivered, err
+		}
+		if len(deliveries) == 0 {
+			return delivered, nil
+		}
+
+		for _, delivery := range deliveries {
+			// Check if the context is cancelled
+			select {
+			case <-ctx.Done():
+				return delivered, nil
+			default:
+			}
+
+			if err := w.deliver(ctx, &delivery); err != nil {
+				attempts := delivery.Attempts + 1
+				if attempts >= w.MaxAttempts {
+					w.Logger.Error("Giving up on delivery", "delivery_id", delivery.ID, "url", delivery.URL, "attempts", attempts, "error", err)
+				} else {
+					w.Logger.Warn("Failed to deliver", "delivery_id", delivery.ID, "url", delivery.URL, "attempt", attempts, "error", err)
+				}
+				if err := w.db.MarkWebhookFailed(ctx, delivery.ID, time.Now().Add(w.Backoff(attempts)), err.Error()); err != nil {
+					return delivered, err
+				}
+				continue
+			}
+
+			if err := w.db.MarkWebhookDelivered(ctx, delivery.ID); err != nil {
+				return delivered, err
+			}
+			delivered++
+		}
+	}
+}
+
+// deliver sends a single webhook request.
+func (w *Webhooks) deliver(ctx context.Context, delivery *WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "hako-webhook")
+	req.Header.Set("X-Hako-Event", string(delivery.Event))
+	req.Header.Set("X-Hako-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Hako-Signature", w.Sign(delivery.Payload))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return nil
+}
+
+// LoopForever runs the webhook delivery loop.
+func (w *Webhooks) LoopForever(ctx context.Context) {
+	w.Logger.Info("Start")
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	lastPrune := time.Time{}
+	for {
+		w.enqueueSubmitted()
+		if _, err := w.DeliverDue(ctx); err != nil {
+			w.Logger.Error("Failed to deliver webhooks", "error", err)
+		}
+
+		// Prune old deliveries once an hour
+		if time.Since(lastPrune) > 1*time.Hour {
+			lastPrune = time.Now()
+			if _, err := w.db.PruneWebhookDeliveries(ctx, time.Now().Add(-7*24*time.Hour), w.MaxAttempts); err != nil {
+				w.Logger.Error("Failed to prune deliveries", "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			// Queue the events submitted last, to deliver them after a restart
+			w.enqueueSubmitted()
+			w.Logger.Info("Stop")
+			close(w.done)
+			return
+		case <-w.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Done returns a channel that will be closed when the delivery loop is done.
+func (w *Webhooks) Done() <-chan struct{} {
+	return w.done
+}
+
+// FxNewWebhooks creates a new Webhooks instance for Fx, subscribed to all file
+// events, which are submitted to the delivery loop so that publishing them
+// does not wait for the database. Nothing is delivered when no webhook URLs
+// are configured.
+func FxNewWebhooks(cfg *Config, db *DB, events *Events, logger *slog.Logger, lc fx.Lifecycle) *Webhooks {
+	w := NewWebhooks(db, cfg.WebhookURLs, cfg.WebhookSecret)
+	w.Logger = logger.With("component", "webhook")
+	if len(cfg.WebhookURLs) == 0 {
+		return w
+	}
+
+	events.Subscribe(func(ev Event) {
+		if ev.File == nil {
+			return
+		}
+		w.Submit(ev)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go w.LoopForever(ctx)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			<-w.Done()
+			return nil
+		},
+	})
+
+	return w
+}
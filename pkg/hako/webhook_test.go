@@ -0,0 +1,162 @@
+package hako_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hizkifw/hako/pkg/hako"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooks(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	// Endpoint that fails the first request
+	var mu sync.Mutex
+	var bodies [][]byte
+	var signatures []string
+	failures := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		signatures = append(signatures, r.Header.Get("X-Hako-Signature"))
+	}))
+	defer srv.Close()
+
+	webhooks := hako.NewWebhooks(db, []string{srv.URL}, "secret")
+	webhooks.MinBackoff = 1 * time.Millisecond
+
+	events := hako.NewEvents()
+	unsubscribe := events.Subscribe(func(ev hako.Event) {
+		assert.Nil(webhooks.Enqueue(ev), "Failed to enqueue event")
+	})
+	events.Publish(hako.EventFileUploaded, &hako.DbFile{ID: 36, OriginalFilename: "file.txt", MimeType: "text/plain"})
+	unsubscribe()
+	events.Publish(hako.EventFileDownloaded, &hako.DbFile{ID: 36})
+
+	// First attempt fails
+	delivered, err := webhooks.DeliverDue(ctx)
+	assert.Nil(err, "Failed to deliver webhooks")
+	assert.Zero(delivered, "No webhooks should be delivered")
+
+	// Retry after the backoff succeeds
+	time.Sleep(10 * time.Millisecond)
+	delivered, err = webhooks.DeliverDue(ctx)
+	assert.Nil(err, "Failed to deliver webhooks")
+	assert.Equal(1, delivered, "One webhook should be delivered")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(bodies, 1, "Endpoint should receive one event")
+
+	var ev hako.Event
+	assert.Nil(json.Unmarshal(bodies[0], &ev), "Failed to unmarshal payload")
+	assert.Equal(hako.EventFileUploaded, ev.Type, "Event type mismatch")
+	assert.Equal("10", ev.File.ID, "File ID should be base36")
+	assert.Equal("file.txt", ev.File.Filename, "Filename mismatch")
+	assert.Equal(webhooks.Sign(bodies[0]), signatures[0], "Signature mismatch")
+	assert.Equal("sha256=", signatures[0][:7], "Signature should be prefixed with the algorithm")
+
+	delivery, err := db.GetWebhookDelivery(ctx, 1)
+	assert.Nil(err, "Failed to get delivery")
+	assert.Equal(2, delivery.Attempts, "Delivery should take two attempts")
+	assert.NotNil(delivery.DeliveredAt, "Delivery should be marked delivered")
+}
+
+func TestWebhooksSubmit(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	received := make(chan hako.EventType, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- hako.EventType(r.Header.Get("X-Hako-Event"))
+	}))
+	defer srv.Close()
+
+	webhooks := hako.NewWebhooks(db, []string{srv.URL}, "secret")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-webhooks.Done()
+	}()
+	go webhooks.LoopForever(ctx)
+
+	// Submitted events are queued and delivered by the loop
+	webhooks.Submit(hako.Event{Type: hako.EventFileUploaded, File: &hako.FileInfo{ID: "10"}})
+	select {
+	case typ := <-received:
+		assert.Equal(hako.EventFileUploaded, typ, "Event type mismatch")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Submitted event was not delivered")
+	}
+}
+
+func TestWebhooksBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	webhooks := hako.NewWebhooks(nil, nil, "")
+	webhooks.MinBackoff = 1 * time.Second
+	webhooks.MaxBackoff = 10 * time.Second
+
+	assert.Equal(1*time.Second, webhooks.Backoff(1), "First retry backoff mismatch")
+	assert.Equal(2*time.Second, webhooks.Backoff(2), "Second retry backoff mismatch")
+	assert.Equal(8*time.Second, webhooks.Backoff(4), "Fourth retry backoff mismatch")
+	assert.Equal(10*time.Second, webhooks.Backoff(10), "Backoff should be capped")
+}
+
+func TestWebhooksGiveUp(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db, err := hako.NewDB(":memory:")
+	assert.Nil(err, "Failed to create database")
+	assert.Nil(db.Migrate(), "Failed to migrate database")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	webhooks := hako.NewWebhooks(db, []string{srv.URL}, "secret")
+	webhooks.MinBackoff = 0
+	webhooks.MaxAttempts = 3
+	assert.Nil(webhooks.Enqueue(hako.Event{Type: hako.EventFileExpired}), "Failed to enqueue event")
+
+	for i := 0; i < 5; i++ {
+		delivered, err := webhooks.DeliverDue(context.Background())
+		assert.Nil(err, "Failed to deliver webhooks")
+		assert.Zero(delivered, "No webhooks should be delivered")
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	delivery, err := db.GetWebhookDelivery(ctx, 1)
+	assert.Nil(err, "Failed to get delivery")
+	assert.Equal(3, delivery.Attempts, "Delivery should stop after the maximum attempts")
+	assert.Nil(delivery.DeliveredAt, "Delivery should not be marked delivered")
+	assert.Contains(delivery.LastError, "502", "Last error should be recorded")
+
+	due, err := db.ListDueWebhooks(ctx, time.Now(), webhooks.MaxAttempts, 100)
+	assert.Nil(err, "Failed to list due webhooks")
+	assert.Empty(due, "Exhausted deliveries should not be due")
+}